@@ -0,0 +1,189 @@
+// Package bft holds a PBFT style consensus for a permissioned network: a
+// fixed set of n replicas agree on every block before it is appended, and
+// the chain stays safe while no more than f = (n-1)/3 of them are crashed
+// or lying.
+//
+// Blocks are only made on request. A client signs a request transaction
+// with the BPM and sends it to any replica, which passes it on to the
+// others. For every height the replicas go through views, each with its
+// own leader taken in turn from the sorted replicas:
+//
+//  1. the leader proposes a block with the oldest pending request
+//  2. every replica that finds the proposal valid broadcasts a prepare vote
+//  3. a replica that sees 2f+1 prepares for the block locks on it and
+//     broadcasts a commit vote
+//  4. a replica that sees 2f+1 commits appends the block with those commit
+//     votes as its QuorumCert, and broadcasts it as decided
+//
+// If no block is decided in time, replicas give up on the view and move to
+// the next one, and the next leader. The new leader collects 2f+1 newview
+// messages, which carry the senders' locks, and proposes the block with
+// the highest lock again, so a block that may have been decided anywhere
+// can't be replaced. A replica only prepares a block other than the one it
+// is locked on if the proposal carries 2f+1 prepares for it from a later
+// view than its lock.
+//
+// The commit certificate travels in the block (see chain.QuorumCert), so
+// any node can check that a block was agreed on without taking part.
+package bft
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"blockchain-go/chain"
+)
+
+// Vote and message types
+const (
+	// VotePropose is the leader's vote for the block it proposes
+	VotePropose = "propose"
+	// VotePrepare says a replica found the proposal valid
+	VotePrepare = "prepare"
+	// VoteCommit says a replica saw 2f+1 prepares for the block and is
+	// locked on it
+	VoteCommit = "commit"
+	// VoteNewView says a replica gave up on the views before Round
+	VoteNewView = "newview"
+	// MsgRequest carries a client request to the other replicas
+	MsgRequest = "request"
+	// MsgDecide carries a block with its commit certificate
+	MsgDecide = "decide"
+	// MsgSync asks the other replicas for the decided blocks from Height on
+	MsgSync = "sync"
+)
+
+// TxRequest is the transaction type of client requests. Its Amount is the
+// BPM the block is made for, and it must be signed by From.
+const TxRequest = "request"
+
+var (
+	// ErrNotReplica is returned for blocks or votes by someone who isn't a replica
+	ErrNotReplica = errors.New("bft: not a replica")
+	// ErrBadQC is returned for blocks without a valid commit certificate
+	ErrBadQC = errors.New("bft: invalid quorum certificate")
+	// ErrBadRequest is returned for blocks that don't hold exactly one valid request
+	ErrBadRequest = errors.New("bft: invalid request")
+	// ErrStalled is returned by Replica.Err when the replica's chain
+	// refused a block the replicas decided
+	ErrStalled = errors.New("bft: replica can't append a decided block")
+)
+
+// Quorum is the number of votes out of n replicas that proves agreement,
+// 2f+1 with f = (n-1)/3. Any two quorums share at least one honest replica.
+func Quorum(n int) int {
+	return 2*n/3 + 1
+}
+
+// Leader returns the leader of view at height. The turn moves on with
+// every height, so one slow replica doesn't lead every first view.
+func Leader(replicas []string, height, view int) string {
+	return replicas[(height+view)%len(replicas)]
+}
+
+// CheckQC checks that qc holds valid votes of type typ from a quorum of
+// replicas, all for the same block at the same height and round
+func CheckQC(qc *chain.QuorumCert, replicas []string, typ string) error {
+	if qc == nil {
+		return fmt.Errorf("%w: missing", ErrBadQC)
+	}
+	if qc.Type != typ {
+		return fmt.Errorf("%w: %s certificate, want %s", ErrBadQC, qc.Type, typ)
+	}
+	voted := make(map[string]bool)
+	for _, v := range qc.Votes {
+		if v.Type != qc.Type || v.Height != qc.Height || v.Round != qc.Round || v.Hash != qc.Hash {
+			return fmt.Errorf("%w: %s vote by %s is for another block", ErrBadQC, v.Type, v.Validator)
+		}
+		if !slices.Contains(replicas, v.Validator) {
+			return fmt.Errorf("%w: %s", ErrNotReplica, v.Validator)
+		}
+		if err := chain.VerifyVote(v); err != nil {
+			return err
+		}
+		voted[v.Validator] = true
+	}
+	if len(voted) < Quorum(len(replicas)) {
+		return fmt.Errorf("%w: %d of %d replicas voted, need %d", ErrBadQC, len(voted), len(replicas), Quorum(len(replicas)))
+	}
+	return nil
+}
+
+// Verifier makes a chain.Chain check that every block was proposed by a
+// replica, holds one signed request for its BPM, and carries the commit
+// votes of a quorum of replicas for it. chain already checks the
+// proposer's signature. Whether a request was decided before is not
+// checked here: honest replicas refuse to prepare it, so no quorum does.
+type Verifier struct {
+	// Replicas are the replica addresses, sorted
+	Replicas []string
+}
+
+// NewVerifier returns the Verifier for the chain that starts with g
+func NewVerifier(g *chain.Genesis) Verifier {
+	return Verifier{Replicas: slices.Sorted(slices.Values(g.Replicas))}
+}
+
+func (v Verifier) VerifyBlock(b chain.Block, prev []chain.Block) error {
+	if err := v.CheckProposal(b); err != nil {
+		return err
+	}
+	if err := CheckQC(b.QC, v.Replicas, VoteCommit); err != nil {
+		return fmt.Errorf("index %d: %w", b.Index, err)
+	}
+	if b.QC.Height != b.Index || b.QC.Hash != b.Hash {
+		return fmt.Errorf("%w: index %d: certificate is for %s at %d", ErrBadQC, b.Index, b.QC.Hash, b.QC.Height)
+	}
+	return nil
+}
+
+// CheckProposal checks everything about b but its certificate, which a
+// proposal doesn't have yet
+func (v Verifier) CheckProposal(b chain.Block) error {
+	if !slices.Contains(v.Replicas, b.Validator) {
+		return fmt.Errorf("%w: index %d: proposed by %q", ErrNotReplica, b.Index, b.Validator)
+	}
+	if len(b.Txs) != 1 || b.Txs[0].Type != TxRequest {
+		return fmt.Errorf("%w: index %d: %d transactions", ErrBadRequest, b.Index, len(b.Txs))
+	}
+	if req := b.Txs[0]; req.Amount != uint64(b.BPM) {
+		return fmt.Errorf("%w: index %d: request for BPM %d in a block for %d", ErrBadRequest, b.Index, req.Amount, b.BPM)
+	}
+	return chain.VerifyTx(b.Txs[0])
+}
+
+// Extends is the BFT fork choice: decided blocks are final, so the only
+// chain that may replace ours is a longer one that contains it, such as
+// the chain of a replica that decided blocks while we were down
+func Extends(current, candidate []chain.Block) bool {
+	tip := current[len(current)-1]
+	return len(candidate) > len(current) && candidate[tip.Index].Hash == tip.Hash
+}
+
+// Message is what replicas send each other. Which fields are set depends
+// on Type:
+//
+//	propose  Block, the leader's propose Vote, and QC with the prepares
+//	         that justify it if it isn't a new block
+//	prepare  Vote
+//	commit   Vote
+//	newview  Vote, and Block and QC with the sender's lock if it has one
+//	request  Tx
+//	decide   Block, with its QC
+//	sync     Height
+type Message struct {
+	Type   string
+	Block  *chain.Block      `json:",omitempty"`
+	Vote   *chain.Vote       `json:",omitempty"`
+	QC     *chain.QuorumCert `json:",omitempty"`
+	Tx     *chain.Tx         `json:",omitempty"`
+	Height int               `json:",omitempty"`
+}
+
+// Transport carries messages between replicas
+type Transport interface {
+	// Broadcast sends m to every other replica. It must not block for
+	// long; messages may be lost.
+	Broadcast(m Message)
+}
@@ -0,0 +1,582 @@
+package bft
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"blockchain-go/chain"
+)
+
+// maxView caps how far the view timeout doubles, 1<<maxView times the base
+const maxView = 6
+
+// syncBatch is the most decided blocks sent for one sync request
+const syncBatch = 64
+
+// round is the votes of one type in one view of the current height
+type round struct {
+	Type string
+	View int
+}
+
+// Replica takes part in the BFT consensus for one chain.Chain: it proposes
+// blocks when it leads, votes on the proposals of others, and appends the
+// blocks a quorum decided on. All its state is kept by one goroutine,
+// started by Start, that handles messages one at a time.
+type Replica struct {
+	chain     *chain.Chain
+	key       ed25519.PrivateKey
+	address   string
+	replicas  []string
+	verifier  Verifier
+	timeout   time.Duration
+	transport Transport
+
+	inbox chan Message
+	quit  chan struct{}
+	done  chan struct{}
+
+	errMu sync.Mutex
+	err   error
+
+	// everything below is only touched by the run goroutine
+
+	height, view int
+	// requests are the pending client requests, oldest first, and
+	// committed the hashes of the requests already decided
+	requests  []chain.Tx
+	committed map[string]bool
+	// proposal is the block accepted in this view, nil if none yet
+	proposal *chain.Block
+	// lock is the block this replica sent a commit for, and lockQC the
+	// prepares that made it do so
+	lock   *chain.Block
+	lockQC *chain.QuorumCert
+	votes  map[round]map[string]chain.Vote
+	// newViews holds the newview messages of this height by view and sender
+	newViews map[int]map[string]Message
+	// proposals for views this replica hasn't reached yet
+	proposals  map[int]Message
+	proposed   bool
+	committing bool
+	// later holds the messages for the next height
+	later    []Message
+	timer    *time.Timer
+	lastSync time.Time
+	// self holds the messages this replica sent, for it to handle too
+	self []Message
+	// stalled is set while the chain refuses the block decided at height:
+	// the replica stops voting, as it would vote on top of a chain the
+	// others don't have, and asks for the decided blocks until one goes in
+	stalled bool
+}
+
+// NewReplica creates a replica of c that votes with key, one of replicas.
+// timeout is how long the first view of a height lasts; every later view
+// lasts twice as long as the one before.
+func NewReplica(c *chain.Chain, key ed25519.PrivateKey, replicas []string, timeout time.Duration, t Transport) (*Replica, error) {
+	replicas = slices.Sorted(slices.Values(replicas))
+	address := chain.Address(key.Public().(ed25519.PublicKey))
+	if !slices.Contains(replicas, address) {
+		return nil, fmt.Errorf("%w: %s", ErrNotReplica, address)
+	}
+	if timeout <= 0 {
+		return nil, errors.New("bft: view timeout must be positive")
+	}
+	timer := time.NewTimer(0)
+	timer.Stop()
+	return &Replica{
+		chain:     c,
+		key:       key,
+		address:   address,
+		replicas:  replicas,
+		verifier:  Verifier{Replicas: replicas},
+		timeout:   timeout,
+		transport: t,
+		inbox:     make(chan Message, 1024),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+		committed: make(map[string]bool),
+		timer:     timer,
+	}, nil
+}
+
+// Address returns the address of the replica
+func (r *Replica) Address() string {
+	return r.address
+}
+
+// Err returns why the replica stopped taking part, wrapping ErrStalled,
+// or nil while it does
+func (r *Replica) Err() error {
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	return r.err
+}
+
+func (r *Replica) setErr(err error) {
+	r.errMu.Lock()
+	defer r.errMu.Unlock()
+	r.err = err
+}
+
+// Start runs the replica until Stop
+func (r *Replica) Start() {
+	for _, b := range r.chain.Blocks() {
+		for _, tx := range b.Txs {
+			r.committed[tx.Hash()] = true
+		}
+	}
+	go r.run()
+}
+
+// Stop stops the replica and waits for it
+func (r *Replica) Stop() {
+	close(r.quit)
+	<-r.done
+}
+
+// Handle hands the replica a message from another replica
+func (r *Replica) Handle(m Message) {
+	select {
+	case r.inbox <- m:
+	case <-r.quit:
+	}
+}
+
+// Submit queues a client request and passes it on to the other replicas
+func (r *Replica) Submit(tx chain.Tx) error {
+	if tx.Type != TxRequest {
+		return fmt.Errorf("%w: type %q", ErrBadRequest, tx.Type)
+	}
+	if err := chain.VerifyTx(tx); err != nil {
+		return err
+	}
+	r.Handle(Message{Type: MsgRequest, Tx: &tx})
+	return nil
+}
+
+func (r *Replica) run() {
+	defer close(r.done)
+	r.enterHeight()
+	//blocks may have been decided while this replica was down
+	r.requestSync()
+	for {
+		select {
+		case <-r.quit:
+			r.timer.Stop()
+			return
+		case m := <-r.inbox:
+			r.handle(m)
+		case <-r.timer.C:
+			if r.stalled {
+				r.requestSync()
+				r.timer.Reset(r.timeout)
+			} else {
+				r.timedOut()
+			}
+		}
+		//handle what this replica sent itself, in the order it sent it
+		for len(r.self) > 0 {
+			m := r.self[0]
+			r.self = r.self[1:]
+			r.handle(m)
+		}
+	}
+}
+
+// send broadcasts m and handles it here too
+func (r *Replica) send(m Message) {
+	r.transport.Broadcast(m)
+	r.self = append(r.self, m)
+}
+
+// vote signs a vote of type typ for hash in the current view and sends it
+func (r *Replica) vote(typ, hash string) *chain.Vote {
+	v := &chain.Vote{Type: typ, Height: r.height, Round: r.view, Hash: hash}
+	v.Sign(r.key)
+	return v
+}
+
+// enterHeight starts on the block after the tip
+func (r *Replica) enterHeight() {
+	tip := r.chain.Tip()
+	for _, tx := range tip.Txs {
+		r.committed[tx.Hash()] = true
+	}
+	r.requests = slices.DeleteFunc(r.requests, func(tx chain.Tx) bool { return r.committed[tx.Hash()] })
+	r.height = tip.Index + 1
+	r.lock, r.lockQC = nil, nil
+	r.votes = make(map[round]map[string]chain.Vote)
+	r.newViews = make(map[int]map[string]Message)
+	r.proposals = make(map[int]Message)
+	r.enterView(0)
+
+	later := r.later
+	r.later = nil
+	for _, m := range later {
+		r.handle(m)
+	}
+}
+
+// enterView moves to view of the current height
+func (r *Replica) enterView(view int) {
+	r.view = view
+	r.proposal = nil
+	r.proposed = false
+	r.committing = false
+	r.resetTimer()
+	r.propose()
+	if m, ok := r.proposals[view]; ok {
+		delete(r.proposals, view)
+		r.handleProposal(m)
+	}
+}
+
+// resetTimer starts the view timer if there is something to agree on
+func (r *Replica) resetTimer() {
+	r.timer.Stop()
+	if len(r.requests) == 0 && r.lock == nil {
+		return
+	}
+	r.timer.Reset(r.timeout << min(r.view, maxView))
+}
+
+// timedOut gives up on the current view: the replica tells the others,
+// with its lock, and moves on to the next view
+func (r *Replica) timedOut() {
+	log.Printf("bft: height %d view %d timed out, leader was %s", r.height, r.view, Leader(r.replicas, r.height, r.view))
+	r.sendNewView(r.view + 1)
+	r.enterView(r.view + 1)
+}
+
+func (r *Replica) sendNewView(view int) {
+	v := &chain.Vote{Type: VoteNewView, Height: r.height, Round: view}
+	if r.lock != nil {
+		v.Hash = r.lock.Hash
+	}
+	v.Sign(r.key)
+	r.send(Message{Type: VoteNewView, Vote: v, Block: r.lock, QC: r.lockQC})
+}
+
+// propose makes the leader of the view propose: the highest lock reported
+// in the newview messages if there is one, else a new block for the oldest
+// request. Only the first view may start without 2f+1 newviews.
+func (r *Replica) propose() {
+	if r.stalled || r.proposed || Leader(r.replicas, r.height, r.view) != r.address {
+		return
+	}
+	var b *chain.Block
+	var justify *chain.QuorumCert
+	if r.view > 0 {
+		if len(r.newViews[r.view]) < Quorum(len(r.replicas)) {
+			return
+		}
+		b, justify = r.lock, r.lockQC
+		for _, m := range r.newViews[r.view] {
+			if m.QC != nil && (justify == nil || m.QC.Round > justify.Round) {
+				b, justify = m.Block, m.QC
+			}
+		}
+	}
+	if b == nil {
+		if len(r.requests) == 0 {
+			return
+		}
+		req := r.requests[0]
+		tip := r.chain.Tip()
+		next := chain.GenerateBlock(tip, int(req.Amount))
+		next.Txs = []chain.Tx{req}
+		next.TxRoot = chain.TxRoot(next.Txs)
+		next.Sign(r.key)
+		b = &next
+	}
+	r.proposed = true
+	r.send(Message{Type: VotePropose, Block: b, Vote: r.vote(VotePropose, b.Hash), QC: justify})
+}
+
+func (r *Replica) handle(m Message) {
+	switch m.Type {
+	case MsgRequest:
+		r.handleRequest(m)
+		return
+	case MsgDecide:
+		r.handleDecide(m)
+		return
+	case MsgSync:
+		r.handleSync(m)
+		return
+	}
+	if m.Vote == nil || r.stalled {
+		return
+	}
+	v := *m.Vote
+	if v.Height < r.height {
+		return
+	}
+	if v.Height > r.height {
+		if v.Height == r.height+1 && len(r.later) < cap(r.inbox) {
+			r.later = append(r.later, m)
+		}
+		r.requestSync()
+		return
+	}
+	if v.Type != m.Type || !slices.Contains(r.replicas, v.Validator) || chain.VerifyVote(v) != nil {
+		log.Printf("bft: dropped a %s for height %d from %q that doesn't check out", m.Type, v.Height, v.Validator)
+		return
+	}
+	switch m.Type {
+	case VotePropose:
+		r.handleProposal(m)
+	case VotePrepare, VoteCommit:
+		r.handleVote(v)
+	case VoteNewView:
+		r.handleNewView(m)
+	}
+}
+
+func (r *Replica) handleRequest(m Message) {
+	if m.Tx == nil || m.Tx.Type != TxRequest || chain.VerifyTx(*m.Tx) != nil {
+		return
+	}
+	hash := m.Tx.Hash()
+	if r.committed[hash] || slices.ContainsFunc(r.requests, func(tx chain.Tx) bool { return tx.Hash() == hash }) {
+		return
+	}
+	r.requests = append(r.requests, *m.Tx)
+	//pass it on the first time, so the request gets to every replica even
+	//if the one the client sent it to crashes
+	r.transport.Broadcast(m)
+	if len(r.requests) == 1 && r.lock == nil {
+		r.resetTimer()
+	}
+	r.propose()
+}
+
+// handleProposal prepares the leader's block if it is valid, and safe
+// given this replica's lock
+func (r *Replica) handleProposal(m Message) {
+	v, b := *m.Vote, m.Block
+	if b == nil || v.Hash != b.Hash || v.Validator != Leader(r.replicas, r.height, v.Round) {
+		return
+	}
+	if v.Round > r.view {
+		r.proposals[v.Round] = m
+		return
+	}
+	if v.Round < r.view || r.proposal != nil {
+		return
+	}
+	if err := r.check(*b); err != nil {
+		log.Printf("bft: height %d view %d: rejected proposal %s: %v", r.height, r.view, b.Hash, err)
+		return
+	}
+	if r.lock != nil && r.lock.Hash != b.Hash {
+		justify := m.QC
+		if justify == nil || justify.Hash != b.Hash || justify.Height != r.height || justify.Round <= r.lockQC.Round ||
+			CheckQC(justify, r.replicas, VotePrepare) != nil {
+			log.Printf("bft: height %d view %d: locked on %s, not preparing %s", r.height, r.view, r.lock.Hash, b.Hash)
+			return
+		}
+	}
+	r.proposal = b
+	r.send(Message{Type: VotePrepare, Vote: r.vote(VotePrepare, b.Hash)})
+	r.progress()
+}
+
+// check checks a proposed block the way the chain will once it is decided
+func (r *Replica) check(b chain.Block) error {
+	blocks := r.chain.Blocks()
+	if !chain.IsBlockValid(b, blocks[len(blocks)-1]) {
+		return fmt.Errorf("%w: index %d", chain.ErrInvalidBlock, b.Index)
+	}
+	if err := r.chain.Rules().CheckTimestamp(b, blocks, time.Now()); err != nil {
+		return err
+	}
+	if err := r.verifier.CheckProposal(b); err != nil {
+		return err
+	}
+	if r.committed[b.Txs[0].Hash()] {
+		return fmt.Errorf("%w: %s was decided before", ErrBadRequest, b.Txs[0].Hash())
+	}
+	return nil
+}
+
+func (r *Replica) handleVote(v chain.Vote) {
+	rd := round{v.Type, v.Round}
+	if r.votes[rd] == nil {
+		r.votes[rd] = make(map[string]chain.Vote)
+	}
+	if old, ok := r.votes[rd][v.Validator]; ok {
+		if old.Hash != v.Hash {
+			log.Printf("bft: %s sent two %s votes in height %d view %d", v.Validator, v.Type, v.Height, v.Round)
+		}
+		return
+	}
+	r.votes[rd][v.Validator] = v
+	r.progress()
+}
+
+// qc returns the certificate of votes of type typ in view for hash, nil
+// while fewer than a quorum voted for it
+func (r *Replica) qc(typ string, view int, hash string) *chain.QuorumCert {
+	qc := &chain.QuorumCert{Type: typ, Height: r.height, Round: view, Hash: hash}
+	for _, v := range r.votes[round{typ, view}] {
+		if v.Hash == hash {
+			qc.Votes = append(qc.Votes, v)
+		}
+	}
+	if len(qc.Votes) < Quorum(len(r.replicas)) {
+		return nil
+	}
+	slices.SortFunc(qc.Votes, func(a, b chain.Vote) int { return strings.Compare(a.Validator, b.Validator) })
+	return qc
+}
+
+// progress acts on the votes counted so far: commit to the proposal once
+// it is prepared, and decide any block with enough commits
+func (r *Replica) progress() {
+	if p := r.proposal; p != nil && !r.committing {
+		if qc := r.qc(VotePrepare, r.view, p.Hash); qc != nil {
+			r.committing = true
+			r.lock, r.lockQC = p, qc
+			r.send(Message{Type: VoteCommit, Vote: r.vote(VoteCommit, p.Hash)})
+		}
+	}
+	for _, b := range []*chain.Block{r.proposal, r.lock} {
+		if b == nil {
+			continue
+		}
+		for rd := range r.votes {
+			if rd.Type != VoteCommit {
+				continue
+			}
+			if qc := r.qc(VoteCommit, rd.View, b.Hash); qc != nil {
+				decided := *b
+				decided.QC = qc
+				r.decide(decided)
+				return
+			}
+		}
+	}
+}
+
+// decide appends b, which carries a valid commit certificate, tells the
+// other replicas and moves on to the next height. If the chain refuses b,
+// e.g. because it was given other blocks meanwhile or its clock is off,
+// the replica stalls: it stops voting, reports the error through Err and
+// asks the others for the decided blocks until its chain takes them.
+func (r *Replica) decide(b chain.Block) {
+	if err := r.chain.Append(b); err != nil {
+		if r.chain.Tip().Index >= b.Index {
+			//the chain got to this height without us, carry on from its tip
+			log.Printf("bft: chain is at %d, past decided block %d", r.chain.Tip().Index, b.Index)
+			r.enterHeight()
+			return
+		}
+		if !r.stalled {
+			log.Printf("bft: could not append decided block %d, no longer voting: %v", b.Index, err)
+			r.stalled = true
+			r.setErr(fmt.Errorf("%w: index %d: %w", ErrStalled, b.Index, err))
+			r.timer.Reset(r.timeout)
+		}
+		r.requestSync()
+		return
+	}
+	if r.stalled {
+		log.Printf("bft: appended decided block %d, voting again", b.Index)
+		r.stalled = false
+		r.setErr(nil)
+	}
+	//a decided block is final, no fork may revert it
+	r.chain.Finalize(b.Index, b.Hash)
+	r.transport.Broadcast(Message{Type: MsgDecide, Block: &b})
+	r.enterHeight()
+}
+
+// handleDecide appends a block another replica decided. Only a block that
+// carries a valid commit certificate counts: anyone can send a decide, and
+// a block the chain refuses makes this replica stall.
+func (r *Replica) handleDecide(m Message) {
+	if m.Block == nil {
+		return
+	}
+	switch {
+	case m.Block.Index == r.height:
+		if err := r.certified(*m.Block); err != nil {
+			log.Printf("bft: dropped decided block %d: %v", m.Block.Index, err)
+			return
+		}
+		r.decide(*m.Block)
+	case m.Block.Index > r.height:
+		r.requestSync()
+	}
+}
+
+// certified checks that b is a whole block, signed by its proposer, that a
+// quorum of replicas committed to
+func (r *Replica) certified(b chain.Block) error {
+	if chain.CalculateHash(b) != b.Hash || chain.TxRoot(b.Txs) != b.TxRoot {
+		return fmt.Errorf("%w: index %d", chain.ErrInvalidBlock, b.Index)
+	}
+	if err := chain.VerifySignature(b); err != nil {
+		return err
+	}
+	return r.verifier.VerifyBlock(b, nil)
+}
+
+// handleNewView counts a replica's move to a later view. f+1 of them
+// prove an honest replica timed out, so this one follows; with 2f+1 the
+// new leader can propose.
+func (r *Replica) handleNewView(m Message) {
+	v := *m.Vote
+	if v.Round < r.view {
+		return
+	}
+	if m.QC != nil {
+		if m.Block == nil || m.QC.Hash != m.Block.Hash || m.QC.Height != r.height || m.Block.Hash != v.Hash ||
+			CheckQC(m.QC, r.replicas, VotePrepare) != nil {
+			return
+		}
+	} else {
+		m.Block = nil
+	}
+	if r.newViews[v.Round] == nil {
+		r.newViews[v.Round] = make(map[string]Message)
+	}
+	r.newViews[v.Round][v.Validator] = m
+
+	if v.Round > r.view && len(r.newViews[v.Round]) > (len(r.replicas)-1)/3 {
+		if _, ok := r.newViews[v.Round][r.address]; !ok {
+			r.sendNewView(v.Round)
+		}
+		r.enterView(v.Round)
+		return
+	}
+	r.propose()
+}
+
+// requestSync asks the others for the blocks this replica is missing, at
+// most once per view timeout
+func (r *Replica) requestSync() {
+	if time.Since(r.lastSync) < r.timeout {
+		return
+	}
+	r.lastSync = time.Now()
+	r.transport.Broadcast(Message{Type: MsgSync, Height: r.height})
+}
+
+// handleSync sends the decided blocks a lagging replica asked for
+func (r *Replica) handleSync(m Message) {
+	for i := max(m.Height, 1); i < r.height && i < m.Height+syncBatch; i++ {
+		if b, ok := r.chain.Get(i); ok {
+			r.transport.Broadcast(Message{Type: MsgDecide, Block: &b})
+		}
+	}
+}
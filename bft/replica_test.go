@@ -0,0 +1,316 @@
+package bft_test
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"blockchain-go/bft"
+	"blockchain-go/chain"
+)
+
+// The tests run replicas in this process, over a simulated network that
+// delays every message at random, and send them client requests. Some
+// replicas are faulty:
+//
+//   - crashed replicas stop half way through, like a crashed process
+//   - equivocating replicas send two different proposals when they lead
+//   - lying replicas vote for blocks that don't exist and send decided
+//     blocks with forged certificates
+//   - forging replicas send decides for empty blocks at the height being
+//     voted on, instead of their votes
+//
+// Honest replicas can also stall: their chain refuses decided blocks for
+// the first half of the requests, so they stop voting until it takes them.
+//
+// Whatever the faulty ones do, no two honest replicas may decide different
+// blocks at the same height, and with at most (n-1)/3 of them faulty every
+// request has to be decided, once.
+
+const (
+	requests = 10
+	timeout  = 200 * time.Millisecond
+	delay    = 10 * time.Millisecond
+	wait     = 30 * time.Second
+)
+
+func TestMain(m *testing.M) {
+	//the replicas log every view change
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// network delivers messages between the replicas of a test
+type network struct {
+	mu       sync.Mutex
+	replicas []*bft.Replica
+	down     []bool
+}
+
+// deliver hands m to replica to after a random delay, unless it is down
+func (n *network) deliver(to int, m bft.Message) {
+	//a round trip through JSON, so no replica shares memory with another
+	data, _ := json.Marshal(m)
+	var copied bft.Message
+	json.Unmarshal(data, &copied)
+	go func() {
+		time.Sleep(rand.N(delay + 1))
+		n.mu.Lock()
+		r, down := n.replicas[to], n.down[to]
+		n.mu.Unlock()
+		if !down {
+			r.Handle(copied)
+		}
+	}()
+}
+
+// link is the Transport of replica from
+type link struct {
+	net  *network
+	from int
+	// alter, if set, changes what a faulty replica sends to replica to
+	alter func(to int, m bft.Message) bft.Message
+}
+
+func (l link) Broadcast(m bft.Message) {
+	for to := range l.net.replicas {
+		if to == l.from {
+			continue
+		}
+		if l.alter != nil {
+			l.net.deliver(to, l.alter(to, m))
+		} else {
+			l.net.deliver(to, m)
+		}
+	}
+}
+
+// equivocate makes a leader propose a different block to every odd replica
+func equivocate(key ed25519.PrivateKey) func(int, bft.Message) bft.Message {
+	return func(to int, m bft.Message) bft.Message {
+		if m.Type != bft.VotePropose || to%2 == 0 {
+			return m
+		}
+		b := *m.Block
+		b.Timestamp++
+		b.Sign(key)
+		v := *m.Vote
+		v.Hash = b.Hash
+		v.Sign(key)
+		return bft.Message{Type: m.Type, Block: &b, Vote: &v}
+	}
+}
+
+// lie makes a replica vote for made up blocks, and decide them with a
+// certificate that repeats its own vote quorum times
+func lie(key ed25519.PrivateKey, quorum int) func(int, bft.Message) bft.Message {
+	return func(to int, m bft.Message) bft.Message {
+		switch m.Type {
+		case bft.VotePrepare, bft.VoteCommit:
+			v := *m.Vote
+			v.Hash = fmt.Sprintf("%064x", rand.Uint64())
+			v.Sign(key)
+			return bft.Message{Type: m.Type, Vote: &v}
+		case bft.MsgDecide:
+			b := *m.Block
+			b.Timestamp++
+			b.Sign(key)
+			qc := *b.QC
+			qc.Hash = b.Hash
+			qc.Votes = nil
+			v := chain.Vote{Type: bft.VoteCommit, Height: qc.Height, Round: qc.Round, Hash: b.Hash}
+			v.Sign(key)
+			for range quorum {
+				qc.Votes = append(qc.Votes, v)
+			}
+			b.QC = &qc
+			return bft.Message{Type: m.Type, Block: &b}
+		}
+		return m
+	}
+}
+
+// forgeDecide makes a replica send a decide for a made up block, without a
+// certificate, in place of every vote, so it reaches the others before any
+// block of that height is decided
+func forgeDecide(to int, m bft.Message) bft.Message {
+	if m.Vote == nil {
+		return m
+	}
+	return bft.Message{Type: bft.MsgDecide, Block: &chain.Block{Index: m.Vote.Height}}
+}
+
+// refusing is the verifier of a chain that refuses every block while
+// refuse is set
+type refusing struct {
+	chain.Verifier
+	refuse *atomic.Bool
+}
+
+func (v refusing) VerifyBlock(b chain.Block, prev []chain.Block) error {
+	if v.refuse.Load() {
+		return errors.New("refusing blocks")
+	}
+	return v.Verifier.VerifyBlock(b, prev)
+}
+
+// replicas says how many replicas a test runs, and how many of each kind
+type replicas struct {
+	n, crash, equivocating, lying, forging, stall int
+}
+
+func TestReplicas(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		replicas
+	}{
+		{"honest", replicas{n: 4}},
+		{"crash", replicas{n: 4, crash: 1}},
+		{"equivocate", replicas{n: 4, equivocating: 1}},
+		{"lie", replicas{n: 4, lying: 1}},
+		{"forge decides", replicas{n: 4, forging: 1}},
+		{"stall", replicas{n: 4, stall: 1}},
+		{"crash, equivocate and lie", replicas{n: 7, crash: 1, equivocating: 1, lying: 1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			run(t, tt.replicas)
+		})
+	}
+}
+
+// run decides requests with the replicas of rs: replicas [0, crash) crash,
+// then come the equivocating, the lying and the forging ones, then the
+// ones that stall, and the rest are honest
+func run(t *testing.T, rs replicas) {
+	n, crash, stall := rs.n, rs.crash, rs.stall
+	faulty := crash + rs.equivocating + rs.lying + rs.forging
+	var refuse atomic.Bool
+	keys := make([]ed25519.PrivateKey, n)
+	g := chain.DefaultGenesis()
+	for i := range keys {
+		_, keys[i], _ = ed25519.GenerateKey(nil)
+		g.Replicas = append(g.Replicas, chain.Address(keys[i].Public().(ed25519.PublicKey)))
+	}
+
+	net := &network{down: make([]bool, n)}
+	chains := make([]*chain.Chain, n)
+	for i := range keys {
+		if i >= faulty && i < faulty+stall {
+			chains[i] = chain.New(g, refusing{bft.NewVerifier(g), &refuse})
+		} else {
+			chains[i] = chain.New(g, bft.NewVerifier(g))
+		}
+		l := link{net: net, from: i}
+		switch {
+		case i < crash:
+		case i < crash+rs.equivocating:
+			l.alter = equivocate(keys[i])
+		case i < crash+rs.equivocating+rs.lying:
+			l.alter = lie(keys[i], bft.Quorum(n))
+		case i < faulty:
+			l.alter = forgeDecide
+		}
+		r, err := bft.NewReplica(chains[i], keys[i], g.Replicas, timeout, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		net.replicas = append(net.replicas, r)
+	}
+	for _, r := range net.replicas {
+		r.Start()
+	}
+	refuse.Store(true)
+	defer func() {
+		for i, r := range net.replicas {
+			if i >= crash {
+				r.Stop()
+			}
+		}
+	}()
+
+	_, client, _ := ed25519.GenerateKey(nil)
+	for i := range requests {
+		tx := chain.Tx{Type: bft.TxRequest, From: chain.Address(client.Public().(ed25519.PublicKey)), Amount: uint64(60 + i), Nonce: uint64(i)}
+		tx.Sign(client)
+		//clients may send to any replica, even a faulty one, as long as it is up
+		to := rand.N(n)
+		for to < crash && i > requests/2 {
+			to = rand.N(n)
+		}
+		net.replicas[to].Submit(tx)
+		time.Sleep(timeout / 10)
+		if i == requests/2 {
+			for s := faulty; s < faulty+stall; s++ {
+				if err := net.replicas[s].Err(); !errors.Is(err, bft.ErrStalled) {
+					t.Errorf("replica %d refusing decided blocks: Err() = %v, want %v", s, err, bft.ErrStalled)
+				}
+			}
+			refuse.Store(false)
+			net.mu.Lock()
+			for c := range crash {
+				net.down[c] = true
+			}
+			net.mu.Unlock()
+			for c := range crash {
+				net.replicas[c].Stop()
+			}
+		}
+	}
+
+	honest := chains[faulty:]
+	start := time.Now()
+	for !decided(honest) && time.Since(start) < wait {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	for s := faulty; s < faulty+stall; s++ {
+		if err := net.replicas[s].Err(); err != nil {
+			t.Errorf("replica %d still stalled: %v", s, err)
+		}
+	}
+	//safety: the honest replicas never decide different blocks
+	for i, c := range honest {
+		if err := c.Validate(); err != nil {
+			t.Errorf("replica %d: %v", faulty+i, err)
+		}
+		for _, other := range honest[i+1:] {
+			for h := range min(c.Len(), other.Len()) {
+				a, _ := c.Get(h)
+				b, _ := other.Get(h)
+				if a.Hash != b.Hash {
+					t.Fatalf("honest replicas decided %s and %s at height %d", a.Hash, b.Hash, h)
+				}
+			}
+		}
+	}
+	//liveness: every request is decided, once
+	seen := make(map[string]bool)
+	for _, b := range honest[0].Blocks()[1:] {
+		if seen[b.Txs[0].Hash()] {
+			t.Errorf("request %s decided twice", b.Txs[0].Hash())
+		}
+		seen[b.Txs[0].Hash()] = true
+	}
+	if len(seen) != requests {
+		t.Errorf("%d of %d requests decided in %v", len(seen), requests, wait)
+	}
+}
+
+// decided reports whether every chain holds every request
+func decided(chains []*chain.Chain) bool {
+	for _, c := range chains {
+		if c.Len() <= requests {
+			return false
+		}
+	}
+	return true
+}
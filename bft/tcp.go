@@ -0,0 +1,105 @@
+package bft
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net"
+	"time"
+)
+
+// peerQueue is how many messages wait for a slow or unreachable peer
+// before new ones are dropped. Replicas recover lost messages through view
+// changes and sync, so dropping beats blocking the replica.
+const peerQueue = 256
+
+// redialDelay is how long a peer is left alone after its connection failed
+const redialDelay = time.Second
+
+// TCP is a Transport that sends messages as JSON lines over TCP. Every
+// replica listens on one address and dials every other replica's; a
+// connection is only ever used in the direction it was dialed.
+type TCP struct {
+	listener net.Listener
+	queues   []chan Message
+}
+
+// NewTCP listens on listen for messages from the other replicas and sends
+// to the replicas at peers, dialing them when the first message is due
+func NewTCP(listen string, peers []string) (*TCP, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	t := &TCP{listener: l}
+	for _, peer := range peers {
+		q := make(chan Message, peerQueue)
+		t.queues = append(t.queues, q)
+		go sendTo(peer, q)
+	}
+	return t, nil
+}
+
+// Broadcast queues m for every peer
+func (t *TCP) Broadcast(m Message) {
+	for _, q := range t.queues {
+		select {
+		case q <- m:
+		default:
+		}
+	}
+}
+
+// Serve hands every message received to handle, until the listener fails
+func (t *TCP) Serve(handle func(Message)) error {
+	log.Println("bft: listening for replicas on", t.listener.Addr())
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go receive(conn, handle)
+	}
+}
+
+func receive(conn net.Conn, handle func(Message)) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	//decided blocks travel with their certificates, which can get long
+	scanner.Buffer(nil, 4<<20)
+	for scanner.Scan() {
+		var m Message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			log.Printf("bft: bad message from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		handle(m)
+	}
+}
+
+// sendTo writes the messages of q to peer, dialing again whenever the
+// connection breaks. Messages due while the peer is down are dropped.
+func sendTo(peer string, q chan Message) {
+	var conn net.Conn
+	var enc *json.Encoder
+	var failed time.Time
+	for m := range q {
+		if conn == nil {
+			if time.Since(failed) < redialDelay {
+				continue
+			}
+			var err error
+			if conn, err = net.DialTimeout("tcp", peer, redialDelay); err != nil {
+				failed = time.Now()
+				continue
+			}
+			enc = json.NewEncoder(conn)
+		}
+		conn.SetWriteDeadline(time.Now().Add(redialDelay))
+		if err := enc.Encode(m); err != nil {
+			log.Printf("bft: lost %s: %v", peer, err)
+			conn.Close()
+			conn, failed = nil, time.Now()
+		}
+	}
+}
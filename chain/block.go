@@ -0,0 +1,101 @@
+// Package chain holds the block type and validation rules shared by every
+// node program in this repository (http, networking, proof-work, proof-stake
+// and p2p), so that a fix to the rules lands everywhere at once.
+package chain
+
+import (
+	"time"
+)
+
+// Block represents each 'item' in the blockchain
+type Block struct {
+	Index int
+	// Timestamp is in Unix nanoseconds
+	Timestamp int64
+	// BPM : (Beats Per Minute)
+	BPM      int
+	Hash     string //1）to save space， 2） Preserve integrity of the blockchain
+	PrevHash string
+
+	// Bits (the compact target) and Nonce are only filled in by proof-work
+	Bits  uint32 `json:",omitempty"`
+	Nonce uint64 `json:",omitempty"`
+	// Validator is the address of the proof-stake validator that forged the block
+	Validator string `json:",omitempty"`
+	// Commit, Reveal and Mix are the proof-stake validator's RANDAO
+	// commitment, the secret behind its previous commitment, and the
+	// resulting randomness mix; see package pos
+	Commit string `json:",omitempty"`
+	Reveal string `json:",omitempty"`
+	Mix    string `json:",omitempty"`
+	// TxRoot commits the header to Txs, see TxRoot
+	TxRoot string `json:",omitempty"`
+	// Difficulty is the weight of a proof-authority block: 2 if its signer
+	// was in turn, 1 if not, see package poa. It counts as the block's work.
+	Difficulty uint64 `json:",omitempty"`
+
+	// Signature is the Validator's ed25519 signature over the header, in
+	// hex. It is not part of the header itself.
+	Signature string `json:",omitempty"`
+
+	// Txs are the transactions in the block. They are not part of the
+	// header: it only carries their TxRoot.
+	Txs []Tx `json:",omitempty"`
+	// QC is the commit certificate BFT replicas agreed on the block with.
+	// It is not part of the header, which it signs itself.
+	QC *QuorumCert `json:",omitempty"`
+
+	// ChainWork is the cumulative work of the chain up to this block, in
+	// hex. It is not part of the header: the chain recomputes it.
+	ChainWork string `json:",omitempty"`
+}
+
+// Time returns the block timestamp as a time.Time
+func (b Block) Time() time.Time {
+	return time.Unix(0, b.Timestamp).UTC()
+}
+
+// GenerateBlock creates a new block using previous block's hash
+func GenerateBlock(oldBlock Block, BPM int) Block {
+	var newBlock Block
+
+	t := time.Now()
+
+	newBlock.Index = oldBlock.Index + 1
+	newBlock.Timestamp = t.UnixNano()
+	newBlock.BPM = BPM
+	//current preHash = old block hash
+	newBlock.PrevHash = oldBlock.Hash
+	newBlock.Hash = CalculateHash(newBlock)
+
+	return newBlock
+}
+
+// IsBlockValid makes sure block is valid by checking index, and comparing the hash of the previous block.
+// It also checks that the header commits to the transactions in the block, and
+// that a block with a Validator was signed by it.
+func IsBlockValid(newBlock, oldBlock Block) bool {
+	if oldBlock.Index+1 != newBlock.Index {
+		return false
+	}
+
+	if oldBlock.Hash != newBlock.PrevHash {
+		return false
+	}
+
+	if TxRoot(newBlock.Txs) != newBlock.TxRoot {
+		return false
+	}
+
+	//a block that names its forger must be signed by it
+	if newBlock.Validator != "" && VerifySignature(newBlock) != nil {
+		return false
+	}
+
+	//double check
+	if CalculateHash(newBlock) != newBlock.Hash {
+		return false
+	}
+
+	return true
+}
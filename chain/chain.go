@@ -0,0 +1,315 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrEmptyChain is returned when a chain without a genesis block is given
+	ErrEmptyChain = errors.New("chain: no genesis block")
+	// ErrInvalidBlock is returned when a block does not link to its parent
+	ErrInvalidBlock = errors.New("chain: invalid block")
+	// ErrGenesisMismatch is returned for blocks that belong to another network
+	ErrGenesisMismatch = errors.New("chain: genesis block does not match")
+	// ErrLighterChain is returned by Replace when the new chain has no more work than ours
+	ErrLighterChain = errors.New("chain: replacement has no more work")
+	// ErrForkChoice is returned by Replace when the fork choice keeps our chain
+	ErrForkChoice = errors.New("chain: fork choice prefers the current chain")
+	// ErrFinalized is returned by Replace when the new chain drops a finalized block
+	ErrFinalized = errors.New("chain: replacement reverts a finalized block")
+)
+
+// Verifier checks the consensus specific parts of a block, such as its
+// proof of work. prev holds the ancestors of b, its parent last.
+type Verifier interface {
+	VerifyBlock(b Block, prev []Block) error
+}
+
+// ForkChooser is implemented by Verifiers that pick between forks by their
+// own rule. Replace uses it instead of comparing chain work.
+type ForkChooser interface {
+	// ForkChoice reports whether candidate should replace current
+	ForkChoice(current, candidate []Block) bool
+}
+
+// Chain is a series of validated Blocks. It owns its blocks behind a lock,
+// so the node programs never touch the slice directly. Besides the best
+// branch it keeps a tree of the valid blocks on other branches, see Add.
+type Chain struct {
+	mu     sync.RWMutex
+	blocks []Block
+	// index holds the index of every block of blocks by hash, and side the
+	// valid blocks that are on other branches
+	index    map[string]int
+	side     map[string]Block
+	store    BlockStore
+	rules    Rules
+	verifier Verifier
+	// now is the clock blocks are checked against
+	now func() time.Time
+	// finalized is the index of the last finalized block, which no
+	// replacement may revert
+	finalized int
+
+	subsMu    sync.Mutex
+	subs      map[chan Block]struct{}
+	reorgSubs map[chan Reorg]struct{}
+}
+
+// New creates an in-memory chain that starts with the genesis block of g
+func New(g *Genesis, v Verifier) *Chain {
+	c, _ := Open(NewMemoryStore(), g, v)
+	return c
+}
+
+// Open loads the chain kept in store. An empty store is seeded with the
+// genesis block of g; otherwise the stored chain must start with it and
+// every stored block is checked before the chain is handed out. v may be
+// nil if blocks carry no consensus data; such a chain refuses blocks with
+// Bits or Difficulty, see CheckNoWork.
+func Open(store BlockStore, g *Genesis, v Verifier) (*Chain, error) {
+	genesis := g.Block()
+	blocks, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		if err := store.Append(genesis); err != nil {
+			return nil, err
+		}
+		blocks = []Block{genesis}
+	}
+	if blocks[0].Hash != genesis.Hash {
+		return nil, ErrGenesisMismatch
+	}
+	c := &Chain{store: store, rules: g.Rules, verifier: v, now: time.Now, side: make(map[string]Block)}
+	if c.blocks, err = c.verifyBlocks(blocks); err != nil {
+		return nil, err
+	}
+	c.index = make(map[string]int, len(c.blocks))
+	for i, b := range c.blocks {
+		c.index[b.Hash] = i
+	}
+	return c, nil
+}
+
+// OpenPath opens the chain kept in the block file at path, or an in-memory
+// chain if path is empty.
+func OpenPath(path string, g *Genesis, v Verifier) (*Chain, error) {
+	if path == "" {
+		return New(g, v), nil
+	}
+	store, err := OpenFileStore(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Open(store, g, v)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the underlying store
+func (c *Chain) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.store.Close()
+}
+
+// verifyBlock checks b on top of prev (its parent last) and fills in its
+// ChainWork
+func (c *Chain) verifyBlock(b *Block, prev []Block) error {
+	parent := &prev[len(prev)-1]
+	if b.Validator != "" {
+		//IsBlockValid checks this too, but can't say what was wrong
+		if err := VerifySignature(*b); err != nil {
+			return err
+		}
+	}
+	if !IsBlockValid(*b, *parent) {
+		return fmt.Errorf("%w: index %d", ErrInvalidBlock, b.Index)
+	}
+	if err := c.rules.CheckTimestamp(*b, prev, c.now()); err != nil {
+		return err
+	}
+	if c.verifier != nil {
+		if err := c.verifier.VerifyBlock(*b, prev); err != nil {
+			return err
+		}
+	} else if err := CheckNoWork(*b); err != nil {
+		return err
+	}
+	addWork(b, parent)
+	return nil
+}
+
+// verifyBlocks checks a whole chain, genesis first, and returns a copy of it
+// with the ChainWork of every block filled in. Work sent by a peer is never
+// trusted.
+func (c *Chain) verifyBlocks(blocks []Block) ([]Block, error) {
+	if len(blocks) == 0 {
+		return nil, ErrEmptyChain
+	}
+	blocks = append([]Block(nil), blocks...)
+	addWork(&blocks[0], nil)
+	for i := 1; i < len(blocks); i++ {
+		if err := c.verifyBlock(&blocks[i], blocks[:i]); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+// Append adds b on top of the current tip if it is valid. The block is
+// written to the store before it becomes visible.
+func (c *Chain) Append(b Block) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := c.verifyBlock(&b, c.blocks); err != nil {
+		return err
+	}
+	return c.extend(b)
+}
+
+// Validate checks every block of the chain against its parent
+func (c *Chain) Validate() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, err := c.verifyBlocks(c.blocks)
+	return err
+}
+
+// Replace swaps our blocks for newBlocks if they form a valid chain that
+// shares our genesis and our finalized block and has more cumulative work
+// than ours (about fork attacking). For chains without proof-work that is
+// the longer chain. A Verifier that is a ForkChooser decides instead. Only
+// the blocks after the last one both chains share are rolled back, and
+// they stay in the tree as a side branch, as do the new blocks if they
+// lose, until they fall SideDepth behind the tip.
+func (c *Chain) Replace(newBlocks []Block) error {
+	newBlocks, err := c.verifyBlocks(newBlocks)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if newBlocks[0].Hash != c.blocks[0].Hash {
+		return ErrGenesisMismatch
+	}
+	fork := ForkPoint(c.blocks, newBlocks)
+	if fork < c.finalized {
+		return fmt.Errorf("%w: index %d", ErrFinalized, c.finalized)
+	}
+	for _, b := range newBlocks[fork+1:] {
+		c.side[b.Hash] = b
+	}
+	defer c.pruneSide()
+	return c.switchTo(newBlocks)
+}
+
+// Finalize marks the block at index, which must have hash, as final: no
+// replacement may revert it or its ancestors from then on. Finality only
+// moves forward, so an older index is ignored.
+func (c *Chain) Finalize(index int, hash string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if index < 0 || index >= len(c.blocks) || c.blocks[index].Hash != hash {
+		return fmt.Errorf("%w: index %d: %s is not in the chain", ErrInvalidBlock, index, hash)
+	}
+	c.finalized = max(c.finalized, index)
+	//side blocks at or below it can never be on the best branch again
+	for hash, b := range c.side {
+		if b.Index <= c.finalized {
+			delete(c.side, hash)
+		}
+	}
+	return nil
+}
+
+// Finalized returns the last finalized block, genesis if there is none yet
+func (c *Chain) Finalized() Block {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.blocks[c.finalized]
+}
+
+// Subscribe returns a channel that receives the new tip every time the chain
+// grows or is replaced, e.g. so a miner can drop a block that lost the race.
+// A subscriber that falls behind misses tips rather than blocking the chain;
+// Tip always has the latest one. Call cancel to stop.
+func (c *Chain) Subscribe() (tips <-chan Block, cancel func()) {
+	ch := make(chan Block, 16)
+	c.subsMu.Lock()
+	if c.subs == nil {
+		c.subs = make(map[chan Block]struct{})
+	}
+	c.subs[ch] = struct{}{}
+	c.subsMu.Unlock()
+
+	return ch, func() {
+		c.subsMu.Lock()
+		delete(c.subs, ch)
+		c.subsMu.Unlock()
+	}
+}
+
+func (c *Chain) notify(tip Block) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	for ch := range c.subs {
+		select {
+		case ch <- tip:
+		default:
+		}
+	}
+}
+
+// Rules returns the validation rules of the chain
+func (c *Chain) Rules() Rules {
+	return c.rules
+}
+
+// Genesis returns block 0
+func (c *Chain) Genesis() Block {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.blocks[0]
+}
+
+// Tip returns the last block of the chain
+func (c *Chain) Tip() Block {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.blocks[len(c.blocks)-1]
+}
+
+// Get returns the block at index i
+func (c *Chain) Get(i int) (Block, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if i < 0 || i >= len(c.blocks) {
+		return Block{}, false
+	}
+	return c.blocks[i], true
+}
+
+// Len returns the number of blocks, genesis included
+func (c *Chain) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.blocks)
+}
+
+// Blocks returns a copy of all blocks, e.g. for JSON output
+func (c *Chain) Blocks() []Block {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]Block(nil), c.blocks...)
+}
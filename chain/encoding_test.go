@@ -0,0 +1,47 @@
+package chain
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+// TestHeaderVectors checks EncodeHeader and CalculateHash against the
+// published vectors, so a change to the encoding can't slip in without
+// bumping HeaderVersion and regenerating them with go generate
+func TestHeaderVectors(t *testing.T) {
+	data, err := os.ReadFile("testdata/header_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors []struct {
+		Name     string
+		Header   Block
+		Encoding string
+		Hash     string
+	}
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	if len(vectors) == 0 {
+		t.Fatal("no vectors")
+	}
+
+	hashes := make(map[string]string)
+	for _, v := range vectors {
+		t.Run(v.Name, func(t *testing.T) {
+			if got := hex.EncodeToString(EncodeHeader(v.Header)); got != v.Encoding {
+				t.Errorf("EncodeHeader = %s, want %s", got, v.Encoding)
+			}
+			if got := CalculateHash(v.Header); got != v.Hash {
+				t.Errorf("CalculateHash = %s, want %s", got, v.Hash)
+			}
+			//the index 1 bpm 23 and index 11 bpm 3 vectors collided under the old hash
+			if other, ok := hashes[v.Hash]; ok {
+				t.Errorf("same hash as %q", other)
+			}
+			hashes[v.Hash] = v.Name
+		})
+	}
+}
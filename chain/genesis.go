@@ -0,0 +1,254 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Genesis describes block 0 of a network. Every node of the network loads
+// the same genesis.json, so they all build the same genesis block instead of
+// each stamping its own with time.Now().
+type Genesis struct {
+	ChainID   string    `json:"chainId"`
+	Timestamp time.Time `json:"timestamp"`
+	BPM       int       `json:"bpm"`
+	// Bits is the initial proof-work target in compact form
+	Bits     uint32         `json:"bits,omitempty"`
+	Retarget RetargetConfig `json:"retarget,omitzero"`
+	// Validators holds the initial stakes for proof-stake, by address
+	Validators map[string]uint64 `json:"validators,omitempty"`
+	// Balances holds the initial unstaked proof-stake balances, by address
+	Balances map[string]uint64 `json:"balances,omitempty"`
+	Staking  StakingConfig     `json:"staking,omitzero"`
+	// Authorities are the initial proof-authority signers, by address
+	Authorities []string        `json:"authorities,omitempty"`
+	Authority   AuthorityConfig `json:"authority,omitzero"`
+	// Replicas are the BFT replicas, by address
+	Replicas []string  `json:"replicas,omitempty"`
+	BFT      BFTConfig `json:"bft,omitzero"`
+	Rules    Rules     `json:"rules"`
+}
+
+// StakingConfig holds the proof-stake parameters; see package pos
+type StakingConfig struct {
+	// UnbondingBlocks is how many blocks unbonded stake stays locked before
+	// it can be spent or transferred
+	UnbondingBlocks int `json:"unbondingBlocks,omitempty"`
+	// SlotDuration is the length of a slot, counted from the genesis
+	// timestamp. Each slot has one proposer and holds at most one block.
+	SlotDuration Duration `json:"slotDuration,omitzero"`
+	// EpochLength is the number of slots in an epoch. The validator set
+	// and leader schedule only change from one epoch to the next.
+	EpochLength int `json:"epochLength,omitempty"`
+	// SlashPercent is the share of its stake a validator loses for signing
+	// two blocks at the same height
+	SlashPercent int `json:"slashPercent,omitempty"`
+	// JailEpochs is how many whole epochs a slashed validator may not forge
+	JailEpochs int `json:"jailEpochs,omitempty"`
+}
+
+// AuthorityConfig holds the proof-authority parameters; see package poa
+type AuthorityConfig struct {
+	// Period is the least time between a block and its parent
+	Period Duration `json:"period,omitzero"`
+	// Epoch is the number of blocks after which pending votes on
+	// authorities are dropped
+	Epoch int `json:"epoch,omitempty"`
+}
+
+// BFTConfig holds the BFT parameters; see package bft
+type BFTConfig struct {
+	// ViewTimeout is how long replicas wait for a block before they move
+	// to the next view and leader. It doubles with every failed view.
+	ViewTimeout Duration `json:"viewTimeout,omitzero"`
+}
+
+// RetargetConfig selects how proof-work adjusts its target; see package pow
+type RetargetConfig struct {
+	// Algorithm is "bitcoin", "lwma" or "asert"; empty keeps the genesis target
+	Algorithm string `json:"algorithm,omitempty"`
+	// TargetSpacing is the block interval the target is steered towards
+	TargetSpacing Duration `json:"targetSpacing,omitzero"`
+	// Window is the number of blocks between retargets for "bitcoin", and
+	// the number of blocks averaged over for "lwma"
+	Window int `json:"window,omitempty"`
+	// HalfLife is how long it takes "asert" to halve or double the target
+	HalfLife Duration `json:"halfLife,omitzero"`
+}
+
+// DefaultGenesis is used by nodes started without a genesis file
+func DefaultGenesis() *Genesis {
+	return &Genesis{
+		ChainID:   "blockchain-go",
+		Timestamp: time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC),
+		// hashes below 0x0fffff00..., one in 16 on average
+		Bits: 0x200fffff,
+		Retarget: RetargetConfig{
+			Algorithm:     "lwma",
+			TargetSpacing: Duration(10 * time.Second),
+			Window:        30,
+		},
+		Staking: StakingConfig{
+			UnbondingBlocks: 20,
+			SlotDuration:    Duration(30 * time.Second),
+			EpochLength:     32,
+			SlashPercent:    10,
+			JailEpochs:      2,
+		},
+		Authority: AuthorityConfig{
+			Period: Duration(15 * time.Second),
+			Epoch:  30000,
+		},
+		BFT: BFTConfig{
+			ViewTimeout: Duration(2 * time.Second),
+		},
+		Rules: DefaultRules(),
+	}
+}
+
+// LoadGenesis reads a genesis file. An empty path gives DefaultGenesis.
+func LoadGenesis(path string) (*Genesis, error) {
+	if path == "" {
+		return DefaultGenesis(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var g Genesis
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, fmt.Errorf("chain: %s: %w", path, err)
+	}
+	if g.ChainID == "" {
+		return nil, fmt.Errorf("chain: %s: missing chainId", path)
+	}
+	if g.Rules == (Rules{}) {
+		g.Rules = DefaultRules()
+	}
+	if p := g.Staking.SlashPercent; p < 0 || p > 100 {
+		return nil, fmt.Errorf("chain: %s: slashPercent %d is not between 0 and 100", path, p)
+	}
+	return &g, nil
+}
+
+// Write saves g as indented JSON
+func (g *Genesis) Write(path string) error {
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Hash is the SHA256 of the genesis config. It becomes the PrevHash of the
+// genesis block, so two configs that differ in anything (chain ID, stakes,
+// difficulty) never produce the same block 0.
+func (g *Genesis) Hash() string {
+	// map keys are sorted by encoding/json, so this is deterministic
+	data, _ := json.Marshal(g)
+	hashed := sha256.Sum256(data)
+	return hex.EncodeToString(hashed[:])
+}
+
+// Block builds the genesis block described by g
+func (g *Genesis) Block() Block {
+	genesisBlock := Block{
+		Index:     0,
+		Timestamp: g.Timestamp.UnixNano(),
+		BPM:       g.BPM,
+		PrevHash:  g.Hash(),
+		Bits:      g.Bits,
+	}
+	genesisBlock.Hash = CalculateHash(genesisBlock)
+	return genesisBlock
+}
+
+// InitCommand implements the `init` command of the node programs: it writes
+// a genesis file built from the flags in args.
+func InitCommand(args []string) error {
+	g := DefaultGenesis()
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	out := fs.String("o", "genesis.json", "genesis file to write")
+	fs.StringVar(&g.ChainID, "chain-id", g.ChainID, "chain ID")
+	fs.IntVar(&g.BPM, "bpm", g.BPM, "BPM of the genesis block")
+	fs.Func("bits", "initial proof-work target in compact form (default 0x200fffff)", func(s string) error {
+		bits, err := strconv.ParseUint(s, 0, 32)
+		g.Bits = uint32(bits)
+		return err
+	})
+	fs.IntVar(&g.Rules.MedianTimeBlocks, "median-time-blocks", g.Rules.MedianTimeBlocks, "blocks the median time past is taken over")
+	fs.StringVar(&g.Retarget.Algorithm, "retarget", g.Retarget.Algorithm, "proof-work retarget algorithm: bitcoin, lwma, asert or none")
+	spacing := fs.Duration("block-interval", time.Duration(g.Retarget.TargetSpacing), "target proof-work block interval")
+	fs.IntVar(&g.Retarget.Window, "retarget-window", g.Retarget.Window, "blocks between bitcoin retargets, or blocks averaged by lwma")
+	halfLife := fs.Duration("half-life", 10*time.Minute, "asert half life")
+	drift := fs.Duration("max-future-drift", time.Duration(g.Rules.MaxFutureDrift), "how far ahead of the clock a block may be stamped")
+	now := fs.Bool("now", false, "use the current time instead of the default genesis timestamp")
+	fs.Func("validator", "initial proof-stake validator as address=stake (repeatable)", allocate(&g.Validators))
+	fs.Func("balance", "initial unstaked proof-stake balance as address=amount (repeatable)", allocate(&g.Balances))
+	fs.IntVar(&g.Staking.UnbondingBlocks, "unbonding-blocks", g.Staking.UnbondingBlocks, "blocks unbonded stake stays locked")
+	slot := fs.Duration("slot-duration", time.Duration(g.Staking.SlotDuration), "proof-stake slot length")
+	fs.IntVar(&g.Staking.EpochLength, "epoch-length", g.Staking.EpochLength, "slots per proof-stake epoch")
+	fs.IntVar(&g.Staking.SlashPercent, "slash-percent", g.Staking.SlashPercent, "percent of stake slashed for double signing")
+	fs.IntVar(&g.Staking.JailEpochs, "jail-epochs", g.Staking.JailEpochs, "epochs a slashed validator is jailed for")
+	fs.Func("authority", "initial proof-authority signer address (repeatable)", func(s string) error {
+		g.Authorities = append(g.Authorities, s)
+		return nil
+	})
+	period := fs.Duration("period", time.Duration(g.Authority.Period), "least time between proof-authority blocks")
+	fs.IntVar(&g.Authority.Epoch, "authority-epoch", g.Authority.Epoch, "blocks after which pending proof-authority votes are dropped")
+	fs.Func("replica", "BFT replica address (repeatable)", func(s string) error {
+		g.Replicas = append(g.Replicas, s)
+		return nil
+	})
+	viewTimeout := fs.Duration("view-timeout", time.Duration(g.BFT.ViewTimeout), "how long BFT replicas wait before changing view")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	g.Rules.MaxFutureDrift = Duration(*drift)
+	g.Retarget.TargetSpacing = Duration(*spacing)
+	g.Staking.SlotDuration = Duration(*slot)
+	g.Authority.Period = Duration(*period)
+	g.BFT.ViewTimeout = Duration(*viewTimeout)
+	switch g.Retarget.Algorithm {
+	case "none":
+		g.Retarget = RetargetConfig{}
+	case "asert":
+		g.Retarget.HalfLife = Duration(*halfLife)
+		g.Retarget.Window = 0
+	}
+	if *now {
+		g.Timestamp = time.Now().UTC()
+	}
+
+	if err := g.Write(*out); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s, genesis hash %s\n", *out, g.Block().Hash)
+	return nil
+}
+
+// allocate returns a flag.Func that adds an address=amount flag to m
+func allocate(m *map[string]uint64) func(string) error {
+	return func(s string) error {
+		addr, amount, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("want address=amount, got %q", s)
+		}
+		n, err := strconv.ParseUint(amount, 10, 64)
+		if err != nil {
+			return err
+		}
+		if *m == nil {
+			*m = make(map[string]uint64)
+		}
+		(*m)[addr] = n
+		return nil
+	}
+}
@@ -0,0 +1,74 @@
+package chain
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyExt is the extension of key files, named after their address
+const KeyExt = ".key"
+
+// WriteKey saves the seed of key, hex encoded, to path. Only the owner may
+// read it.
+func WriteKey(path string, key ed25519.PrivateKey) error {
+	return os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0o600)
+}
+
+// ReadKey loads a key written by WriteKey
+func ReadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("chain: %s is not a key file", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ReadKeys loads every key file in dir, by address
+func ReadKeys(dir string) (map[string]ed25519.PrivateKey, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+KeyExt))
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]ed25519.PrivateKey)
+	for _, path := range paths {
+		key, err := ReadKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys[Address(key.Public().(ed25519.PublicKey))] = key
+	}
+	return keys, nil
+}
+
+// KeygenCommand implements the `keygen` command of the node programs: it
+// writes a new key to <dir>/<address>.key and prints the address.
+func KeygenCommand(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	dir := fs.String("dir", "keys", "directory to write the key file to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		return err
+	}
+	address := Address(pub)
+	if err := WriteKey(filepath.Join(*dir, address+KeyExt), key); err != nil {
+		return err
+	}
+	fmt.Println(address)
+	return nil
+}
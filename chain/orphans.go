@@ -0,0 +1,212 @@
+package chain
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// requestTimeout is how long OrphanPool.Request waits before the same
+// missing block may be asked for again
+const requestTimeout = 5 * time.Second
+
+// Orphan is a block whose parent was unknown when it arrived
+type Orphan struct {
+	Block Block
+	// From is the peer that sent it, so its ancestors can be asked from there
+	From  string
+	Added time.Time
+
+	size    int
+	removed bool
+}
+
+// OrphanPool holds blocks that arrived before their parent, e.g. because
+// they came out of order or from a peer that is ahead of us, until their
+// ancestors show up. It is bounded by the total encoded size of its blocks
+// and by their age; the oldest orphans go first.
+type OrphanPool struct {
+	maxBytes int
+	maxAge   time.Duration
+	now      func() time.Time
+
+	mu       sync.Mutex
+	byHash   map[string]*Orphan
+	byParent map[string][]*Orphan
+	// order holds the orphans oldest first; removed ones are skipped and
+	// dropped lazily
+	order     []*Orphan
+	bytes     int
+	requested map[string]time.Time
+}
+
+// NewOrphanPool creates a pool holding up to maxBytes of blocks, none of
+// them for longer than maxAge
+func NewOrphanPool(maxBytes int, maxAge time.Duration) *OrphanPool {
+	return &OrphanPool{
+		maxBytes:  maxBytes,
+		maxAge:    maxAge,
+		now:       time.Now,
+		byHash:    make(map[string]*Orphan),
+		byParent:  make(map[string][]*Orphan),
+		requested: make(map[string]time.Time),
+	}
+}
+
+// Add keeps b, sent by from, until its parent arrives. It reports false if
+// b is already there or is bigger than the whole pool.
+func (p *OrphanPool) Add(b Block, from string) bool {
+	data, _ := json.Marshal(b)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire()
+	if _, ok := p.byHash[b.Hash]; ok || len(data) > p.maxBytes {
+		return false
+	}
+	for p.bytes+len(data) > p.maxBytes {
+		p.remove(p.oldest())
+	}
+	o := &Orphan{Block: b, From: from, Added: p.now(), size: len(data)}
+	p.byHash[b.Hash] = o
+	p.byParent[b.PrevHash] = append(p.byParent[b.PrevHash], o)
+	p.order = append(p.order, o)
+	p.bytes += o.size
+	return true
+}
+
+// Missing returns the hash of the block the orphan with hash is waiting
+// for: its parent, or if that is an orphan too, the parent of the oldest
+// orphan ancestor
+func (p *OrphanPool) Missing(hash string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		o, ok := p.byHash[hash]
+		if !ok {
+			return hash
+		}
+		hash = o.Block.PrevHash
+	}
+}
+
+// Take removes and returns the orphans whose parent is the block with hash
+func (p *OrphanPool) Take(hash string) []Orphan {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire()
+	var children []Orphan
+	for _, o := range p.byParent[hash] {
+		children = append(children, *o)
+		p.remove(o)
+	}
+	return children
+}
+
+// Request reports whether the missing block with hash should be asked
+// for, i.e. it wasn't asked for in the last few seconds, and notes that
+// it is being asked for now
+func (p *OrphanPool) Request(hash string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	for h, at := range p.requested {
+		if now.Sub(at) > requestTimeout {
+			delete(p.requested, h)
+		}
+	}
+	if _, ok := p.requested[hash]; ok {
+		return false
+	}
+	p.requested[hash] = now
+	return true
+}
+
+// Len returns the number of orphans
+func (p *OrphanPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.byHash)
+}
+
+// Bytes returns the encoded size of the orphans
+func (p *OrphanPool) Bytes() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.bytes
+}
+
+// expire drops the orphans older than maxAge
+func (p *OrphanPool) expire() {
+	for o := p.oldest(); o != nil && p.now().Sub(o.Added) > p.maxAge; o = p.oldest() {
+		p.remove(o)
+	}
+}
+
+// oldest returns the oldest orphan, nil if there is none
+func (p *OrphanPool) oldest() *Orphan {
+	for len(p.order) > 0 && p.order[0].removed {
+		p.order = p.order[1:]
+	}
+	if len(p.order) == 0 {
+		return nil
+	}
+	return p.order[0]
+}
+
+func (p *OrphanPool) remove(o *Orphan) {
+	if o == nil || o.removed {
+		return
+	}
+	o.removed = true
+	delete(p.byHash, o.Block.Hash)
+	siblings := p.byParent[o.Block.PrevHash]
+	for i, s := range siblings {
+		if s == o {
+			siblings = append(siblings[:i:i], siblings[i+1:]...)
+			break
+		}
+	}
+	if len(siblings) == 0 {
+		delete(p.byParent, o.Block.PrevHash)
+	} else {
+		p.byParent[o.Block.PrevHash] = siblings
+	}
+	p.bytes -= o.size
+}
+
+// Connect adds b, sent by from, to c. If its parent isn't known yet it
+// goes into the pool instead, and missing is the hash of the block to ask
+// from for next. If the pool doesn't take b either, because it holds it
+// already or it is too big, the ErrUnknownParent of c.Add is returned. If
+// b connects, so do the orphans that were waiting for it, and for them in
+// turn; those that turn out invalid are dropped.
+func (p *OrphanPool) Connect(c *Chain, b Block, from string) (missing string, err error) {
+	err = c.Add(b)
+	if errors.Is(err, ErrUnknownParent) {
+		//an orphan can't be checked against its parent, but its hash must
+		//be its own, or it could take the place of the real block
+		if CalculateHash(b) != b.Hash {
+			return "", fmt.Errorf("%w: index %d: hash doesn't match the header", ErrInvalidBlock, b.Index)
+		}
+		if !p.Add(b, from) {
+			return "", err
+		}
+		return p.Missing(b.Hash), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	queue := []string{b.Hash}
+	for len(queue) > 0 {
+		hash := queue[0]
+		queue = queue[1:]
+		for _, o := range p.Take(hash) {
+			if err := c.Add(o.Block); err == nil || errors.Is(err, ErrKnownBlock) {
+				queue = append(queue, o.Block.Hash)
+			}
+		}
+	}
+	return "", nil
+}
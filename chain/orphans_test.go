@@ -0,0 +1,111 @@
+package chain
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+// blocks returns n blocks on top of genesis, each on the one before
+func blocks(genesis Block, n int) []Block {
+	var bs []Block
+	for prev := genesis; len(bs) < n; prev = bs[len(bs)-1] {
+		bs = append(bs, GenerateBlock(prev, 60+len(bs)))
+	}
+	return bs
+}
+
+func size(b Block) int {
+	data, _ := json.Marshal(b)
+	return len(data)
+}
+
+// TestOrphanPoolBytes checks that the oldest orphans make room for new
+// ones, and that a block bigger than the whole pool isn't taken
+func TestOrphanPoolBytes(t *testing.T) {
+	bs := blocks(DefaultGenesis().Block(), 3)
+	p := NewOrphanPool(size(bs[0])+size(bs[1]), time.Hour)
+	for _, b := range bs {
+		if !p.Add(b, "peer") {
+			t.Fatalf("block %d not added", b.Index)
+		}
+	}
+	if p.Len() != 2 || p.Bytes() != size(bs[1])+size(bs[2]) {
+		t.Errorf("pool holds %d orphans in %d bytes, want 2 in %d", p.Len(), p.Bytes(), size(bs[1])+size(bs[2]))
+	}
+	if p.Missing(bs[0].Hash) != bs[0].Hash {
+		t.Error("oldest orphan kept in a full pool")
+	}
+	if p.Add(bs[2], "peer") {
+		t.Error("orphan added twice")
+	}
+
+	big := bs[0]
+	big.Txs = make([]Tx, 100)
+	if p.Add(big, "peer") {
+		t.Error("orphan bigger than the pool added")
+	}
+	if p.Len() != 2 {
+		t.Errorf("big orphan evicted the others, %d left", p.Len())
+	}
+}
+
+// TestOrphanPoolAge checks that orphans are dropped once older than maxAge
+func TestOrphanPoolAge(t *testing.T) {
+	bs := blocks(DefaultGenesis().Block(), 2)
+	p := NewOrphanPool(1<<20, time.Minute)
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	p.Add(bs[0], "peer")
+	now = now.Add(time.Minute)
+	p.Add(bs[1], "peer")
+	if p.Len() != 2 {
+		t.Fatalf("%d orphans after a minute, want 2", p.Len())
+	}
+	now = now.Add(time.Second)
+	if got := p.Take(bs[0].PrevHash); len(got) != 0 {
+		t.Errorf("took expired orphan %d", got[0].Block.Index)
+	}
+	if p.Len() != 1 {
+		t.Errorf("%d orphans, want the newer one only", p.Len())
+	}
+}
+
+// TestConnect sends a chain newest block first: every block waits for
+// its parent, until the oldest one connects all of them
+func TestConnect(t *testing.T) {
+	c := New(DefaultGenesis(), nil)
+	bs := blocks(c.Tip(), 4)
+	p := NewOrphanPool(1<<20, time.Hour)
+
+	//a block posing as bs[1] must not take its place in the pool
+	forged := bs[1]
+	forged.BPM++
+	if _, err := p.Connect(c, forged, "attacker"); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("Connect(forged) = %v, want %v", err, ErrInvalidBlock)
+	}
+
+	for i := len(bs) - 1; i > 0; i-- {
+		missing, err := p.Connect(c, bs[i], "peer")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if missing != bs[i-1].Hash {
+			t.Errorf("after block %d missing %.8s, want %.8s", bs[i].Index, missing, bs[i-1].Hash)
+		}
+	}
+	if missing, err := p.Connect(c, bs[2], "peer"); missing != "" || !errors.Is(err, ErrUnknownParent) {
+		t.Errorf("Connect(pooled orphan) = %q, %v, want no missing block and %v", missing, err, ErrUnknownParent)
+	}
+
+	if missing, err := p.Connect(c, bs[0], "peer"); missing != "" || err != nil {
+		t.Fatalf("Connect(first block) = %q, %v", missing, err)
+	}
+	if c.Tip().Hash != bs[len(bs)-1].Hash {
+		t.Errorf("tip %d, want %d", c.Tip().Index, bs[len(bs)-1].Index)
+	}
+	if p.Len() != 0 {
+		t.Errorf("%d orphans left", p.Len())
+	}
+}
@@ -0,0 +1,77 @@
+package chain
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Rules are the validation rules every node of a network has to agree on,
+// whichever consensus it runs. They are part of genesis.json.
+type Rules struct {
+	// MedianTimeBlocks is how many previous blocks the median time past is
+	// taken over; a new block must be newer than that median.
+	MedianTimeBlocks int `json:"medianTimeBlocks"`
+	// MaxFutureDrift is how far ahead of our clock a block may be stamped
+	MaxFutureDrift Duration `json:"maxFutureDrift"`
+}
+
+// DefaultRules are the rules of DefaultGenesis
+func DefaultRules() Rules {
+	return Rules{
+		MedianTimeBlocks: 11,
+		MaxFutureDrift:   Duration(2 * time.Minute),
+	}
+}
+
+// Duration is a time.Duration that reads and writes JSON as "2m0s"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MedianTimePast returns the median timestamp of the last n blocks
+func MedianTimePast(blocks []Block, n int) int64 {
+	if n > len(blocks) {
+		n = len(blocks)
+	}
+	if n <= 0 {
+		return 0
+	}
+	times := make([]int64, 0, n)
+	for _, b := range blocks[len(blocks)-n:] {
+		times = append(times, b.Timestamp)
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return times[len(times)/2]
+}
+
+// CheckTimestamp checks the timestamp of b, whose ancestors are prev (the
+// parent last). It must be after the median time past of prev and no more
+// than MaxFutureDrift ahead of now.
+func (r Rules) CheckTimestamp(b Block, prev []Block, now time.Time) error {
+	if mtp := MedianTimePast(prev, r.MedianTimeBlocks); b.Timestamp <= mtp {
+		return fmt.Errorf("%w: index %d: timestamp %s is not after median time past %s",
+			ErrInvalidBlock, b.Index, b.Time().Format(time.RFC3339Nano), time.Unix(0, mtp).UTC().Format(time.RFC3339Nano))
+	}
+	if limit := now.Add(time.Duration(r.MaxFutureDrift)); b.Time().After(limit) {
+		return fmt.Errorf("%w: index %d: timestamp %s is more than %s in the future",
+			ErrInvalidBlock, b.Index, b.Time().Format(time.RFC3339Nano), time.Duration(r.MaxFutureDrift))
+	}
+	return nil
+}
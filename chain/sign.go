@@ -0,0 +1,72 @@
+package chain
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// Proof-stake validators are ed25519 key pairs, and their address is the
+// hex encoded public key. A block names its forger in Validator and carries
+// its signature over the canonical header, so any node can check who forged
+// it from the block alone.
+
+// ErrBadSignature is returned for blocks and transactions whose signature
+// doesn't match the address that claims them
+var ErrBadSignature = errors.New("chain: bad signature")
+
+// Address returns the address of the holder of pub
+func Address(pub ed25519.PublicKey) string {
+	return hex.EncodeToString(pub)
+}
+
+// PublicKey returns the public key an address stands for
+func PublicKey(address string) (ed25519.PublicKey, error) {
+	pub, err := hex.DecodeString(address)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("chain: %q is not an address", address)
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+// Sign sets the Validator of b to the address of key, hashes b and signs
+// its header
+func (b *Block) Sign(key ed25519.PrivateKey) {
+	b.Validator = Address(key.Public().(ed25519.PublicKey))
+	b.Hash = CalculateHash(*b)
+	b.Signature = hex.EncodeToString(ed25519.Sign(key, EncodeHeader(*b)))
+}
+
+// VerifySignature checks that the header of b was signed by its Validator
+func VerifySignature(b Block) error {
+	if err := verify(b.Validator, EncodeHeader(b), b.Signature); err != nil {
+		return fmt.Errorf("%w: index %d: %v", ErrBadSignature, b.Index, err)
+	}
+	return nil
+}
+
+// Sign signs tx with key, which must belong to tx.From
+func (tx *Tx) Sign(key ed25519.PrivateKey) {
+	tx.Signature = hex.EncodeToString(ed25519.Sign(key, EncodeTx(*tx)))
+}
+
+// VerifyTx checks that tx was signed by its sender
+func VerifyTx(tx Tx) error {
+	if err := verify(tx.From, EncodeTx(tx), tx.Signature); err != nil {
+		return fmt.Errorf("%w: tx %s: %v", ErrBadSignature, tx.Hash(), err)
+	}
+	return nil
+}
+
+func verify(address string, message []byte, signature string) error {
+	pub, err := PublicKey(address)
+	if err != nil {
+		return err
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil || !ed25519.Verify(pub, message, sig) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
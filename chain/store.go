@@ -0,0 +1,191 @@
+package chain
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// BlockStore persists the blocks of a chain. Chain calls it with its own lock
+// held, so implementations see Append and Replace one at a time.
+type BlockStore interface {
+	// Load returns every stored block, genesis first
+	Load() ([]Block, error)
+	// Append durably adds b after the last stored block
+	Append(b Block) error
+	// Replace swaps all stored blocks for blocks
+	Replace(blocks []Block) error
+	Close() error
+}
+
+// MemoryStore keeps blocks in memory only; it is meant for tests and for
+// nodes that don't need to survive a restart.
+type MemoryStore struct {
+	mu     sync.Mutex
+	blocks []Block
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+func (s *MemoryStore) Load() ([]Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Block(nil), s.blocks...), nil
+}
+
+func (s *MemoryStore) Append(b Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocks = append(s.blocks, b)
+	return nil
+}
+
+func (s *MemoryStore) Replace(blocks []Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocks = append([]Block(nil), blocks...)
+	return nil
+}
+
+func (s *MemoryStore) Close() error { return nil }
+
+// FileStore is an append-only file with one JSON encoded block per line.
+// Every append is fsynced before it returns, so a block that was accepted
+// is still there after a crash.
+type FileStore struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// OpenFileStore opens (or creates) the block file at path
+func OpenFileStore(path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStore{path: path, f: f}, nil
+}
+
+// Load reads all blocks from the file. A torn last line, left behind by a
+// crash in the middle of a write, is cut off so later appends stay readable.
+func (s *FileStore) Load() ([]Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	var blocks []Block
+	var good int64
+	r := bufio.NewReader(s.f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// no trailing newline: the last write never finished
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var b Block
+		if err := json.Unmarshal(bytes.TrimSpace(line), &b); err != nil {
+			return nil, fmt.Errorf("chain: %s: block %d: %w", s.path, len(blocks), err)
+		}
+		blocks = append(blocks, b)
+		good += int64(len(line))
+	}
+
+	info, err := s.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != good {
+		if err := s.f.Truncate(good); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+func (s *FileStore) Append(b Block) error {
+	line, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// Replace writes blocks to a temporary file and renames it over the old one,
+// so a crash leaves either the old chain or the new one on disk.
+func (s *FileStore) Replace(blocks []Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, b := range blocks {
+		line, err := json.Marshal(b)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(s.path))
+
+	// the old handle still points at the unlinked file
+	s.f.Close()
+	s.f, err = os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o644)
+	return err
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
+
+// syncDir makes a rename durable; it is best effort since not every
+// platform can fsync a directory.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,223 @@
+package chain
+
+import (
+	"errors"
+	"fmt"
+)
+
+// SideDepth is how far below the tip side blocks are kept. A branch that
+// left the best branch further back than that would need a reorg deeper
+// than any node should follow, so it is dropped rather than kept forever.
+const SideDepth = 1024
+
+var (
+	// ErrUnknownParent is returned by Add for blocks whose parent isn't known
+	ErrUnknownParent = errors.New("chain: unknown parent block")
+	// ErrKnownBlock is returned by Add for blocks it already has
+	ErrKnownBlock = errors.New("chain: block already known")
+)
+
+// Reorg is a switch of the chain from one branch to another. The blocks
+// after Ancestor are rolled back and the new branch is applied on top of
+// it, so anything kept per block, such as a ledger, has to be recomputed
+// from Ancestor on.
+type Reorg struct {
+	// Ancestor is the last block the two branches share
+	Ancestor Block
+	// Removed are the blocks rolled back and Added the blocks that took
+	// their place, both oldest first
+	Removed []Block
+	Added   []Block
+	// Depth is how many blocks were rolled back, len(Removed)
+	Depth int
+}
+
+// ForkPoint returns the index of the last block a and b share. Both must
+// start with the same genesis block.
+func ForkPoint(a, b []Block) int {
+	i := min(len(a), len(b)) - 1
+	for i > 0 && a[i].Hash != b[i].Hash {
+		i--
+	}
+	return i
+}
+
+// Add puts b in the block tree: the chain keeps every valid block it is
+// given, not only the ones on its best branch. b may build on any known
+// block. If its branch is better than the current one by the fork choice,
+// the chain reorganizes onto it; otherwise b is kept as a side block, in
+// case its branch gets better later. Side blocks at or below the finalized
+// block are dropped, and so are side blocks more than SideDepth below the
+// tip, so the tree stays bounded without finality too.
+func (c *Chain) Add(b Block) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.lookup(b.Hash); ok {
+		return fmt.Errorf("%w: index %d: %s", ErrKnownBlock, b.Index, b.Hash)
+	}
+	prev, ok := c.branch(b.PrevHash)
+	if !ok {
+		return fmt.Errorf("%w: index %d: %s", ErrUnknownParent, b.Index, b.PrevHash)
+	}
+	if ForkPoint(c.blocks, prev) < c.finalized {
+		return fmt.Errorf("%w: index %d", ErrFinalized, c.finalized)
+	}
+	if err := c.verifyBlock(&b, prev); err != nil {
+		return err
+	}
+	if b.PrevHash == c.blocks[len(c.blocks)-1].Hash {
+		return c.extend(b)
+	}
+
+	c.side[b.Hash] = b
+	defer c.pruneSide()
+	err := c.switchTo(append(prev, b))
+	if errors.Is(err, ErrForkChoice) || errors.Is(err, ErrLighterChain) {
+		//not better (yet), b stays on its side branch
+		return nil
+	}
+	return err
+}
+
+// Block returns the block with hash, on the best branch or a side branch
+func (c *Chain) Block(hash string) (Block, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lookup(hash)
+}
+
+func (c *Chain) lookup(hash string) (Block, bool) {
+	if i, ok := c.index[hash]; ok {
+		return c.blocks[i], true
+	}
+	b, ok := c.side[hash]
+	return b, ok
+}
+
+// branch returns the blocks from genesis to the block with hash, which
+// may be on a side branch, in a new slice
+func (c *Chain) branch(hash string) ([]Block, bool) {
+	var side []Block
+	for {
+		if i, ok := c.index[hash]; ok {
+			blocks := make([]Block, 0, i+2+len(side))
+			blocks = append(blocks, c.blocks[:i+1]...)
+			for j := len(side) - 1; j >= 0; j-- {
+				blocks = append(blocks, side[j])
+			}
+			return blocks, true
+		}
+		b, ok := c.side[hash]
+		if !ok {
+			return nil, false
+		}
+		side = append(side, b)
+		hash = b.PrevHash
+	}
+}
+
+// extend appends b, already verified, to the best branch
+func (c *Chain) extend(b Block) error {
+	if err := c.store.Append(b); err != nil {
+		return err
+	}
+	c.index[b.Hash] = len(c.blocks)
+	c.blocks = append(c.blocks, b)
+	c.pruneSide()
+	c.notify(b)
+	return nil
+}
+
+// pruneSide drops the side blocks more than SideDepth below the tip, then
+// the side blocks built on dropped ones, which can't be reached anymore
+func (c *Chain) pruneSide() {
+	cutoff := c.blocks[len(c.blocks)-1].Index - SideDepth
+	dropped := false
+	for hash, b := range c.side {
+		if b.Index < cutoff {
+			delete(c.side, hash)
+			dropped = true
+		}
+	}
+	for dropped {
+		dropped = false
+		for hash, b := range c.side {
+			if _, ok := c.lookup(b.PrevHash); !ok {
+				delete(c.side, hash)
+				dropped = true
+			}
+		}
+	}
+}
+
+// switchTo makes candidate, a verified chain from our genesis, the best
+// branch if the fork choice prefers it and it keeps our finalized block.
+// The blocks it rolls back become side blocks.
+func (c *Chain) switchTo(candidate []Block) error {
+	fork := ForkPoint(c.blocks, candidate)
+	if fork < c.finalized {
+		return fmt.Errorf("%w: index %d", ErrFinalized, c.finalized)
+	}
+	if fc, ok := c.verifier.(ForkChooser); ok {
+		if !fc.ForkChoice(c.blocks, candidate) {
+			return ErrForkChoice
+		}
+	} else if candidate[len(candidate)-1].Work().Cmp(c.blocks[len(c.blocks)-1].Work()) <= 0 {
+		return ErrLighterChain
+	}
+	if err := c.store.Replace(candidate); err != nil {
+		return err
+	}
+
+	reorg := Reorg{
+		Ancestor: candidate[fork],
+		Removed:  append([]Block(nil), c.blocks[fork+1:]...),
+		Added:    append([]Block(nil), candidate[fork+1:]...),
+	}
+	reorg.Depth = len(reorg.Removed)
+	for _, b := range reorg.Removed {
+		delete(c.index, b.Hash)
+		c.side[b.Hash] = b
+	}
+	for i, b := range reorg.Added {
+		delete(c.side, b.Hash)
+		c.index[b.Hash] = fork + 1 + i
+	}
+	c.blocks = candidate
+	c.notify(candidate[len(candidate)-1])
+	if reorg.Depth > 0 {
+		c.notifyReorg(reorg)
+	}
+	return nil
+}
+
+// SubscribeReorgs returns a channel that receives every reorg, i.e. every
+// time blocks of the best branch are rolled back. Like Subscribe, a
+// subscriber that falls behind misses reorgs. Call cancel to stop.
+func (c *Chain) SubscribeReorgs() (reorgs <-chan Reorg, cancel func()) {
+	ch := make(chan Reorg, 16)
+	c.subsMu.Lock()
+	if c.reorgSubs == nil {
+		c.reorgSubs = make(map[chan Reorg]struct{})
+	}
+	c.reorgSubs[ch] = struct{}{}
+	c.subsMu.Unlock()
+
+	return ch, func() {
+		c.subsMu.Lock()
+		delete(c.reorgSubs, ch)
+		c.subsMu.Unlock()
+	}
+}
+
+func (c *Chain) notifyReorg(reorg Reorg) {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	for ch := range c.reorgSubs {
+		select {
+		case ch <- reorg:
+		default:
+		}
+	}
+}
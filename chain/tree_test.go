@@ -0,0 +1,82 @@
+package chain
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestPruneSide checks that a side branch is kept while it is close to
+// the tip and dropped, with the blocks built on it, once it is more than
+// SideDepth behind
+func TestPruneSide(t *testing.T) {
+	c := New(DefaultGenesis(), nil)
+	genesis := c.Tip()
+	if err := c.Append(GenerateBlock(genesis, 60)); err != nil {
+		t.Fatal(err)
+	}
+	//a block of the same height on another branch is as heavy, so it
+	//stays on the side, and so does its child while the best branch is
+	//longer
+	side := GenerateBlock(genesis, 61)
+	if err := c.Add(side); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Append(GenerateBlock(c.Tip(), 60)); err != nil {
+		t.Fatal(err)
+	}
+	child := GenerateBlock(side, 62)
+	if err := c.Add(child); err != nil {
+		t.Fatal(err)
+	}
+	if c.Tip().Hash == child.Hash {
+		t.Fatal("side branch replaced an equally heavy best branch")
+	}
+
+	for c.Tip().Index < side.Index+SideDepth {
+		if err := c.Append(GenerateBlock(c.Tip(), 60)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := c.Block(side.Hash); !ok {
+		t.Fatalf("side block dropped at tip %d, only %d below", c.Tip().Index, c.Tip().Index-side.Index)
+	}
+	if err := c.Append(GenerateBlock(c.Tip(), 60)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Block(side.Hash); ok {
+		t.Errorf("side block kept at tip %d, %d below", c.Tip().Index, c.Tip().Index-side.Index)
+	}
+	if _, ok := c.Block(child.Hash); ok {
+		t.Error("child of a dropped side block kept")
+	}
+	if err := c.Add(GenerateBlock(child, 63)); err == nil {
+		t.Error("block on a dropped side branch added")
+	}
+}
+
+// TestClaimedWork checks that a chain without a verifier doesn't let a
+// block that claims proof-work or proof-authority weight take over
+func TestClaimedWork(t *testing.T) {
+	c := New(DefaultGenesis(), nil)
+	genesis := c.Tip()
+	for range 3 {
+		if err := c.Append(GenerateBlock(c.Tip(), 60)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tip := c.Tip()
+	for _, heavy := range []Block{
+		{Difficulty: 1 << 63},
+		{Bits: 0x1d00ffff},
+	} {
+		b := GenerateBlock(genesis, 61)
+		b.Bits, b.Difficulty = heavy.Bits, heavy.Difficulty
+		b.Hash = CalculateHash(b)
+		if err := c.Add(b); !errors.Is(err, ErrInvalidBlock) {
+			t.Errorf("Add(bits %08x, difficulty %d) = %v, want %v", b.Bits, b.Difficulty, err, ErrInvalidBlock)
+		}
+	}
+	if c.Tip().Hash != tip.Hash {
+		t.Errorf("tip moved to %d", c.Tip().Index)
+	}
+}
@@ -0,0 +1,72 @@
+package chain
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// Tx is a transaction carried in a block. The chain itself only checks
+// that the header commits to them through TxRoot; what they do is up to
+// the consensus, e.g. proof-stake moves stake with them (see pos.Ledger).
+type Tx struct {
+	Type   string
+	From   string
+	To     string `json:",omitempty"`
+	Amount uint64
+	// Nonce is the number of transactions From sent before this one, so the
+	// same transaction can't be included twice
+	Nonce uint64
+	// Evidence holds signed block headers a transaction points to, such as
+	// two headers one validator signed for the same height
+	Evidence []Block `json:",omitempty"`
+	// Signature is From's ed25519 signature over the encoding, in hex. It
+	// is not part of the encoding itself.
+	Signature string `json:",omitempty"`
+}
+
+// EncodeTx returns the canonical encoding of tx, in the same style as
+// EncodeHeader
+//
+//	Type      string
+//	From      string
+//	To        string
+//	Amount    uint64
+//	Nonce     uint64
+//	Evidence  uint32 count, then per header its encoding and Signature as strings
+func EncodeTx(tx Tx) []byte {
+	buf := make([]byte, 0, 32+len(tx.Type)+len(tx.From)+len(tx.To))
+	buf = appendString(buf, tx.Type)
+	buf = appendString(buf, tx.From)
+	buf = appendString(buf, tx.To)
+	buf = binary.BigEndian.AppendUint64(buf, tx.Amount)
+	buf = binary.BigEndian.AppendUint64(buf, tx.Nonce)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(tx.Evidence)))
+	for _, header := range tx.Evidence {
+		buf = appendString(buf, string(EncodeHeader(header)))
+		buf = appendString(buf, header.Signature)
+	}
+	return buf
+}
+
+// Hash returns the SHA256 hash of the canonical encoding of tx
+func (tx Tx) Hash() string {
+	hashed := sha256.Sum256(EncodeTx(tx))
+	return hex.EncodeToString(hashed[:])
+}
+
+// TxRoot returns the hash a header commits to for txs: the SHA256 of their
+// count followed by their hashes. A block without transactions has an empty
+// root, so such headers stay as they were.
+func TxRoot(txs []Tx) string {
+	if len(txs) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	h.Write(binary.BigEndian.AppendUint32(nil, uint32(len(txs))))
+	for _, tx := range txs {
+		hashed := sha256.Sum256(EncodeTx(tx))
+		h.Write(hashed[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,66 @@
+package chain
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// Vote is a validator's signed vote for the block Hash at Height, used by
+// finality gadgets such as pos.Finality and by BFT replicas. What kinds of
+// votes there are, e.g. prevote and precommit, is up to the gadget.
+type Vote struct {
+	Type   string
+	Height int
+	// Round is the voting round, or view, for protocols that retry a height
+	Round     int `json:",omitempty"`
+	Hash      string
+	Validator string
+	// Signature is Validator's ed25519 signature over the encoding, in hex.
+	// It is not part of the encoding itself.
+	Signature string `json:",omitempty"`
+}
+
+// EncodeVote returns the canonical encoding of v, in the same style as
+// EncodeHeader
+//
+//	Type       string
+//	Height     int64
+//	Round      int64
+//	Hash       string
+//	Validator  string
+func EncodeVote(v Vote) []byte {
+	buf := make([]byte, 0, 28+len(v.Type)+len(v.Hash)+len(v.Validator))
+	buf = appendString(buf, v.Type)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(v.Height))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(v.Round))
+	buf = appendString(buf, v.Hash)
+	buf = appendString(buf, v.Validator)
+	return buf
+}
+
+// Sign sets the Validator of v to the address of key and signs v
+func (v *Vote) Sign(key ed25519.PrivateKey) {
+	v.Validator = Address(key.Public().(ed25519.PublicKey))
+	v.Signature = hex.EncodeToString(ed25519.Sign(key, EncodeVote(*v)))
+}
+
+// QuorumCert is a quorum certificate: votes of the same Type, Height,
+// Round and Hash from enough validators to prove they agreed on the block,
+// see package bft
+type QuorumCert struct {
+	Type   string
+	Height int
+	Round  int
+	Hash   string
+	Votes  []Vote
+}
+
+// VerifyVote checks that v was signed by its Validator
+func VerifyVote(v Vote) error {
+	if err := verify(v.Validator, EncodeVote(v), v.Signature); err != nil {
+		return fmt.Errorf("%w: %s for %d by %s: %v", ErrBadSignature, v.Type, v.Height, v.Validator, err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package chain
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// Targets are kept in block headers in Bitcoin's compact "bits" form: the
+// top byte is a base-256 exponent and the low three bytes a mantissa, so
+// target = mantissa * 256^(exponent-3). 0x1d00ffff, for example, is
+// 0x00ffff followed by 26 zero bytes.
+
+var oneLsh256 = new(big.Int).Lsh(big.NewInt(1), 256)
+
+// CompactToBig converts compact bits to the target they encode
+func CompactToBig(bits uint32) *big.Int {
+	mantissa := int64(bits & 0x007fffff)
+	negative := bits&0x00800000 != 0
+	exponent := uint(bits >> 24)
+
+	var target *big.Int
+	if exponent <= 3 {
+		target = big.NewInt(mantissa >> (8 * (3 - exponent)))
+	} else {
+		target = big.NewInt(mantissa)
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if negative {
+		target.Neg(target)
+	}
+	return target
+}
+
+// BigToCompact converts a target to compact bits, dropping the precision
+// that doesn't fit in the three byte mantissa
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+	if exponent <= 3 {
+		mantissa = uint32(target.Bits()[0])
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tmp := new(big.Int).Abs(target)
+		mantissa = uint32(tmp.Rsh(tmp, 8*(exponent-3)).Bits()[0])
+	}
+
+	// the 0x00800000 bit is the sign, so a mantissa that would set it is
+	// shifted down a byte and the exponent bumped instead
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	bits := uint32(exponent<<24) | mantissa
+	if target.Sign() < 0 {
+		bits |= 0x00800000
+	}
+	return bits
+}
+
+// CalcWork returns the expected number of hashes needed to find a block
+// with the given bits, 2^256 / (target+1). Blocks without a target (bits 0,
+// i.e. not proof-work) count as one unit of work, so for them the heaviest
+// chain is simply the longest.
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if bits == 0 || target.Sign() <= 0 {
+		return big.NewInt(1)
+	}
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(oneLsh256, denominator)
+}
+
+// Work returns the cumulative chain work up to and including b
+func (b Block) Work() *big.Int {
+	work, ok := new(big.Int).SetString(b.ChainWork, 16)
+	if !ok {
+		return new(big.Int)
+	}
+	return work
+}
+
+// addWork sets the ChainWork of b to the work of its parent plus its own.
+// A proof-authority block's own work is its Difficulty.
+func addWork(b *Block, parent *Block) {
+	work := CalcWork(b.Bits)
+	if b.Bits == 0 && b.Difficulty > 0 {
+		work.SetUint64(b.Difficulty)
+	}
+	if parent != nil {
+		work.Add(work, parent.Work())
+	}
+	b.ChainWork = work.Text(16)
+}
+
+// CheckNoWork checks that b doesn't claim work of its own through Bits or
+// Difficulty. Rules that don't check those fields must refuse them, or a
+// single block with a made up target or difficulty would outweigh any
+// honest chain.
+func CheckNoWork(b Block) error {
+	if b.Bits != 0 || b.Difficulty != 0 {
+		return fmt.Errorf("%w: index %d: bits %08x and difficulty %d on a chain that doesn't check them", ErrInvalidBlock, b.Index, b.Bits, b.Difficulty)
+	}
+	return nil
+}
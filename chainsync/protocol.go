@@ -0,0 +1,250 @@
+// Package chainsync lets a node download the blocks it is missing from its
+// peers, instead of being sent whole chains. Two nodes first exchange a
+// Status, their genesis and best block. The one behind finds the last
+// block both chains share, downloads the headers after it from the peer
+// with the best chain and checks that they link up, then downloads the
+// blocks for those headers by range, from every peer that has them at
+// once, and adds each range to its chain as soon as the ranges before it
+// are in.
+//
+// The protocol is one JSON Message per line over any stream, so it runs
+// over libp2p streams and plain TCP alike. Requests carry an ID the
+// response repeats, so a peer can have several requests in flight.
+package chainsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"blockchain-go/chain"
+)
+
+// Message types
+const (
+	TypeStatus     = "status"
+	TypeGetHeaders = "getheaders"
+	TypeHeaders    = "headers"
+	TypeGetBlocks  = "getblocks"
+	TypeBlocks     = "blocks"
+	TypeError      = "error"
+)
+
+const (
+	// MaxHeaders is the most headers a response carries
+	MaxHeaders = 512
+	// MaxBlocks is the most blocks a response carries
+	MaxBlocks = 64
+)
+
+var (
+	// ErrClosed is returned by requests to a peer whose stream is gone
+	ErrClosed = errors.New("chainsync: stream closed")
+	// ErrBadResponse is returned for responses that don't answer the request
+	ErrBadResponse = errors.New("chainsync: bad response")
+)
+
+// Status is what a node tells its peers about its chain
+type Status struct {
+	// Genesis is the hash of the genesis block: peers with another one are
+	// on another network
+	Genesis string
+	Height  int
+	Tip     string
+	// Work is the cumulative work of the chain, in hex, see Block.ChainWork
+	Work string
+	// Finalized is the height of the last finalized block
+	Finalized int
+}
+
+// NewStatus returns the status of c
+func NewStatus(c *chain.Chain) Status {
+	tip := c.Tip()
+	return Status{
+		Genesis:   c.Genesis().Hash,
+		Height:    tip.Index,
+		Tip:       tip.Hash,
+		Work:      tip.ChainWork,
+		Finalized: c.Finalized().Index,
+	}
+}
+
+// Message is a request or a response. Requests are status (answered by a
+// status), getheaders and getblocks, asking for Count headers or blocks
+// of the best chain from height From on; fewer come back if the chain
+// is shorter.
+type Message struct {
+	Type   string
+	ID     uint64  `json:",omitempty"`
+	Status *Status `json:",omitempty"`
+	From   int     `json:",omitempty"`
+	Count  int     `json:",omitempty"`
+	// Headers are blocks without their Txs and QC
+	Headers []chain.Block `json:",omitempty"`
+	Blocks  []chain.Block `json:",omitempty"`
+	Error   string        `json:",omitempty"`
+}
+
+// Header returns the header of b: b without the transactions and the
+// certificate, which the header doesn't cover, and without ChainWork,
+// which is never trusted from a peer anyway
+func Header(b chain.Block) chain.Block {
+	b.Txs = nil
+	b.QC = nil
+	b.ChainWork = ""
+	return b
+}
+
+// Serve answers the request req from c
+func Serve(c *chain.Chain, req Message) Message {
+	resp := Message{ID: req.ID}
+	switch req.Type {
+	case TypeStatus:
+		status := NewStatus(c)
+		resp.Type, resp.Status = TypeStatus, &status
+	case TypeGetHeaders:
+		resp.Type = TypeHeaders
+		for _, b := range blockRange(c, req.From, min(req.Count, MaxHeaders)) {
+			resp.Headers = append(resp.Headers, Header(b))
+		}
+	case TypeGetBlocks:
+		resp.Type = TypeBlocks
+		resp.Blocks = blockRange(c, req.From, min(req.Count, MaxBlocks))
+		for i := range resp.Blocks {
+			resp.Blocks[i].ChainWork = ""
+		}
+	default:
+		resp.Type, resp.Error = TypeError, "unknown request "+req.Type
+	}
+	return resp
+}
+
+// blockRange returns up to count blocks of the best chain of c from height from on
+func blockRange(c *chain.Chain, from, count int) []chain.Block {
+	var blocks []chain.Block
+	for i := max(from, 0); i < from+count; i++ {
+		b, ok := c.Get(i)
+		if !ok {
+			break
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+// ServeStream answers the requests read from r, one per line, on w from c
+// until r ends
+func ServeStream(c *chain.Chain, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	enc := json.NewEncoder(w)
+	for scanner.Scan() {
+		var req Message
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return err
+		}
+		if err := enc.Encode(Serve(c, req)); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Peer is a node we can send requests to
+type Peer interface {
+	// ID names the peer in logs and errors
+	ID() string
+	// Request sends req and waits for the response
+	Request(ctx context.Context, req Message) (Message, error)
+}
+
+// StreamPeer is a Peer at the other end of a stream that ServeStream
+// answers on
+type StreamPeer struct {
+	id string
+	rw io.ReadWriteCloser
+
+	wmu sync.Mutex
+	enc *json.Encoder
+
+	mu      sync.Mutex
+	next    uint64
+	waiting map[uint64]chan Message
+	done    chan struct{}
+}
+
+// NewStreamPeer starts reading the responses from rw
+func NewStreamPeer(id string, rw io.ReadWriteCloser) *StreamPeer {
+	p := &StreamPeer{id: id, rw: rw, enc: json.NewEncoder(rw), waiting: make(map[uint64]chan Message), done: make(chan struct{})}
+	go p.read()
+	return p
+}
+
+// ID returns the id the peer was created with
+func (p *StreamPeer) ID() string { return p.id }
+
+// Done is closed once the stream is gone
+func (p *StreamPeer) Done() <-chan struct{} { return p.done }
+
+// Close closes the stream
+func (p *StreamPeer) Close() error { return p.rw.Close() }
+
+// Request implements Peer
+func (p *StreamPeer) Request(ctx context.Context, req Message) (Message, error) {
+	ch := make(chan Message, 1)
+	p.mu.Lock()
+	p.next++
+	req.ID = p.next
+	p.waiting[req.ID] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.waiting, req.ID)
+		p.mu.Unlock()
+	}()
+
+	p.wmu.Lock()
+	err := p.enc.Encode(req)
+	p.wmu.Unlock()
+	if err != nil {
+		return Message{}, err
+	}
+	select {
+	case resp := <-ch:
+		if resp.Type == TypeError {
+			return resp, errors.New("chainsync: " + p.id + ": " + resp.Error)
+		}
+		return resp, nil
+	case <-p.done:
+		return Message{}, ErrClosed
+	case <-ctx.Done():
+		return Message{}, ctx.Err()
+	}
+}
+
+func (p *StreamPeer) read() {
+	defer close(p.done)
+	defer p.rw.Close()
+	scanner := bufio.NewScanner(p.rw)
+	//a full getblocks response can be large
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var resp Message
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			return
+		}
+		//a request gets one response: the waiter is taken out before it is
+		//sent to, so a second response with the same ID finds none and
+		//can't block the loop on the full channel
+		p.mu.Lock()
+		ch := p.waiting[resp.ID]
+		delete(p.waiting, resp.ID)
+		p.mu.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package chainsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"blockchain-go/chain"
+	"blockchain-go/pow"
+)
+
+const (
+	// perPeer is how many block requests a peer has in flight at once
+	perPeer = 2
+	// requestTimeout bounds a single request
+	requestTimeout = 30 * time.Second
+)
+
+var (
+	// ErrBadHeaders is returned for headers that don't link up or don't
+	// carry their own hash
+	ErrBadHeaders = errors.New("chainsync: bad headers")
+	// ErrBadBlocks is returned for blocks that don't match their headers
+	ErrBadBlocks = errors.New("chainsync: blocks don't match headers")
+	// ErrNoPeers is returned when no peer is left to download from
+	ErrNoPeers = errors.New("chainsync: no peer left to download from")
+)
+
+// Syncer brings a chain up to date with the best chain among its peers
+type Syncer struct {
+	chain *chain.Chain
+
+	mu    sync.Mutex
+	peers map[string]Peer
+
+	// running makes Sync calls take turns
+	running sync.Mutex
+}
+
+// NewSyncer creates a Syncer for c without peers
+func NewSyncer(c *chain.Chain) *Syncer {
+	return &Syncer{chain: c, peers: make(map[string]Peer)}
+}
+
+// AddPeer adds p, replacing a peer with the same ID
+func (s *Syncer) AddPeer(p Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[p.ID()] = p
+}
+
+// RemovePeer removes the peer with id
+func (s *Syncer) RemovePeer(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, id)
+}
+
+// Len returns the number of peers
+func (s *Syncer) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.peers)
+}
+
+// candidate is a peer with its status
+type candidate struct {
+	peer   Peer
+	status Status
+}
+
+// job is a range of blocks to download: those with hashes, from height from on
+type job struct {
+	from   int
+	hashes []string
+}
+
+// result is what a download of a job brought: the blocks that matched
+// its headers, oldest first
+type result struct {
+	job    job
+	peer   Peer
+	blocks []chain.Block
+	err    error
+}
+
+// Sync asks every peer for its status and, if one has a better chain,
+// downloads the blocks we are missing of it and adds them to our chain.
+// It returns how many blocks were added. Peers that send bad headers or
+// blocks are removed.
+func (s *Syncer) Sync(ctx context.Context) (added int, err error) {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	candidates := s.statuses(ctx)
+	best, ok := s.best(candidates)
+	if !ok {
+		return 0, nil
+	}
+	fork, err := s.findFork(ctx, best.peer, best.status.Height)
+	if err != nil {
+		s.RemovePeer(best.peer.ID())
+		return 0, err
+	}
+	return s.download(ctx, best, fork, candidates)
+}
+
+// statuses asks every peer for its status, and removes those on another
+// network
+func (s *Syncer) statuses(ctx context.Context) []candidate {
+	s.mu.Lock()
+	peers := make([]Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	s.mu.Unlock()
+
+	genesis := s.chain.Genesis().Hash
+	var (
+		mu         sync.Mutex
+		wg         sync.WaitGroup
+		candidates []candidate
+	)
+	for _, p := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := request(ctx, p, Message{Type: TypeStatus})
+			if err != nil || resp.Status == nil {
+				return
+			}
+			if resp.Status.Genesis != genesis {
+				s.RemovePeer(p.ID())
+				return
+			}
+			mu.Lock()
+			candidates = append(candidates, candidate{p, *resp.Status})
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return candidates
+}
+
+// best returns the candidate with the most work, if that is more than ours
+func (s *Syncer) best(candidates []candidate) (candidate, bool) {
+	var best candidate
+	bestWork := s.chain.Tip().Work()
+	found := false
+	for _, c := range candidates {
+		work, ok := new(big.Int).SetString(c.status.Work, 16)
+		if ok && work.Cmp(bestWork) > 0 {
+			best, bestWork, found = c, work, true
+		}
+	}
+	return best, found
+}
+
+// findFork returns the height of the last block our chain shares with
+// that of p, which is height blocks long: it steps back from the top
+// twice as far each time until the blocks match, then bisects
+func (s *Syncer) findFork(ctx context.Context, p Peer, height int) (int, error) {
+	matches := func(h int) (bool, error) {
+		ours, ok := s.chain.Get(h)
+		if !ok {
+			return false, nil
+		}
+		resp, err := request(ctx, p, Message{Type: TypeGetHeaders, From: h, Count: 1})
+		if err != nil {
+			return false, err
+		}
+		if len(resp.Headers) != 1 || resp.Headers[0].Index != h {
+			return false, fmt.Errorf("%w: %s: no header %d", ErrBadResponse, p.ID(), h)
+		}
+		return resp.Headers[0].Hash == ours.Hash, nil
+	}
+
+	//the genesis block matches, Sync checked; hi never does
+	lo, hi := 0, min(s.chain.Tip().Index, height)+1
+	for step := 1; hi-step > lo; step *= 2 {
+		ok, err := matches(hi - step)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = hi - step
+			break
+		}
+		hi -= step
+	}
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		ok, err := matches(mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// download fetches the headers after fork from best, and the blocks for
+// them from every candidate that has them. Three stages run at once: the
+// headers come in, ranges of blocks are downloaded for the headers that
+// are in, and the ranges are added to the chain in order as they arrive.
+func (s *Syncer) download(ctx context.Context, best candidate, fork int, candidates []candidate) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	headers := make(chan []string)
+	headersErr := make(chan error, 1)
+	go func() {
+		defer close(headers)
+		headersErr <- s.fetchHeaders(ctx, best.peer, fork, best.status.Height, headers)
+	}()
+
+	ranges := make(chan result, 16)
+	var (
+		added int
+		verr  error
+		done  = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		added, verr = s.validate(ranges, cancel)
+	}()
+	err := s.schedule(ctx, fork+1, headers, candidates, ranges)
+	close(ranges)
+	<-done
+	if verr != nil {
+		//schedule only saw the cancel
+		err = verr
+	}
+	if herr := <-headersErr; err == nil && !errors.Is(herr, context.Canceled) {
+		err = herr
+	}
+	return added, err
+}
+
+// fetchHeaders downloads the headers from fork+1 to height from p and
+// sends their hashes, in batches, once they are checked
+func (s *Syncer) fetchHeaders(ctx context.Context, p Peer, fork, height int, out chan<- []string) error {
+	prev, _ := s.chain.Get(fork)
+	for prev.Index < height {
+		resp, err := request(ctx, p, Message{Type: TypeGetHeaders, From: prev.Index + 1, Count: MaxHeaders})
+		if err != nil {
+			return err
+		}
+		if len(resp.Headers) == 0 {
+			//it had fewer blocks than it said, sync what we have
+			return nil
+		}
+		hashes := make([]string, len(resp.Headers))
+		for i, h := range resp.Headers {
+			if err := checkHeader(h, prev); err != nil {
+				s.RemovePeer(p.ID())
+				return fmt.Errorf("%s: %w", p.ID(), err)
+			}
+			hashes[i] = h.Hash
+			prev = h
+		}
+		select {
+		case out <- hashes:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// checkHeader checks what can be checked of h without its body and the
+// chain behind it: that it follows prev, that its hash is right, and its
+// signature or proof of work if it has one
+func checkHeader(h, prev chain.Block) error {
+	if h.Index != prev.Index+1 || h.PrevHash != prev.Hash || chain.CalculateHash(h) != h.Hash {
+		return fmt.Errorf("%w: index %d", ErrBadHeaders, h.Index)
+	}
+	if h.Validator != "" {
+		if err := chain.VerifySignature(h); err != nil {
+			return err
+		}
+	}
+	if h.Bits != 0 {
+		if err := pow.CheckProofOfWork(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schedule splits the headers into ranges of MaxBlocks, downloads them
+// from the candidates, at most perPeer at once from each, and passes the
+// downloaded ranges on in order. A range a peer couldn't serve goes to
+// another one, and that peer isn't asked again this time.
+func (s *Syncer) schedule(ctx context.Context, next int, headers <-chan []string, candidates []candidate, ranges chan<- result) error {
+	var (
+		queue    []job
+		end      = next
+		inFlight = make(map[Peer]int)
+		failed   = make(map[Peer]bool)
+		ready    = make(map[int]result)
+		//room for every fetch that can be running, so none of them is left
+		//blocked on send when we return early
+		results = make(chan result, perPeer*len(candidates))
+		running int
+	)
+	for headers != nil || len(queue) > 0 || running > 0 || len(ready) > 0 {
+		//hand out the queued ranges to the least busy peers that have them
+		for len(queue) > 0 {
+			j := queue[0]
+			var peer Peer
+			for _, c := range candidates {
+				last := j.from + len(j.hashes) - 1
+				if !failed[c.peer] && inFlight[c.peer] < perPeer && c.status.Height >= last &&
+					(peer == nil || inFlight[c.peer] < inFlight[peer]) {
+					peer = c.peer
+				}
+			}
+			if peer == nil {
+				break
+			}
+			queue = queue[1:]
+			inFlight[peer]++
+			running++
+			go func() { results <- fetchBlocks(ctx, peer, j) }()
+		}
+		if len(queue) > 0 && running == 0 && headers == nil {
+			return ErrNoPeers
+		}
+
+		select {
+		case hashes, ok := <-headers:
+			if !ok {
+				headers = nil
+				continue
+			}
+			for i := 0; i < len(hashes); i += MaxBlocks {
+				queue = append(queue, job{from: end + i, hashes: hashes[i:min(i+MaxBlocks, len(hashes))]})
+			}
+			end += len(hashes)
+		case r := <-results:
+			inFlight[r.peer]--
+			running--
+			if r.err != nil || len(r.blocks) == 0 {
+				failed[r.peer] = true
+				if errors.Is(r.err, ErrBadBlocks) {
+					s.RemovePeer(r.peer.ID())
+				}
+				queue = append([]job{r.job}, queue...)
+				continue
+			}
+			if len(r.blocks) < len(r.job.hashes) {
+				rest := job{from: r.job.from + len(r.blocks), hashes: r.job.hashes[len(r.blocks):]}
+				queue = append([]job{rest}, queue...)
+				r.job.hashes = r.job.hashes[:len(r.blocks)]
+			}
+			ready[r.job.from] = r
+			for {
+				r, ok := ready[next]
+				if !ok {
+					break
+				}
+				delete(ready, next)
+				select {
+				case ranges <- r:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				next += len(r.blocks)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// fetchBlocks downloads the range j from p and keeps the blocks, from the
+// first on, that match their headers
+func fetchBlocks(ctx context.Context, p Peer, j job) result {
+	r := result{job: j, peer: p}
+	resp, err := request(ctx, p, Message{Type: TypeGetBlocks, From: j.from, Count: len(j.hashes)})
+	if err != nil {
+		r.err = err
+		return r
+	}
+	for i, b := range resp.Blocks {
+		if i >= len(j.hashes) || b.Hash != j.hashes[i] || chain.CalculateHash(b) != b.Hash || chain.TxRoot(b.Txs) != b.TxRoot {
+			break
+		}
+		r.blocks = append(r.blocks, b)
+	}
+	if len(r.blocks) == 0 && len(resp.Blocks) > 0 {
+		r.err = fmt.Errorf("%w: %s at %d", ErrBadBlocks, p.ID(), j.from)
+	}
+	return r
+}
+
+// validate adds the ranges to the chain in the order they come. A block
+// the chain refuses ends the sync, through cancel, and its sender is
+// removed.
+func (s *Syncer) validate(ranges <-chan result, cancel context.CancelFunc) (int, error) {
+	added := 0
+	var err error
+	for r := range ranges {
+		if err != nil {
+			//drain, so schedule never blocks
+			continue
+		}
+		for _, b := range r.blocks {
+			switch e := s.chain.Add(b); {
+			case e == nil:
+				added++
+			case errors.Is(e, chain.ErrKnownBlock):
+			default:
+				s.RemovePeer(r.peer.ID())
+				err = fmt.Errorf("%s: %w", r.peer.ID(), e)
+				cancel()
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+	return added, err
+}
+
+func request(ctx context.Context, p Peer, req Message) (Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	return p.Request(ctx, req)
+}
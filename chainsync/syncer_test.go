@@ -0,0 +1,136 @@
+package chainsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"blockchain-go/chain"
+)
+
+// extend appends n blocks to c
+func extend(t *testing.T, c *chain.Chain, n int) {
+	t.Helper()
+	for range n {
+		if err := c.Append(chain.GenerateBlock(c.Tip(), 60+c.Len()%40)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// pipe returns a StreamPeer talking to serve over an in-memory stream
+func pipe(t *testing.T, id string, serve func(net.Conn)) *StreamPeer {
+	ours, theirs := net.Pipe()
+	go func() {
+		defer theirs.Close()
+		serve(theirs)
+	}()
+	p := NewStreamPeer(id, ours)
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// tampered answers requests from c like ServeStream, but changes every
+// block it sends, so none matches its header
+func tampered(c *chain.Chain) func(net.Conn) {
+	return func(conn net.Conn) {
+		scanner := bufio.NewScanner(conn)
+		enc := json.NewEncoder(conn)
+		for scanner.Scan() {
+			var req Message
+			json.Unmarshal(scanner.Bytes(), &req)
+			resp := Serve(c, req)
+			for i := range resp.Blocks {
+				resp.Blocks[i].BPM++
+			}
+			if enc.Encode(resp) != nil {
+				return
+			}
+		}
+	}
+}
+
+// TestSync syncs a chain that forked off a while ago from two peers with
+// a longer chain and one that serves bad blocks
+func TestSync(t *testing.T) {
+	g := chain.DefaultGenesis()
+	remote := chain.New(g, nil)
+	extend(t, remote, 40)
+	local := chain.New(g, nil)
+	for i := 1; i <= 40; i++ {
+		b, _ := remote.Get(i)
+		if err := local.Append(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//both go their own way after block 40, ours for 10 blocks and theirs
+	//for several ranges
+	extend(t, local, 10)
+	extend(t, remote, 5*MaxBlocks)
+
+	s := NewSyncer(local)
+	for _, id := range []string{"good1", "good2"} {
+		s.AddPeer(pipe(t, id, func(conn net.Conn) { ServeStream(remote, conn, conn) }))
+	}
+	s.AddPeer(pipe(t, "bad", tampered(remote)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	added, err := s.Sync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local.Tip().Hash != remote.Tip().Hash {
+		t.Errorf("tip %d %.8s, want %d %.8s", local.Tip().Index, local.Tip().Hash, remote.Tip().Index, remote.Tip().Hash)
+	}
+	if want := remote.Len() - 41; added != want {
+		t.Errorf("added %d blocks, want %d", added, want)
+	}
+	if s.Len() != 2 {
+		t.Errorf("%d peers left, want the 2 good ones", s.Len())
+	}
+
+	//in sync now, so there is nothing to do
+	if added, err := s.Sync(ctx); added != 0 || err != nil {
+		t.Errorf("second Sync = %d, %v", added, err)
+	}
+}
+
+// TestDuplicateResponses checks that a peer answering a request twice
+// before the requester got to the first answer doesn't stop the responses
+// to later requests
+func TestDuplicateResponses(t *testing.T) {
+	c := chain.New(chain.DefaultGenesis(), nil)
+	const unread = 1 << 20
+	p := pipe(t, "echo", func(conn net.Conn) {
+		//answer the unread request twice before the one that was sent
+		scanner := bufio.NewScanner(conn)
+		enc := json.NewEncoder(conn)
+		for scanner.Scan() {
+			var req Message
+			json.Unmarshal(scanner.Bytes(), &req)
+			for _, resp := range []Message{{Type: TypeStatus, ID: unread}, {Type: TypeStatus, ID: unread}, Serve(c, req)} {
+				if enc.Encode(resp) != nil {
+					return
+				}
+			}
+		}
+	})
+	//a request whose requester is busy elsewhere
+	p.mu.Lock()
+	p.waiting[unread] = make(chan Message, 1)
+	p.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := p.Request(ctx, Message{Type: TypeStatus})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status == nil || resp.Status.Tip != c.Tip().Hash {
+		t.Errorf("got %+v, want the status of our chain", resp)
+	}
+}
@@ -0,0 +1,164 @@
+package consensus
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"time"
+
+	"blockchain-go/bft"
+	"blockchain-go/chain"
+)
+
+// ErrSubmitOnly is returned by BFT.Prepare: BFT blocks are agreed on by
+// the replicas, so a node asks for one with Submit instead of forging it
+var ErrSubmitOnly = errors.New("consensus: bft blocks are made by the replicas, submit a request instead")
+
+// Service is implemented by engines that run in the background next to
+// the node, such as BFT replicas talking to each other
+type Service interface {
+	// Start starts the engine on c, the chain of the node
+	Start(c *chain.Chain) error
+}
+
+// Submitter is implemented by engines where a node doesn't forge blocks
+// itself but asks the network to agree on one
+type Submitter interface {
+	// Submit asks for a block for bpm and returns it once it is on the chain
+	Submit(ctx context.Context, bpm int) (chain.Block, error)
+}
+
+// BFT is the PBFT style consensus of a fixed set of replicas, see package
+// bft. The node must hold the key of one of the replicas.
+type BFT struct {
+	Verifier bft.Verifier
+	Key      ed25519.PrivateKey
+	Timeout  time.Duration
+	// PeerListen is the address the replica listens on for the others,
+	// and Peers are the addresses of the others
+	PeerListen string
+	Peers      []string
+
+	chain   *chain.Chain
+	replica *bft.Replica
+}
+
+// NewBFT creates the BFT engine for the chain that starts with g
+func NewBFT(g *chain.Genesis, opts Options) (*BFT, error) {
+	if len(g.Replicas) == 0 {
+		return nil, errors.New("consensus: genesis has no replicas, set them with: init -replica addr")
+	}
+	for _, address := range g.Replicas {
+		if _, err := chain.PublicKey(address); err != nil {
+			return nil, err
+		}
+	}
+	var key ed25519.PrivateKey
+	for _, address := range slices.Sorted(maps.Keys(opts.Keys)) {
+		if slices.Contains(g.Replicas, address) {
+			key = opts.Keys[address]
+			break
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w: none of the %d keys of this node", bft.ErrNotReplica, len(opts.Keys))
+	}
+	if opts.PeerListen == "" {
+		return nil, errors.New("consensus: bft needs an address to listen for the other replicas on")
+	}
+	return &BFT{
+		Verifier:   bft.NewVerifier(g),
+		Key:        key,
+		Timeout:    time.Duration(g.BFT.ViewTimeout),
+		PeerListen: opts.PeerListen,
+		Peers:      opts.Peers,
+	}, nil
+}
+
+// Start runs this node's replica on c, and connects it to the others
+func (e *BFT) Start(c *chain.Chain) error {
+	t, err := bft.NewTCP(e.PeerListen, e.Peers)
+	if err != nil {
+		return err
+	}
+	e.replica, err = bft.NewReplica(c, e.Key, e.Verifier.Replicas, e.Timeout, t)
+	if err != nil {
+		return err
+	}
+	e.chain = c
+	e.replica.Start()
+	go func() { log.Fatal(t.Serve(e.replica.Handle)) }()
+	log.Printf("bft replica %s, %d peers", e.replica.Address(), len(e.Peers))
+	return nil
+}
+
+// Submit signs a request for bpm with the replica key, hands it to the
+// replica and waits for the block that decides it. It fails with the
+// replica's error if the replica stalled, see bft.Replica.Err.
+func (e *BFT) Submit(ctx context.Context, bpm int) (chain.Block, error) {
+	if e.replica == nil {
+		return chain.Block{}, errors.New("consensus: bft replica not started")
+	}
+	tx := chain.Tx{
+		Type:   bft.TxRequest,
+		From:   e.replica.Address(),
+		Amount: uint64(bpm),
+		// requests are told apart by their nonce
+		Nonce: uint64(time.Now().UnixNano()),
+	}
+	tx.Sign(e.Key)
+	hash := tx.Hash()
+
+	tips, stop := e.chain.Subscribe()
+	defer stop()
+	from := e.chain.Len()
+	if err := e.replica.Err(); err != nil {
+		return chain.Block{}, err
+	}
+	if err := e.replica.Submit(tx); err != nil {
+		return chain.Block{}, err
+	}
+	//a replica that can't append decided blocks won't see this one either
+	check := time.NewTicker(e.Timeout)
+	defer check.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return chain.Block{}, ctx.Err()
+		case <-check.C:
+			if err := e.replica.Err(); err != nil {
+				return chain.Block{}, err
+			}
+			continue
+		case <-tips:
+		}
+		//tips may be missed, so look at every block since the request
+		for ; from < e.chain.Len(); from++ {
+			b, _ := e.chain.Get(from)
+			if len(b.Txs) > 0 && b.Txs[0].Hash() == hash {
+				return b, nil
+			}
+		}
+	}
+}
+
+func (e *BFT) Prepare(b *chain.Block, prev []chain.Block) error {
+	return ErrSubmitOnly
+}
+
+func (e *BFT) Seal(ctx context.Context, b *chain.Block, prev []chain.Block) error {
+	return ErrSubmitOnly
+}
+
+func (e *BFT) VerifyHeader(b chain.Block, prev []chain.Block) error {
+	return e.Verifier.VerifyBlock(b, prev)
+}
+
+// ForkChoice only takes chains that extend ours, as decided blocks are final
+func (e *BFT) ForkChoice(current, candidate []chain.Block) bool {
+	return bft.Extends(current, candidate)
+}
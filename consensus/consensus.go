@@ -0,0 +1,97 @@
+// Package consensus puts the consensus rules of this repo behind one
+// interface, so a single node program can run any of them. An Engine
+// prepares and seals the blocks a node makes, checks the blocks it is
+// given, and picks between forks; everything else about blocks, such as
+// linking and hashing, is the same for every engine and stays in chain.
+package consensus
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"strings"
+
+	"blockchain-go/chain"
+)
+
+// Engine is a set of consensus rules
+type Engine interface {
+	// Prepare fills in the consensus fields of b, a new block on top of
+	// prev (its parent last), that are known before sealing, such as the
+	// proof-work target
+	Prepare(b *chain.Block, prev []chain.Block) error
+	// Seal makes b valid, e.g. by mining its nonce or signing it. It can
+	// take a while, up to waiting for the validator's turn, and gives up
+	// with ctx.Err() once ctx is done.
+	Seal(ctx context.Context, b *chain.Block, prev []chain.Block) error
+	// VerifyHeader checks the consensus fields of b on top of prev
+	VerifyHeader(b chain.Block, prev []chain.Block) error
+	// ForkChoice reports whether candidate should replace current. Both
+	// are valid chains that start with the same genesis block.
+	ForkChoice(current, candidate []chain.Block) bool
+}
+
+// ErrUnknownEngine is returned by New for names it doesn't know
+var ErrUnknownEngine = errors.New("consensus: unknown engine")
+
+// Options are the node settings engines may need
+type Options struct {
+	// MinerThreads is the number of proof-work workers, 0 for one per CPU
+	MinerThreads int
+	// Keys are the validator or signer keys the node seals blocks with, by
+	// address
+	Keys map[string]ed25519.PrivateKey
+	// RandaoKey derives the RANDAO secrets of proof-stake validators, and
+	// is required when there are Keys to forge with
+	RandaoKey []byte
+	// PeerListen is where a BFT replica listens for the other replicas,
+	// and Peers are their addresses
+	PeerListen string
+	Peers      []string
+}
+
+// Names lists the engines New knows
+var Names = []string{"none", "pow", "pos", "poa", "bft"}
+
+// New returns the engine called name for the chain that starts with g
+func New(name string, g *chain.Genesis, opts Options) (Engine, error) {
+	switch name {
+	case "none":
+		return None{}, nil
+	case "pow":
+		return NewPoW(g, opts)
+	case "pos":
+		return NewPoS(g, opts)
+	case "poa":
+		return NewPoA(g, opts)
+	case "bft":
+		return NewBFT(g, opts)
+	}
+	return nil, fmt.Errorf("%w %q, want one of %s", ErrUnknownEngine, name, strings.Join(Names, ", "))
+}
+
+// Verifier makes a chain.Chain check blocks with e, and choose between
+// forks with it
+func Verifier(e Engine) chain.Verifier {
+	return verifier{e}
+}
+
+type verifier struct {
+	engine Engine
+}
+
+func (v verifier) VerifyBlock(b chain.Block, prev []chain.Block) error {
+	return v.engine.VerifyHeader(b, prev)
+}
+
+func (v verifier) ForkChoice(current, candidate []chain.Block) bool {
+	return v.engine.ForkChoice(current, candidate)
+}
+
+// Heaviest is the fork choice of engines without one of their own: the
+// chain with the most cumulative work wins, which for chains without
+// proof-work is the longest. Ties keep the current chain.
+func Heaviest(current, candidate []chain.Block) bool {
+	return candidate[len(candidate)-1].Work().Cmp(current[len(current)-1].Work()) > 0
+}
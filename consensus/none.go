@@ -0,0 +1,29 @@
+package consensus
+
+import (
+	"context"
+
+	"blockchain-go/chain"
+)
+
+// None appends blocks as they come, like the original main.go and
+// networking programs: any block that links to its parent is valid, as
+// long as it claims no proof-work or proof-authority weight
+type None struct{}
+
+func (None) Prepare(b *chain.Block, prev []chain.Block) error {
+	return nil
+}
+
+func (None) Seal(ctx context.Context, b *chain.Block, prev []chain.Block) error {
+	b.Hash = chain.CalculateHash(*b)
+	return nil
+}
+
+func (None) VerifyHeader(b chain.Block, prev []chain.Block) error {
+	return chain.CheckNoWork(b)
+}
+
+func (None) ForkChoice(current, candidate []chain.Block) bool {
+	return Heaviest(current, candidate)
+}
@@ -0,0 +1,165 @@
+package consensus
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"blockchain-go/chain"
+	"blockchain-go/poa"
+)
+
+// ErrNotSigner is returned by PoA.Prepare when none of the node's keys may
+// seal the next block
+var ErrNotSigner = errors.New("consensus: no signer on this node may seal the next block")
+
+// wiggleTime is how long an out-of-turn signer waits, per signer that may
+// seal, before it steps in, so the in-turn block usually wins
+const wiggleTime = 500 * time.Millisecond
+
+// Voter is implemented by engines whose signers vote each other in and
+// out, like PoA. A node's proposals go into the blocks it seals until they
+// pass.
+type Voter interface {
+	// Propose votes to authorize or drop address from now on
+	Propose(address string, authorize bool)
+	// Discard stops voting on address
+	Discard(address string)
+	// Proposals returns the addresses voted on, and whether to authorize them
+	Proposals() map[string]bool
+	// Signers returns the signers as of the last of blocks
+	Signers(blocks []chain.Block) ([]string, error)
+}
+
+// PoA is proof-authority: a fixed but votable set of signers take turns,
+// see package poa
+type PoA struct {
+	Snapshots *poa.Snapshots
+	Keys      map[string]ed25519.PrivateKey
+
+	mu        sync.Mutex
+	proposals map[string]bool
+}
+
+// NewPoA creates the proof-authority engine for the chain that starts with g
+func NewPoA(g *chain.Genesis, opts Options) (*PoA, error) {
+	if len(g.Authorities) == 0 {
+		return nil, errors.New("consensus: genesis has no authorities, set them with: init -authority addr")
+	}
+	for _, address := range g.Authorities {
+		if _, err := chain.PublicKey(address); err != nil {
+			return nil, err
+		}
+	}
+	return &PoA{
+		Snapshots: poa.NewSnapshots(g),
+		Keys:      opts.Keys,
+		proposals: make(map[string]bool),
+	}, nil
+}
+
+// Prepare picks the signer of b among the node's keys, the in-turn one if
+// the node has it, and puts one of the node's proposals in b
+func (e *PoA) Prepare(b *chain.Block, prev []chain.Block) error {
+	snap, err := e.Snapshots.At(prev)
+	if err != nil {
+		return err
+	}
+	signer := ""
+	for _, address := range slices.Sorted(maps.Keys(e.Keys)) {
+		if !snap.CanSeal(b.Index, address) {
+			continue
+		}
+		if signer == "" || snap.InTurn(b.Index, address) {
+			signer = address
+		}
+	}
+	if signer == "" {
+		return ErrNotSigner
+	}
+	b.Validator = signer
+	b.Difficulty = snap.Difficulty(b.Index, signer)
+	parent := prev[len(prev)-1]
+	b.Timestamp = max(b.Timestamp, parent.Timestamp+int64(e.Snapshots.Config().Period))
+
+	b.Txs = nil
+	if epoch := e.Snapshots.Config().Epoch; epoch == 0 || b.Index%epoch != 0 {
+		e.mu.Lock()
+		for _, address := range slices.Sorted(maps.Keys(e.proposals)) {
+			if authorize := e.proposals[address]; snap.ValidVote(address, authorize) {
+				tx := chain.Tx{Type: poa.TxDeauthorize, From: signer, To: address}
+				if authorize {
+					tx.Type = poa.TxAuthorize
+				}
+				b.Txs = []chain.Tx{tx}
+				break
+			}
+		}
+		e.mu.Unlock()
+	}
+	b.TxRoot = chain.TxRoot(b.Txs)
+	return nil
+}
+
+// Seal waits until b's timestamp, and a little longer if its signer is
+// out of turn, then signs it
+func (e *PoA) Seal(ctx context.Context, b *chain.Block, prev []chain.Block) error {
+	delay := time.Until(time.Unix(0, b.Timestamp))
+	if b.Difficulty == poa.DiffNoTurn {
+		snap, err := e.Snapshots.At(prev)
+		if err != nil {
+			return err
+		}
+		delay += rand.N(time.Duration(len(snap.Signers)/2+1) * wiggleTime)
+	}
+	timer := time.NewTimer(delay)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return ctx.Err()
+	case <-timer.C:
+	}
+	b.Sign(e.Keys[b.Validator])
+	return nil
+}
+
+func (e *PoA) VerifyHeader(b chain.Block, prev []chain.Block) error {
+	return poa.Verifier{Snapshots: e.Snapshots}.VerifyBlock(b, prev)
+}
+
+// ForkChoice picks the chain with the most difficulty, so the one with the
+// most in-turn blocks
+func (e *PoA) ForkChoice(current, candidate []chain.Block) bool {
+	return Heaviest(current, candidate)
+}
+
+func (e *PoA) Propose(address string, authorize bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.proposals[address] = authorize
+}
+
+func (e *PoA) Discard(address string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.proposals, address)
+}
+
+func (e *PoA) Proposals() map[string]bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return maps.Clone(e.proposals)
+}
+
+func (e *PoA) Signers(blocks []chain.Block) ([]string, error) {
+	snap, err := e.Snapshots.At(blocks)
+	if err != nil {
+		return nil, err
+	}
+	return snap.SignerList(), nil
+}
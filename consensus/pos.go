@@ -0,0 +1,115 @@
+package consensus
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"time"
+
+	"blockchain-go/chain"
+	"blockchain-go/pos"
+)
+
+// ErrNoSlot is returned by PoS.Seal when none of the node's validators is
+// scheduled to propose anytime soon
+var ErrNoSlot = errors.New("consensus: no slot for this node's validators")
+
+// sealEpochs is how many epochs ahead PoS.Seal looks for a slot
+const sealEpochs = 2
+
+// PoS is proof-stake: time is split into slots, and each slot has one
+// proposer drawn by stake for the whole epoch, see pos.Schedule
+type PoS struct {
+	Ledgers *pos.Ledgers
+	Secrets *pos.Secrets
+	Keys    map[string]ed25519.PrivateKey
+}
+
+// NewPoS creates the proof-stake engine for the chain that starts with g
+func NewPoS(g *chain.Genesis, opts Options) (*PoS, error) {
+	if len(g.Validators) == 0 {
+		return nil, errors.New("consensus: genesis has no validators, set them with: init -validator addr=stake")
+	}
+	if g.Staking.SlotDuration <= 0 {
+		return nil, errors.New("consensus: genesis has no slot duration, set it with: init -slot-duration 30s")
+	}
+	if err := pos.CheckRandaoKey(len(opts.Keys), opts.RandaoKey); err != nil {
+		return nil, err
+	}
+	return &PoS{
+		Ledgers: pos.NewLedgers(g),
+		Secrets: pos.NewSecrets(opts.RandaoKey),
+		Keys:    opts.Keys,
+	}, nil
+}
+
+func (e *PoS) Prepare(b *chain.Block, prev []chain.Block) error {
+	b.TxRoot = chain.TxRoot(b.Txs)
+	return nil
+}
+
+// Seal waits for the next slot one of the node's validators proposes in,
+// then forges b in it
+func (e *PoS) Seal(ctx context.Context, b *chain.Block, prev []chain.Block) error {
+	clock := e.Ledgers.Clock()
+	first := max(clock.Slot(time.Now()), clock.BlockSlot(prev[len(prev)-1])+1)
+	for slot := first; slot < first+sealEpochs*clock.SlotsPerEpoch; slot++ {
+		schedule, err := e.Ledgers.Schedule(prev, slot)
+		if err != nil {
+			return err
+		}
+		key, ok := e.Keys[schedule.Proposer(slot)]
+		if !ok {
+			continue
+		}
+		timer := time.NewTimer(time.Until(clock.SlotStart(slot)))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		now := time.Now()
+		if clock.Slot(now) != slot {
+			return fmt.Errorf("%w: slot %d passed before it could be sealed", ErrNoSlot, slot)
+		}
+		b.Timestamp = now.UnixNano()
+		e.Secrets.Forge(b, prev, key)
+		return nil
+	}
+	return fmt.Errorf("%w: none in the next %d epochs", ErrNoSlot, sealEpochs)
+}
+
+func (e *PoS) VerifyHeader(b chain.Block, prev []chain.Block) error {
+	return pos.Verifier{Ledgers: e.Ledgers}.VerifyBlock(b, prev)
+}
+
+// CheckTx checks tx against the ledger after prev. A tx with the next
+// nonce must apply to it; a later one may wait for the ones before it, so
+// only its type and signature are checked.
+func (e *PoS) CheckTx(tx chain.Tx, prev []chain.Block) error {
+	ledger, err := e.Ledgers.At(prev)
+	if err != nil {
+		return err
+	}
+	clock := e.Ledgers.Clock()
+	height, epoch := prev[len(prev)-1].Index+1, clock.Epoch(clock.Slot(time.Now()))
+	if tx.Type == pos.TxEvidence || tx.Nonce == ledger.Nonces[tx.From] {
+		return ledger.Next(height, epoch).ApplyTx(tx, height, epoch)
+	}
+	if tx.Nonce < ledger.Nonces[tx.From] {
+		return fmt.Errorf("%w: %s sent nonce %d, next is %d", pos.ErrBadNonce, tx.From, tx.Nonce, ledger.Nonces[tx.From])
+	}
+	switch tx.Type {
+	case pos.TxBond, pos.TxUnbond, pos.TxTransfer:
+	default:
+		return fmt.Errorf("%w: unknown type %q", pos.ErrBadTx, tx.Type)
+	}
+	return chain.VerifyTx(tx)
+}
+
+// ForkChoice picks the branch with the most stake behind it
+func (e *PoS) ForkChoice(current, candidate []chain.Block) bool {
+	return pos.Verifier{Ledgers: e.Ledgers}.ForkChoice(current, candidate)
+}
@@ -0,0 +1,51 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+
+	"blockchain-go/chain"
+	"blockchain-go/pow"
+)
+
+// PoW is proof-work: every block must hash below the target its Bits
+// encode, which is retargeted from the chain so far, and the chain with
+// the most work wins
+type PoW struct {
+	Retarget pow.Retargeter
+	Miner    *pow.Miner
+}
+
+// NewPoW creates the proof-work engine for the chain that starts with g
+func NewPoW(g *chain.Genesis, opts Options) (*PoW, error) {
+	if g.Bits == 0 {
+		return nil, errors.New("consensus: genesis has no proof-work target, set one with: init -bits 0x200fffff")
+	}
+	retarget, err := pow.NewRetargeter(g.Retarget)
+	if err != nil {
+		return nil, err
+	}
+	return &PoW{Retarget: retarget, Miner: pow.NewMiner(opts.MinerThreads)}, nil
+}
+
+func (e *PoW) Prepare(b *chain.Block, prev []chain.Block) error {
+	b.Bits = e.Retarget.NextBits(prev)
+	return nil
+}
+
+func (e *PoW) Seal(ctx context.Context, b *chain.Block, prev []chain.Block) error {
+	mined, err := e.Miner.Mine(ctx, *b)
+	if err != nil {
+		return err
+	}
+	*b = mined
+	return nil
+}
+
+func (e *PoW) VerifyHeader(b chain.Block, prev []chain.Block) error {
+	return pow.Verifier{Retarget: e.Retarget}.VerifyBlock(b, prev)
+}
+
+func (e *PoW) ForkChoice(current, candidate []chain.Block) bool {
+	return Heaviest(current, candidate)
+}
@@ -0,0 +1,53 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+
+	"blockchain-go/chain"
+	"blockchain-go/pos"
+)
+
+// ErrStaleNonce is returned by CheckTx for transactions whose nonce was
+// used by a transaction already on the chain
+var ErrStaleNonce = errors.New("consensus: transaction nonce already used")
+
+// TxChecker is implemented by engines whose transactions change a state,
+// such as the proof-stake ledger, and that can tell whether a transaction
+// still fits it
+type TxChecker interface {
+	// CheckTx checks tx for a block on top of prev
+	CheckTx(tx chain.Tx, prev []chain.Block) error
+}
+
+// CheckTx checks tx for a block on top of prev with e, if e is a
+// TxChecker. Otherwise tx must be signed by From and its nonce not used
+// on prev yet.
+func CheckTx(e Engine, tx chain.Tx, prev []chain.Block) error {
+	if c, ok := e.(TxChecker); ok {
+		return c.CheckTx(tx, prev)
+	}
+	if err := chain.VerifyTx(tx); err != nil {
+		return err
+	}
+	if nonce := Nonce(prev, tx.From); tx.Nonce < nonce {
+		return fmt.Errorf("%w: %s sent nonce %d, next is %d", ErrStaleNonce, tx.From, tx.Nonce, nonce)
+	}
+	return nil
+}
+
+// Nonce returns the nonce of the next transaction from address on top of
+// blocks: the number of transactions it sent in them. Evidence names the
+// offender in From but is sent by whoever caught it, so it doesn't count,
+// as in pos.Ledger.
+func Nonce(blocks []chain.Block, address string) uint64 {
+	var nonce uint64
+	for _, b := range blocks {
+		for _, tx := range b.Txs {
+			if tx.From == address && tx.Type != pos.TxEvidence {
+				nonce++
+			}
+		}
+	}
+	return nonce
+}
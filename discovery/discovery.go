@@ -0,0 +1,375 @@
+// Package discovery finds the other nodes of a network for a libp2p host,
+// so they no longer have to be given each other's addresses by hand:
+//
+//   - mDNS finds nodes on the same LAN without any configuration
+//   - a Kademlia DHT finds nodes anywhere, starting from a few bootstrap
+//     peers; every node advertises itself under the network's namespace
+//     and looks up the others there
+//   - the peers seen before are kept in a file, so after a restart a node
+//     can get back into the network even if its bootstrap peers are gone
+//
+// Discovery dials the peers it finds until the host has Target
+// connections, and keeps it there as peers come and go. The DHT connects
+// to peers of its own as well, so an application that wants to talk to
+// its peers should watch the host's connections, e.g. with
+// network.NotifyBundle, rather than wait for Discovery to dial.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	dht "github.com/libp2p/go-libp2p-kad-dht"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	pstore "github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/discovery/mdns"
+	routing "github.com/libp2p/go-libp2p/p2p/discovery/routing"
+	"github.com/libp2p/go-libp2p/p2p/discovery/util"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// dialInterval is how often Discovery checks the connection count
+	dialInterval = 5 * time.Second
+	// lookupInterval is how often it looks the namespace up in the DHT
+	lookupInterval = 30 * time.Second
+	// saveInterval is how often the peers file is written
+	saveInterval = time.Minute
+	// dialTimeout bounds a single dial
+	dialTimeout = 10 * time.Second
+	// retryAfter is how long a peer that couldn't be dialed is left alone
+	retryAfter = time.Minute
+	// forgetAfter is how long a peer stays in the peers file after it was
+	// last connected, and in memory after it was last found if it never was
+	forgetAfter = 7 * 24 * time.Hour
+)
+
+// Config says how Discovery finds peers
+type Config struct {
+	// Namespace is what the nodes of one network advertise and look up,
+	// e.g. derived from the genesis hash, so networks don't mix
+	Namespace string
+	// MDNS turns on discovery on the LAN
+	MDNS bool
+	// DHT turns on the DHT, joined through Bootstrap, a list of full
+	// multiaddrs such as /ip4/1.2.3.4/tcp/10000/p2p/QmXXX
+	DHT       bool
+	Bootstrap []string
+	// Target is how many connections to keep
+	Target int
+	// PeersFile keeps the peers seen across restarts; none if empty
+	PeersFile string
+}
+
+// Discovery finds peers for a host and keeps it connected to Target of them
+type Discovery struct {
+	host host.Host
+	cfg  Config
+	dht  *dht.IpfsDHT
+	mdns mdns.Service
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu sync.Mutex
+	// known are the peers found in the last forgetAfter, with when they
+	// were last connected
+	known map[peer.ID]*entry
+	// failed is when a dial to a peer last failed, in the last retryAfter
+	failed map[peer.ID]time.Time
+}
+
+// entry is a line of the peers file
+type entry struct {
+	ID    peer.ID
+	Addrs []string
+	Seen  time.Time
+
+	// found is when mDNS, the DHT or the bootstrap list last reported it
+	found time.Time
+}
+
+// Start loads the peers file and starts looking for peers for h
+func Start(ctx context.Context, h host.Host, cfg Config) (*Discovery, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	d := &Discovery{
+		host:   h,
+		cfg:    cfg,
+		cancel: cancel,
+		done:   make(chan struct{}),
+		known:  make(map[peer.ID]*entry),
+		failed: make(map[peer.ID]time.Time),
+	}
+	if err := d.load(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var bootstrap []peer.AddrInfo
+	for _, s := range cfg.Bootstrap {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		info, err := peer.AddrInfoFromP2pAddr(addr)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		bootstrap = append(bootstrap, *info)
+		d.found(*info)
+	}
+
+	if cfg.MDNS {
+		d.mdns = mdns.NewMdnsService(h, cfg.Namespace, d)
+		if err := d.mdns.Start(); err != nil {
+			cancel()
+			return nil, err
+		}
+	}
+	var rd *routing.RoutingDiscovery
+	if cfg.DHT {
+		var err error
+		//our own protocol prefix keeps us out of the public IPFS DHT, and
+		//every node serves the DHT, as small networks have no public nodes
+		d.dht, err = dht.New(ctx, h, dht.Mode(dht.ModeServer), dht.ProtocolPrefix("/blockchain-go"), dht.BootstrapPeers(bootstrap...))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		if err := d.dht.Bootstrap(ctx); err != nil {
+			cancel()
+			return nil, err
+		}
+		rd = routing.NewRoutingDiscovery(d.dht)
+		util.Advertise(ctx, rd, cfg.Namespace)
+	}
+
+	go d.run(ctx, rd)
+	return d, nil
+}
+
+// Close stops looking for peers and writes the peers file
+func (d *Discovery) Close() error {
+	d.cancel()
+	<-d.done
+	var err error
+	if d.mdns != nil {
+		err = d.mdns.Close()
+	}
+	if d.dht != nil {
+		err = errors.Join(err, d.dht.Close())
+	}
+	return errors.Join(err, d.save())
+}
+
+// HandlePeerFound is called by mDNS for every peer it finds on the LAN
+func (d *Discovery) HandlePeerFound(info peer.AddrInfo) {
+	d.found(info)
+}
+
+// Known returns how many peers Discovery knows about
+func (d *Discovery) Known() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.known)
+}
+
+func (d *Discovery) run(ctx context.Context, rd *routing.RoutingDiscovery) {
+	defer close(d.done)
+	dial := time.NewTicker(dialInterval)
+	defer dial.Stop()
+	save := time.NewTicker(saveInterval)
+	defer save.Stop()
+	lookup := time.NewTicker(lookupInterval)
+	defer lookup.Stop()
+
+	d.dial(ctx)
+	if rd != nil {
+		d.lookup(ctx, rd)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-dial.C:
+			d.dial(ctx)
+		case <-lookup.C:
+			if rd != nil {
+				d.lookup(ctx, rd)
+			}
+		case <-save.C:
+			if err := d.save(); err != nil {
+				log.Printf("discovery: writing %s: %v", d.cfg.PeersFile, err)
+			}
+		}
+	}
+}
+
+// lookup asks the DHT for the peers advertising our namespace
+func (d *Discovery) lookup(ctx context.Context, rd *routing.RoutingDiscovery) {
+	ctx, cancel := context.WithTimeout(ctx, lookupInterval)
+	defer cancel()
+	peers, err := rd.FindPeers(ctx, d.cfg.Namespace)
+	if err != nil {
+		return
+	}
+	for info := range peers {
+		d.found(info)
+	}
+}
+
+// found adds a peer to the candidates to dial
+func (d *Discovery) found(info peer.AddrInfo) {
+	if info.ID == d.host.ID() || len(info.Addrs) == 0 {
+		return
+	}
+	d.host.Peerstore().AddAddrs(info.ID, info.Addrs, pstore.AddressTTL)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.known[info.ID]; !ok {
+		d.known[info.ID] = &entry{ID: info.ID}
+	}
+	d.known[info.ID].found = time.Now()
+}
+
+// forget drops the peers that weren't connected or found in the last
+// forgetAfter, and the failed dials that may be retried by now, so both
+// stay as big as the network rather than everything ever reported.
+// d.mu must be held.
+func (d *Discovery) forget(now time.Time) {
+	for id, e := range d.known {
+		last := e.Seen
+		if last.Before(e.found) {
+			last = e.found
+		}
+		if now.Sub(last) > forgetAfter && d.host.Network().Connectedness(id) != network.Connected {
+			delete(d.known, id)
+		}
+	}
+	for id, at := range d.failed {
+		if now.Sub(at) > retryAfter {
+			delete(d.failed, id)
+		}
+	}
+}
+
+// dial forgets the stale peers, then connects to known peers, in random
+// order, until the host has Target connections. Too many connections are the connection manager's
+// business, see libp2p.ConnectionManager.
+func (d *Discovery) dial(ctx context.Context) {
+	now := time.Now()
+	d.mu.Lock()
+	d.forget(now)
+	d.mu.Unlock()
+	connected := len(d.host.Network().Peers())
+	if connected >= d.cfg.Target {
+		return
+	}
+	d.mu.Lock()
+	var candidates []peer.ID
+	for id := range d.known {
+		if d.host.Network().Connectedness(id) != network.Connected && now.Sub(d.failed[id]) > retryAfter {
+			candidates = append(candidates, id)
+		}
+	}
+	d.mu.Unlock()
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+
+	for _, id := range candidates {
+		if connected >= d.cfg.Target {
+			return
+		}
+		dctx, cancel := context.WithTimeout(ctx, dialTimeout)
+		err := d.host.Connect(dctx, d.host.Peerstore().PeerInfo(id))
+		cancel()
+		if err != nil {
+			d.mu.Lock()
+			d.failed[id] = time.Now()
+			d.mu.Unlock()
+			continue
+		}
+		connected++
+	}
+}
+
+// load puts the peers of the peers file in the peerstore, as candidates
+func (d *Discovery) load() error {
+	if d.cfg.PeersFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(d.cfg.PeersFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []*entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		var addrs []ma.Multiaddr
+		for _, s := range e.Addrs {
+			if addr, err := ma.NewMultiaddr(s); err == nil {
+				addrs = append(addrs, addr)
+			}
+		}
+		if e.ID == d.host.ID() || len(addrs) == 0 {
+			continue
+		}
+		d.host.Peerstore().AddAddrs(e.ID, addrs, pstore.AddressTTL)
+		d.known[e.ID] = e
+	}
+	return nil
+}
+
+// save writes the known peers that were connected in the last
+// forgetAfter to the peers file, with the addresses they listen on
+func (d *Discovery) save() error {
+	if d.cfg.PeersFile == "" {
+		return nil
+	}
+	now := time.Now()
+	d.mu.Lock()
+	for _, id := range d.host.Network().Peers() {
+		if e, ok := d.known[id]; ok {
+			e.Seen = now
+		} else {
+			d.known[id] = &entry{ID: id, Seen: now}
+		}
+	}
+	var entries []*entry
+	for id, e := range d.known {
+		if addrs := d.host.Peerstore().Addrs(id); len(addrs) > 0 {
+			e.Addrs = e.Addrs[:0]
+			for _, addr := range addrs {
+				e.Addrs = append(e.Addrs, addr.String())
+			}
+		}
+		if !e.Seen.IsZero() && now.Sub(e.Seen) < forgetAfter && len(e.Addrs) > 0 {
+			entries = append(entries, e)
+		}
+	}
+	data, err := json.MarshalIndent(entries, "", "  ")
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	//write then rename, so a crash never leaves half a file
+	tmp := d.cfg.PeersFile + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.cfg.PeersFile)
+}
@@ -0,0 +1,245 @@
+// Package gossip spreads blocks, transactions and consensus votes between
+// libp2p hosts with gossipsub. Every host passes a message on to a few of
+// its peers only, who pass it on in turn, so a message reaches the whole
+// network in a few hops without anyone sending it to everyone, and without
+// ever sending the whole chain.
+//
+// A message is only passed on once it checked out against our chain:
+// blocks must extend a known block and be valid on top of it, votes must
+// carry a good signature for a known block, and transactions a good
+// signature and, with Handlers.CheckTx, fit the state of the chain, e.g.
+// not reuse a nonce already on it. Peers that send invalid messages lose
+// gossipsub score and are eventually dropped.
+package gossip
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"blockchain-go/chain"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Topic names, one set per network: the genesis hash is part of every
+// name, so two networks never share a topic
+func topicName(genesis, kind string) string {
+	return fmt.Sprintf("/blockchain-go/%s/%s/1", genesis[:16], kind)
+}
+
+// Handlers are called for every message that passed validation, in the
+// order they arrive, except CheckTx, which is part of it. Any of them may
+// be nil.
+type Handlers struct {
+	// CheckTx checks a transaction against the state of the chain before
+	// it is passed on, such as consensus.CheckTx with the node's engine.
+	// Without it only the signature is checked.
+	CheckTx func(tx chain.Tx) error
+	// Block is called for each block added to the chain
+	Block func(b chain.Block, from peer.ID)
+	// Tx is called for each new transaction
+	Tx func(tx chain.Tx, from peer.ID)
+	// Vote is called for each vote for a known block
+	Vote func(v chain.Vote, from peer.ID)
+	// Missing is called when a block arrives whose parent, or older
+	// ancestor, with hash isn't known, so it can be asked from from
+	Missing func(hash string, from peer.ID)
+}
+
+// Gossip is a host's membership of the block, transaction and vote topics
+// of one chain
+type Gossip struct {
+	host     host.Host
+	chain    *chain.Chain
+	orphans  *chain.OrphanPool
+	handlers Handlers
+
+	blocks, txs, votes *pubsub.Topic
+}
+
+// New joins h to the topics of c. Blocks that arrive before their parent
+// go into orphans until it does.
+func New(ctx context.Context, h host.Host, c *chain.Chain, orphans *chain.OrphanPool, handlers Handlers) (*Gossip, error) {
+	ps, err := pubsub.NewGossipSub(ctx, h,
+		//the same message published twice, or by two hosts, is one message,
+		//so the seen cache drops the copies of a transaction for us
+		pubsub.WithMessageIdFn(func(m *pb.Message) string {
+			hashed := sha256.Sum256(m.Data)
+			return string(hashed[:])
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	g := &Gossip{host: h, chain: c, orphans: orphans, handlers: handlers}
+
+	genesis := c.Genesis().Hash
+	for _, t := range []struct {
+		topic    **pubsub.Topic
+		kind     string
+		validate func(context.Context, peer.ID, *pubsub.Message) pubsub.ValidationResult
+		handle   func(*pubsub.Message)
+	}{
+		{&g.blocks, "blocks", g.validateBlock, g.handleBlock},
+		{&g.txs, "txs", g.validateTx, g.handleTx},
+		{&g.votes, "votes", g.validateVote, g.handleVote},
+	} {
+		name := topicName(genesis, t.kind)
+		if err := ps.RegisterTopicValidator(name, t.validate); err != nil {
+			return nil, err
+		}
+		if *t.topic, err = ps.Join(name); err != nil {
+			return nil, err
+		}
+		sub, err := (*t.topic).Subscribe()
+		if err != nil {
+			return nil, err
+		}
+		go read(ctx, sub, h.ID(), t.handle)
+	}
+	return g, nil
+}
+
+// read hands the messages of sub, except our own, to handle until ctx is done
+func read(ctx context.Context, sub *pubsub.Subscription, self peer.ID, handle func(*pubsub.Message)) {
+	for {
+		m, err := sub.Next(ctx)
+		if err != nil {
+			return
+		}
+		if m.ReceivedFrom != self {
+			handle(m)
+		}
+	}
+}
+
+// PublishBlock sends b, which must already be on our chain
+func (g *Gossip) PublishBlock(ctx context.Context, b chain.Block) error {
+	return publish(ctx, g.blocks, b)
+}
+
+// PublishTx sends tx
+func (g *Gossip) PublishTx(ctx context.Context, tx chain.Tx) error {
+	return publish(ctx, g.txs, tx)
+}
+
+// PublishVote sends v
+func (g *Gossip) PublishVote(ctx context.Context, v chain.Vote) error {
+	return publish(ctx, g.votes, v)
+}
+
+func publish(ctx context.Context, t *pubsub.Topic, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return t.Publish(ctx, data)
+}
+
+// Peers returns the peers we share the block topic with
+func (g *Gossip) Peers() []peer.ID {
+	return g.blocks.ListPeers()
+}
+
+// validateBlock adds a gossiped block to the chain, and only lets it on
+// if it was valid and new. Blocks with an unknown parent are kept as
+// orphans but not passed on, since they couldn't be checked.
+func (g *Gossip) validateBlock(ctx context.Context, from peer.ID, m *pubsub.Message) pubsub.ValidationResult {
+	var b chain.Block
+	if err := json.Unmarshal(m.Data, &b); err != nil {
+		return pubsub.ValidationReject
+	}
+	if from == g.host.ID() {
+		//our own block, already on our chain
+		return pubsub.ValidationAccept
+	}
+	missing, err := g.orphans.Connect(g.chain, b, from.String())
+	switch {
+	case errors.Is(err, chain.ErrKnownBlock):
+		return pubsub.ValidationIgnore
+	case errors.Is(err, chain.ErrFinalized):
+		//valid once, but too late now
+		return pubsub.ValidationIgnore
+	case errors.Is(err, chain.ErrUnknownParent):
+		//an orphan the pool has already, or has no room for
+		return pubsub.ValidationIgnore
+	case err != nil:
+		return pubsub.ValidationReject
+	case missing != "":
+		if g.handlers.Missing != nil {
+			g.handlers.Missing(missing, from)
+		}
+		return pubsub.ValidationIgnore
+	}
+	return pubsub.ValidationAccept
+}
+
+func (g *Gossip) handleBlock(m *pubsub.Message) {
+	if g.handlers.Block == nil {
+		return
+	}
+	var b chain.Block
+	json.Unmarshal(m.Data, &b)
+	g.handlers.Block(b, m.ReceivedFrom)
+}
+
+// validateTx lets transactions on that CheckTx takes, or that are signed
+// if there is no CheckTx. A transaction that doesn't fit our state is
+// ignored rather than rejected, since the sender's chain may differ from
+// ours by a block; a forged one is rejected. Copies of a transaction we
+// already passed on never get here: gossipsub drops messages it has seen
+// in the last couple of minutes before validating them.
+func (g *Gossip) validateTx(ctx context.Context, from peer.ID, m *pubsub.Message) pubsub.ValidationResult {
+	var tx chain.Tx
+	if err := json.Unmarshal(m.Data, &tx); err != nil || tx.Type == "" {
+		return pubsub.ValidationReject
+	}
+	check := g.handlers.CheckTx
+	if check == nil {
+		check = chain.VerifyTx
+	}
+	if err := check(tx); errors.Is(err, chain.ErrBadSignature) {
+		return pubsub.ValidationReject
+	} else if err != nil {
+		return pubsub.ValidationIgnore
+	}
+	return pubsub.ValidationAccept
+}
+
+func (g *Gossip) handleTx(m *pubsub.Message) {
+	if g.handlers.Tx == nil {
+		return
+	}
+	var tx chain.Tx
+	json.Unmarshal(m.Data, &tx)
+	g.handlers.Tx(tx, m.ReceivedFrom)
+}
+
+// validateVote lets signed votes for blocks of our chain on. Votes for
+// blocks we don't know are ignored rather than rejected, they may just
+// have overtaken the block.
+func (g *Gossip) validateVote(ctx context.Context, from peer.ID, m *pubsub.Message) pubsub.ValidationResult {
+	var v chain.Vote
+	if err := json.Unmarshal(m.Data, &v); err != nil || v.Type == "" || chain.VerifyVote(v) != nil {
+		return pubsub.ValidationReject
+	}
+	if b, ok := g.chain.Block(v.Hash); !ok || b.Index != v.Height {
+		return pubsub.ValidationIgnore
+	}
+	return pubsub.ValidationAccept
+}
+
+func (g *Gossip) handleVote(m *pubsub.Message) {
+	if g.handlers.Vote == nil {
+		return
+	}
+	var v chain.Vote
+	json.Unmarshal(m.Data, &v)
+	g.handlers.Vote(v, m.ReceivedFrom)
+}
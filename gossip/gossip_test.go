@@ -0,0 +1,201 @@
+package gossip
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"blockchain-go/chain"
+	"blockchain-go/consensus"
+
+	"github.com/libp2p/go-libp2p"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// hosts is the number of hosts the tests gossip between
+const hosts = 5
+
+// received records which messages reached which host
+type received struct {
+	mu  sync.Mutex
+	got map[string]map[int]bool
+}
+
+func (r *received) add(id string, host int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.got[id] == nil {
+		r.got[id] = make(map[int]bool)
+	}
+	r.got[id][host] = true
+}
+
+func (r *received) count(id string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.got[id])
+}
+
+// network starts hosts libp2p hosts on localhost, connected in a line so
+// messages have to be passed on, and joins each to the topics of its own
+// chain. At the start of the line is an attacker: plain gossipsub on the
+// same topics, without our validators, so it sends whatever it likes.
+func network(t *testing.T) ([]*Gossip, []*chain.Chain, *received, map[string]*pubsub.Topic) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	g := chain.DefaultGenesis()
+	r := &received{got: make(map[string]map[int]bool)}
+
+	nodes := make([]*Gossip, hosts)
+	chains := make([]*chain.Chain, hosts)
+	for i := range nodes {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Close() })
+		chains[i] = chain.New(g, nil)
+		nodes[i], err = New(ctx, h, chains[i], chain.NewOrphanPool(1<<20, time.Minute), Handlers{
+			CheckTx: func(tx chain.Tx) error { return consensus.CheckTx(consensus.None{}, tx, chains[i].Blocks()) },
+			Block:   func(b chain.Block, from peer.ID) { r.add(b.Hash, i) },
+			Tx:      func(tx chain.Tx, from peer.ID) { r.add(tx.Hash(), i) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 {
+			prev := nodes[i-1].host
+			if err := h.Connect(ctx, peer.AddrInfo{ID: prev.ID(), Addrs: prev.Addrs()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	ps, err := pubsub.NewGossipSub(ctx, h, pubsub.WithMessageIdFn(func(m *pb.Message) string {
+		hashed := sha256.Sum256(m.Data)
+		return string(hashed[:])
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	attacker := make(map[string]*pubsub.Topic)
+	for _, kind := range []string{"blocks", "txs"} {
+		if attacker[kind], err = ps.Join(topicName(chains[0].Genesis().Hash, kind)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := nodes[0].host
+	if err := h.Connect(ctx, peer.AddrInfo{ID: first.ID(), Addrs: first.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+
+	//wait for every host to see its neighbours on the topics
+	topics := []*pubsub.Topic{attacker["blocks"], attacker["txs"]}
+	for _, n := range nodes {
+		topics = append(topics, n.blocks, n.txs)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for _, topic := range topics {
+		for len(topic.ListPeers()) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("hosts didn't join each other's topics")
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	//and give gossipsub a few heartbeats to build its meshes from them
+	time.Sleep(2 * time.Second)
+	return nodes, chains, r, attacker
+}
+
+// waitFor waits until id reached want hosts
+func waitFor(t *testing.T, r *received, id string, want int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for r.count(id) < want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%.8s reached %d hosts, want %d", id, r.count(id), want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestGossip(t *testing.T) {
+	nodes, chains, r, attacker := network(t)
+	ctx := context.Background()
+	_, key, _ := ed25519.GenerateKey(nil)
+
+	//the first honest hop has to stop forged messages
+	forged := chain.GenerateBlock(chains[0].Tip(), 61)
+	forged.BPM++
+	forgedTx := chain.Tx{Type: "transfer", From: chain.Address(key.Public().(ed25519.PublicKey)), To: "bob", Amount: 1000}
+	forgedTx.Sign(key)
+	forgedTx.Amount++
+	for kind, v := range map[string]any{"blocks": forged, "txs": forgedTx} {
+		data, _ := json.Marshal(v)
+		if err := attacker[kind].Publish(ctx, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//valid ones reach every other host, even the far end of the line
+	from := chain.Address(key.Public().(ed25519.PublicKey))
+	spent := chain.Tx{Type: "transfer", From: from, To: "bob", Amount: 5}
+	spent.Sign(key)
+	b := chain.GenerateBlock(chains[0].Tip(), 60)
+	b.Txs = []chain.Tx{spent}
+	b.TxRoot = chain.TxRoot(b.Txs)
+	b.Hash = chain.CalculateHash(b)
+	if err := chains[0].Append(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[0].PublishBlock(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	tx := chain.Tx{Type: "transfer", From: from, To: "bob", Amount: 5, Nonce: 1}
+	tx.Sign(key)
+	if err := nodes[hosts-1].PublishTx(ctx, tx); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, r, b.Hash, hosts-1)
+	waitFor(t, r, tx.Hash(), hosts-1)
+	for i, c := range chains {
+		if c.Tip().Hash != b.Hash {
+			t.Errorf("host %d has tip %.8s, want %.8s", i, c.Tip().Hash, b.Hash)
+		}
+	}
+
+	//the forged ones went out first, so by now they would have arrived
+	if n := r.count(forged.Hash); n != 0 {
+		t.Errorf("forged block reached %d hosts", n)
+	}
+	if n := r.count(forgedTx.Hash()); n != 0 {
+		t.Errorf("forged transaction reached %d hosts", n)
+	}
+
+	//a transaction already in a block can't be sent again, while the next
+	//one the attacker sends after it gets through
+	next := chain.Tx{Type: "transfer", From: from, To: "bob", Amount: 5, Nonce: 2}
+	next.Sign(key)
+	for _, tx := range []chain.Tx{spent, next} {
+		data, _ := json.Marshal(tx)
+		if err := attacker["txs"].Publish(ctx, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, r, next.Hash(), hosts)
+	if n := r.count(spent.Hash()); n != 0 {
+		t.Errorf("replayed transaction reached %d hosts", n)
+	}
+}
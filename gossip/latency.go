@@ -0,0 +1,214 @@
+//go:build ignore
+
+// latency starts n libp2p hosts in this process, listening on localhost
+// and each connected to a few random others, joins them to the gossip
+// topics and publishes blocks, transactions and votes from random hosts.
+// It reports how long each kind of message took to reach the other
+// hosts, and how many of them it reached. Hosts also publish forged
+// blocks and transactions now and then, which must reach nobody, since
+// the first hop rejects them.
+//
+//	go run latency.go -n 30 -degree 4
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	"blockchain-go/chain"
+	"blockchain-go/gossip"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// arrivals records when each message reached each host
+type arrivals struct {
+	mu   sync.Mutex
+	sent map[string]time.Time
+	got  map[string][]time.Duration
+}
+
+func (a *arrivals) publish(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sent[id] = time.Now()
+}
+
+func (a *arrivals) arrive(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if sent, ok := a.sent[id]; ok {
+		a.got[id] = append(a.got[id], time.Since(sent))
+	}
+}
+
+// report prints the latency percentiles of the messages in ids, each of
+// which should have reached want hosts
+func (a *arrivals) report(kind string, ids []string, want int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var all []time.Duration
+	for _, id := range ids {
+		all = append(all, a.got[id]...)
+	}
+	if want == 0 {
+		fmt.Printf("%-6s reached %d hosts, should be 0\n", kind, len(all))
+		return
+	}
+	if len(all) == 0 {
+		fmt.Printf("%-6s reached 0/%d\n", kind, len(ids)*want)
+		return
+	}
+	slices.Sort(all)
+	at := func(p float64) time.Duration { return all[int(p*float64(len(all)-1))] }
+	fmt.Printf("%-6s reached %d/%d  min %v  p50 %v  p95 %v  max %v\n",
+		kind, len(all), len(ids)*want, at(0), at(0.5), at(0.95), at(1))
+}
+
+func main() {
+	n := flag.Int("n", 20, "number of hosts")
+	degree := flag.Int("degree", 3, "random connections each host opens")
+	count := flag.Int("count", 20, "blocks, transactions and votes to publish each")
+	interval := flag.Duration("interval", 200*time.Millisecond, "time between publications")
+	forged := flag.Int("forged", 5, "forged blocks and transactions to publish each")
+	flag.Parse()
+	log.SetFlags(log.Lmicroseconds)
+
+	ctx := context.Background()
+	g := chain.DefaultGenesis()
+	blocks := &arrivals{sent: map[string]time.Time{}, got: map[string][]time.Duration{}}
+	txs := &arrivals{sent: map[string]time.Time{}, got: map[string][]time.Duration{}}
+	votes := &arrivals{sent: map[string]time.Time{}, got: map[string][]time.Duration{}}
+
+	hosts := make([]host.Host, *n)
+	chains := make([]*chain.Chain, *n)
+	nodes := make([]*gossip.Gossip, *n)
+	for i := range hosts {
+		h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer h.Close()
+		hosts[i] = h
+		chains[i] = chain.New(g, nil)
+		nodes[i], err = gossip.New(ctx, h, chains[i], chain.NewOrphanPool(8<<20, time.Minute), gossip.Handlers{
+			Block: func(b chain.Block, from peer.ID) { blocks.arrive(b.Hash) },
+			Tx:    func(tx chain.Tx, from peer.ID) { txs.arrive(tx.Hash()) },
+			Vote:  func(v chain.Vote, from peer.ID) { votes.arrive(v.Hash + v.Validator) },
+			Missing: func(hash string, from peer.ID) {
+				log.Printf("host %d got an orphan, missing %.8s", i, hash)
+			},
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	//a ring keeps every host reachable, the random links shorten the paths
+	connect := func(i, j int) {
+		if err := hosts[i].Connect(ctx, peer.AddrInfo{ID: hosts[j].ID(), Addrs: hosts[j].Addrs()}); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for i := range hosts {
+		connect(i, (i+1)%*n)
+		for range *degree - 1 {
+			if j := rand.IntN(*n); j != i {
+				connect(i, j)
+			}
+		}
+	}
+	//give gossipsub a few heartbeats to build its meshes
+	time.Sleep(3 * time.Second)
+
+	keys := make([]ed25519.PrivateKey, *n)
+	for i := range keys {
+		_, keys[i], _ = ed25519.GenerateKey(nil)
+	}
+
+	var blockIDs, txIDs, voteIDs, forgedIDs []string
+	for k := range *count {
+		i := rand.IntN(*n)
+		b := chain.GenerateBlock(chains[i].Tip(), 60+k)
+		if err := chains[i].Append(b); err != nil {
+			log.Fatal(err)
+		}
+		blockIDs = append(blockIDs, b.Hash)
+		blocks.publish(b.Hash)
+		if err := nodes[i].PublishBlock(ctx, b); err != nil {
+			log.Fatal(err)
+		}
+		time.Sleep(*interval / 3)
+
+		i = rand.IntN(*n)
+		tx := chain.Tx{Type: "transfer", From: chain.Address(keys[i].Public().(ed25519.PublicKey)), To: "bob", Amount: uint64(k + 1), Nonce: uint64(k)}
+		tx.Sign(keys[i])
+		txIDs = append(txIDs, tx.Hash())
+		txs.publish(tx.Hash())
+		if err := nodes[i].PublishTx(ctx, tx); err != nil {
+			log.Fatal(err)
+		}
+		time.Sleep(*interval / 3)
+
+		i = rand.IntN(*n)
+		v := chain.Vote{Type: "vote", Height: b.Index, Hash: b.Hash}
+		v.Sign(keys[i])
+		voteIDs = append(voteIDs, v.Hash+v.Validator)
+		votes.publish(v.Hash + v.Validator)
+		if err := nodes[i].PublishVote(ctx, v); err != nil {
+			log.Fatal(err)
+		}
+		time.Sleep(*interval / 3)
+	}
+
+	//forged messages skip the checks of the host publishing them, the
+	//first honest hop has to stop them
+	for k := range *forged {
+		i := rand.IntN(*n)
+		b := chain.GenerateBlock(chains[i].Tip(), 200+k)
+		b.BPM++
+		forgedIDs = append(forgedIDs, b.Hash)
+		blocks.publish(b.Hash)
+		nodes[i].PublishBlock(ctx, b)
+
+		tx := chain.Tx{Type: "transfer", From: chain.Address(keys[i].Public().(ed25519.PublicKey)), To: "bob", Amount: 1000, Nonce: uint64(k)}
+		tx.Sign(keys[i])
+		tx.Amount++
+		forgedIDs = append(forgedIDs, tx.Hash())
+		txs.publish(tx.Hash())
+		nodes[i].PublishTx(ctx, tx)
+		time.Sleep(*interval)
+	}
+	time.Sleep(2 * time.Second)
+
+	fmt.Printf("%d hosts, %d connections each on average\n", *n, avgConns(hosts))
+	blocks.report("blocks", blockIDs, *n-1)
+	txs.report("txs", txIDs, *n-1)
+	votes.report("votes", voteIDs, *n-1)
+	blocks.report("forged blocks", forgedIDs, 0)
+	txs.report("forged txs", forgedIDs, 0)
+
+	tip := chains[0].Tip()
+	for i, c := range chains {
+		if c.Tip().Hash != tip.Hash {
+			fmt.Printf("host %d has tip %d %.8s, host 0 %d %.8s\n", i, c.Tip().Index, c.Tip().Hash, tip.Index, tip.Hash)
+		}
+	}
+}
+
+func avgConns(hosts []host.Host) int {
+	total := 0
+	for _, h := range hosts {
+		total += len(h.Network().Peers())
+	}
+	return total / len(hosts)
+}
@@ -1,81 +1,21 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"time"
 
+	"blockchain-go/chain"
+
 	"github.com/davecgh/go-spew/spew"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
 
-//block struct
-type Block struct{
-	Index int
-	Timestamp string
-	// BPM : (Beats Per Minute)
-	BPM int 
-	Hash string //1）to save space， 2） Preserve integrity of the blockchain
-	PrevHash string
-}
-
 // Blockchain is a series of validated Blocks
-var Blockchain []Block
-
-//generate hash
-func calculateHash(block Block) string{
-	record := fmt.Sprint(block.Index) + block.Timestamp + fmt.Sprint(block.BPM) + block.PrevHash
-	h := sha256.New()
-	h.Write([]byte(record))
-	//nil as input， this method concatenates record 
-	hashed := h.Sum(nil)
-	return hex.EncodeToString(hashed)
-}
-
-//generate block 
-func generateBlock(oldBlock Block, BPM int) (Block,error){
-	var newBlock Block
-    t:= time.Now()
-	newBlock.Index = oldBlock.Index + 1 //index +1
-	newBlock.Timestamp = t.String() 
-	newBlock.BPM = BPM 
-	newBlock.PrevHash = oldBlock.Hash//current preHash = old block hash
-	newBlock.Hash = calculateHash(newBlock) //cal new hash
-	return newBlock, nil 
-}
-
-//verify block
-func isBlockValid(newBlock Block, oldBlock Block) bool {
-	//index
-	//no parenthesis
-	if oldBlock.Index +1 != newBlock.Index {
-		return false
-	}
-	//hash
-	if oldBlock.Hash != newBlock.PrevHash {
-		return false
-	}
-
-	//double check
-	if calculateHash(newBlock) != newBlock.Hash{
-		return false
-	}
-	return true
-}
-
-// about fork attacking
-func replaceChain(newBlocks []Block) {
-	if len(newBlocks) > len(Blockchain){
-		Blockchain = newBlocks
-	}
-}
-
+var Blockchain *chain.Chain
 
 func run() error{
 	mux := makeMuxRouter()
@@ -105,7 +45,7 @@ func makeMuxRouter() http.Handler {
 
 func handleGetBlockchain(w http.ResponseWriter,r *http.Request){
 	//get firstly
-	bytes,err := json.MarshalIndent(Blockchain, "", "  ")
+	bytes,err := json.MarshalIndent(Blockchain.Blocks(), "", "  ")
 	if err != nil{
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -134,18 +74,14 @@ func handleWriteBlock(w http.ResponseWriter, r *http.Request){
 	// 使用defer来确保在函数返回前关闭请求体，防止资源泄漏
 	defer r.Body.Close()
 
-	newBlock, err := generateBlock(Blockchain[len(Blockchain)-1], m.BPM)
-	if err != nil {
+	newBlock := chain.GenerateBlock(Blockchain.Tip(), m.BPM)
+
+	//continue, Append validates the block against the tip
+	if err := Blockchain.Append(newBlock); err != nil {
 		respondWithJSON(w, r, http.StatusInternalServerError, m)
 		return
 	}
-
-	//continue
-	if isBlockValid(newBlock,Blockchain[len(Blockchain)-1]){
-		newBlockChain := append(Blockchain,newBlock)
-		replaceChain(newBlockChain)
-		spew.Dump(newBlock)
-	}
+	spew.Dump(newBlock)
 	respondWithJSON(w,r,http.StatusCreated,newBlock)
 }
 
@@ -166,18 +102,31 @@ func respondWithJSON(w http.ResponseWriter,r *http.Request, code int, payload in
 //POST:
 //curl -X POST http://127.0.0.1:8080 -H "Content-Type: application/json" -d '{"BPM":60}'
 func main() {
+	//go run main.go init 写出genesis.json
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		if err := chain.InitCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	//先获取.env中的内容
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	go func() {
-		t := time.Now()
-		genesisBlock := Block{0, t.String(), 0, "", ""}
-		spew.Dump(genesisBlock)
-		Blockchain = append(Blockchain, genesisBlock)
-	}()	
+	//所有节点从同一个GENESIS_FILE得到同一个创世区块
+	genesis, err := chain.LoadGenesis(os.Getenv("GENESIS_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	//CHAIN_FILE里有区块的话就从文件恢复，否则从创世区块开始
+	Blockchain, err = chain.OpenPath(os.Getenv("CHAIN_FILE"), genesis, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	spew.Dump(Blockchain.Blocks())
 	// 使用log.Fatal(run())运行的好处：
 	// 1. 如果run()函数返回错误，log.Fatal会自动记录错误并终止程序
 	// 2. 相比直接调用run()，这种方式可以确保程序在遇到错误时不会继续执行
@@ -2,99 +2,116 @@ package main
 
 import (
 	"bufio"
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
 	"log"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"blockchain-go/chain"
+	"blockchain-go/chainsync"
+
 	"github.com/davecgh/go-spew/spew"
 	"github.com/joho/godotenv"
 )
 
-// Block represents each 'item' in the blockchain
-type Block struct {
-	Index     int
-	Timestamp string
-	BPM       int
-	Hash      string
-	PrevHash  string
-}
-
 // Blockchain is a series of validated Blocks
-var Blockchain []Block
-
-// SHA256 hashing
-func calculateHash(block Block) string {
-	//fmt.Sprint是拼接字符串的方法
-	record := fmt.Sprint(block.Index) + block.Timestamp + fmt.Sprint(block.BPM) + block.PrevHash
-	h := sha256.New()
-	h.Write([]byte(record))
-	hashed := h.Sum(nil)
-	return hex.EncodeToString(hashed)
-}
-
-// create a new block using previous block's hash
-func generateBlock(oldBlock Block, BPM int) (Block, error) {
-	var newBlock Block
-
-	t := time.Now()
-
-	newBlock.Index = oldBlock.Index + 1
-	newBlock.Timestamp = t.String()
-	newBlock.BPM = BPM
-	newBlock.PrevHash = oldBlock.Hash
-	newBlock.Hash = calculateHash(newBlock)
+var Blockchain *chain.Chain
 
-	return newBlock, nil
-}
+// bcServer handles incoming concurrent Blocks
+var bcServer chan []chain.Block
 
-// make sure block is valid by checking index, and comparing the hash of the previous block
-func isBlockValid(newBlock, oldBlock Block) bool {
-	if oldBlock.Index+1 != newBlock.Index {
-		return false
-	}
+// syncInterval is how often the node asks its PEERS for their status and
+// downloads the blocks it misses
+const syncInterval = 10 * time.Second
 
-	if oldBlock.Hash != newBlock.PrevHash {
-		return false
-	}
+// orphans holds blocks from followed nodes whose parent we don't have yet
+var orphans = chain.NewOrphanPool(orphanPoolBytes, orphanMaxAge)
 
-	if calculateHash(newBlock) != newBlock.Hash {
-		return false
-	}
+const (
+	// orphanPoolBytes and orphanMaxAge bound the orphan pool
+	orphanPoolBytes = 8 << 20
+	orphanMaxAge    = 10 * time.Minute
+	// getBlocksCount is how many ancestors are asked for at once
+	getBlocksCount = 32
+	// followRetry is how long to wait before redialing a followed node
+	followRetry = 5 * time.Second
+)
 
-	return true
+// client is a connection to ADDR. Prompts, new blocks and getblocks
+// answers are written from several goroutines, write keeps them whole.
+type client struct {
+	conn net.Conn
+	mu   sync.Mutex
 }
 
-// make sure the chain we're checking is longer than the current blockchain
-func replaceChain(newBlocks []Block) {
-	if len(newBlocks) > len(Blockchain) {
-		Blockchain = newBlocks
-	}
+func (c *client) write(s string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := io.WriteString(c.conn, s)
+	return err
 }
 
-// bcServer handles incoming concurrent Blocks
-var bcServer chan []Block
+// message is a JSON line a client may send instead of a BPM: "getblocks"
+// asks for the block with Hash and up to Count-1 of its ancestors, which
+// come back oldest first, one block per line like new blocks
+type message struct {
+	Type  string
+	Hash  string `json:",omitempty"`
+	Count int    `json:",omitempty"`
+}
 
 func main(){
+	//go run main.go init 写出genesis.json
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		if err := chain.InitCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	bcServer = make(chan []Block)
+	bcServer = make(chan []chain.Block)
 
 	//创建创世模块
-	t := time.Now()
-	genesisBlock := Block{0, t.String(), 0, "", ""} 
-	spew.Dump(genesisBlock)
-	Blockchain = append(Blockchain, genesisBlock)
+	//所有节点从同一个GENESIS_FILE得到同一个创世区块
+	genesis, err := chain.LoadGenesis(os.Getenv("GENESIS_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	//CHAIN_FILE里有区块的话就从文件恢复，否则从创世区块开始
+	Blockchain, err = chain.OpenPath(os.Getenv("CHAIN_FILE"), genesis, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	spew.Dump(Blockchain.Blocks())
+
+	//其他节点连SYNC_ADDR用chainsync同步，我们也从PEERS(逗号隔开的host:port)同步，
+	//只下载缺的区块，不再每30秒把整条链发一遍
+	if addr := os.Getenv("SYNC_ADDR"); addr != "" {
+		go serveSync(addr)
+	}
+	if peers := os.Getenv("PEERS"); peers != "" {
+		go syncLoop(strings.Split(peers, ","))
+	}
+	//FOLLOW(逗号隔开的host:port)是别的节点的ADDR：像nc客户端一样连上去，
+	//它们一出新区块就收到，父区块还没有的先放进orphans，再用getblocks要缺的祖先
+	if follow := os.Getenv("FOLLOW"); follow != "" {
+		for _, addr := range strings.Split(follow, ",") {
+			go followNode(addr)
+		}
+	}
 
 	//start a tcp server
 	server, err := net.Listen("tcp", ":"+os.Getenv("ADDR"))
@@ -122,10 +139,11 @@ func main(){
 func handleConn(conn net.Conn){
 	//defer的好处是，可以在代码的开头处理两头边界，然后后续专注逻辑，这是一个很好的开始
 	defer conn.Close()
+	c := &client{conn: conn}
 	// io 包提供了与终端、文件等输入输出设备交互的功能
 	// 在这里，conn 是一个网络连接，我们可以通过 io.WriteString 向连接写入数据
 	// 这类似于向终端输出，只是输出目标从终端变成了网络连接
-	io.WriteString(conn,"Enter a new BPM:");
+	c.write("Enter a new BPM:")
 
 	scanner := bufio.NewScanner(conn)
 
@@ -133,40 +151,30 @@ func handleConn(conn net.Conn){
 	// go must after a func call
 	go func ()  {
 		for scanner.Scan(){
+			//跟随我们的节点发JSON行来要区块，其他的行是BPM
+			if strings.HasPrefix(scanner.Text(), "{") {
+				handleMessage(c, scanner.Bytes())
+				continue
+			}
 			bpm, err := strconv.Atoi(scanner.Text())
 			if err != nil{
 				log.Printf("%v not a number: %v", scanner.Text(), err)
 				continue
 			}
-			newBlock,err := generateBlock(Blockchain[len(Blockchain)-1],bpm)
-			if err != nil {
+			newBlock := chain.GenerateBlock(Blockchain.Tip(), bpm)
+			//进行校验, Append会先校验再上链
+			if err := Blockchain.Append(newBlock); err != nil {
 				log.Println(err)
-				continue
-			}
-			//进行校验
-			if isBlockValid(newBlock,Blockchain[len(Blockchain)-1]){
-				newBlockChain := append(Blockchain,newBlock)
-				replaceChain(newBlockChain)
+			} else {
+				bcServer <- Blockchain.Blocks()
 			}
-			bcServer <- Blockchain
-			io.WriteString(conn, "\nEnter a new BPM:")
+			c.write("\nEnter a new BPM:")
 		}
 	}()
 
-	// simulate receiving broadcast	
-	//通过在一个独立的 goroutine 中周期性地将区块链数据（Blockchain）序列化为 JSON 格式并发送到 TCP 连接（conn）
-	go func ()  {
-		//like while(true)
-		for{	
-			time.Sleep(30 * time.Second)
-			output, err := json.Marshal(Blockchain)
-			if err != nil {
-				log.Fatal(err)
-			}
-			// string() 是 Go 语言中的类型转换，将其他类型的数据转换为字符串、
-			io.WriteString(conn, string(output))
-		} 
-	}()
+	// simulate receiving broadcast
+	//tip变了就把这个连接还没见过的区块发过去，每个区块一行JSON，不再定时发整条链
+	go sendNewBlocks(c)
 	
 	// 这里是一个无限循环，用于持续监听bcServer通道的消息
 	// watch
@@ -174,16 +182,193 @@ func handleConn(conn net.Conn){
 	// := 是声明并赋值的简写形式，而 = 只是赋值操作
 	// 在这个上下文中，我们只需要从 bcServer 通道接收值，不需要重新声明变量
 	for range bcServer {
-		spew.Dump(Blockchain)
+		spew.Dump(Blockchain.Blocks())
+	}
+
+
+}
+
+// sendNewBlocks writes each block of the chain c hasn't been sent yet, as
+// a JSON line, whenever the tip changes. After a reorg it starts again
+// from the block where the client's view and ours fork.
+func sendNewBlocks(c *client) {
+	tips, stop := Blockchain.Subscribe()
+	defer stop()
+	last := Blockchain.Tip()
+	for range tips {
+		//last被reorg掉了的话，顺着PrevHash往回找到还在最佳链上的祖先
+		for {
+			if b, ok := Blockchain.Get(last.Index); ok && b.Hash == last.Hash {
+				break
+			}
+			prev, ok := Blockchain.Block(last.PrevHash)
+			if !ok {
+				//太老的侧链区块已经丢了，从最终确定的区块接着发
+				last = Blockchain.Finalized()
+				break
+			}
+			last = prev
+		}
+		for i := last.Index + 1; ; i++ {
+			b, ok := Blockchain.Get(i)
+			if !ok {
+				break
+			}
+			output, err := json.Marshal(b)
+			if err != nil {
+				log.Fatal(err)
+			}
+			// string() 是 Go 语言中的类型转换，将其他类型的数据转换为字符串、
+			if err := c.write("\n" + string(output)); err != nil {
+				return
+			}
+			last = b
+		}
 	}
+}
 
+// handleMessage answers a getblocks request of a node following us
+func handleMessage(c *client, line []byte) {
+	var m message
+	if err := json.Unmarshal(line, &m); err != nil || m.Type != "getblocks" {
+		log.Printf("%s: bad request %q", c.conn.RemoteAddr(), line)
+		return
+	}
+	var blocks []chain.Block
+	for hash := m.Hash; len(blocks) < min(max(m.Count, 1), getBlocksCount); {
+		b, ok := Blockchain.Block(hash)
+		if !ok {
+			break
+		}
+		blocks = append(blocks, b)
+		if b.Index == 0 {
+			break
+		}
+		hash = b.PrevHash
+	}
+	//最老的先发，这样每个区块到的时候父区块已经在了
+	for i := len(blocks) - 1; i >= 0; i-- {
+		output, err := json.Marshal(blocks[i])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := c.write("\n" + string(output)); err != nil {
+			return
+		}
+	}
+}
 
+// followNode connects to the ADDR of another node, as a client that never
+// sends a BPM, and adds the blocks it sends. A block whose parent we don't
+// have waits in orphans while its missing ancestors are asked for.
+func followNode(addr string) {
+	for {
+		conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+		if err != nil {
+			log.Println("follow:", err)
+			time.Sleep(followRetry)
+			continue
+		}
+		log.Println("following", addr)
+		//先跳过"Enter a new BPM:"提示，之后是一个接一个的区块JSON。
+		//区块是"\n"+JSON这样写的，最后一个后面没有换行，所以不能按行读
+		r := bufio.NewReader(conn)
+		for {
+			c, err := r.ReadByte()
+			if err != nil || c == '{' {
+				r.UnreadByte()
+				break
+			}
+		}
+		dec := json.NewDecoder(r)
+		for {
+			var b chain.Block
+			if err := dec.Decode(&b); err != nil {
+				log.Printf("follow %s: %v", addr, err)
+				break
+			}
+			missing, err := orphans.Connect(Blockchain, b, addr)
+			if err != nil && !errors.Is(err, chain.ErrKnownBlock) {
+				log.Printf("block %d from %s: %v", b.Index, addr, err)
+				continue
+			}
+			if missing != "" && orphans.Request(missing) {
+				log.Printf("block %d from %s is an orphan (%d waiting), asking for %s", b.Index, addr, orphans.Len(), missing)
+				data, _ := json.Marshal(message{Type: "getblocks", Hash: missing, Count: getBlocksCount})
+				if _, err := conn.Write(append(data, '\n')); err != nil {
+					break
+				}
+			}
+		}
+		conn.Close()
+		log.Printf("lost %s, redialing", addr)
+		time.Sleep(followRetry)
+	}
+}
+
+// serveSync answers the chainsync requests of the nodes that connect to addr
+func serveSync(addr string) {
+	server, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("chainsync listening on", addr)
+	for {
+		conn, err := server.Accept()
+		if err != nil {
+			log.Println("Accept error:", err)
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			chainsync.ServeStream(Blockchain, conn, conn)
+		}()
+	}
+}
+
+// syncLoop keeps a chainsync connection to every peer at addrs, redialing
+// the ones that drop, and downloads the blocks they have and we don't
+// every syncInterval
+func syncLoop(addrs []string) {
+	syncer := chainsync.NewSyncer(Blockchain)
+	conns := make(map[string]*chainsync.StreamPeer)
+	for {
+		for _, addr := range addrs {
+			if p, ok := conns[addr]; ok {
+				select {
+				case <-p.Done():
+					syncer.RemovePeer(addr)
+				default:
+					continue
+				}
+			}
+			conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+			if err != nil {
+				log.Println("sync:", err)
+				delete(conns, addr)
+				continue
+			}
+			conns[addr] = chainsync.NewStreamPeer(addr, conn)
+			syncer.AddPeer(conns[addr])
+		}
+		added, err := syncer.Sync(context.Background())
+		if err != nil {
+			log.Println("sync:", err)
+		}
+		if added > 0 {
+			//bcServer只有连着客户端的时候才有人读，这里不能往里写
+			log.Printf("synced %d blocks, tip %d", added, Blockchain.Tip().Index)
+		}
+		time.Sleep(syncInterval)
+	}
 }
 
 //how to use
 //1.服务端启动之后，客户端通过nc localhost 9000，连上，然后输入BPM
 //2.服务端接收到信息，然后新增区块，最终输入到bcServer通道
-//3.广播的模拟，就是过段时间就输出一下BlockChain
+//3.广播的模拟，就是tip变了就把新区块发给每个连着的客户端
+//4.几个节点一起跑的话，每个设SYNC_ADDR，再用PEERS指向别的节点的SYNC_ADDR，落后的节点会去下载缺的区块
+//5.FOLLOW指向别的节点的ADDR，它们的新区块一出来就收到，缺父区块的时候用getblocks要
 //PS：注意数据的监听用的for range
 // 这里使用 `for _ = range bcServer` 而不是 `xx := <-bcServer` 的原因如下：
 
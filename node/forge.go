@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+
+	"blockchain-go/chain"
+	"blockchain-go/consensus"
+)
+
+// forgeMu makes the front ends forge one block at a time. Two blocks
+// sealed on the same tip would compete with each other, and a proof-stake
+// validator signing both could be slashed for it.
+var forgeMu sync.Mutex
+
+// forge makes a block for bpm on top of the current tip: the engine
+// prepares and seals it, then it is appended. If another block lands on
+// the chain while sealing, sealing is cancelled and starts over on the new
+// tip. Engines that are Submitters make the block themselves.
+func forge(ctx context.Context, bpm int) (chain.Block, error) {
+	if submitter, ok := engine.(consensus.Submitter); ok {
+		return submitter.Submit(ctx, bpm)
+	}
+	forgeMu.Lock()
+	defer forgeMu.Unlock()
+
+	tips, stop := Blockchain.Subscribe()
+	defer stop()
+
+	for {
+		blocks := Blockchain.Blocks()
+		b := chain.GenerateBlock(blocks[len(blocks)-1], bpm)
+		if err := engine.Prepare(&b, blocks); err != nil {
+			return chain.Block{}, err
+		}
+
+		sealCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-tips:
+					if Blockchain.Tip().Hash != b.PrevHash {
+						cancel()
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+		err := engine.Seal(sealCtx, &b, blocks)
+		close(done)
+		cancel()
+
+		if ctx.Err() != nil {
+			return chain.Block{}, ctx.Err()
+		}
+		if errors.Is(err, context.Canceled) {
+			log.Printf("block %d lost to a block that arrived first, starting over on the new tip", b.Index)
+			continue
+		}
+		if err != nil {
+			return chain.Block{}, err
+		}
+		//Append checks the block with engine.VerifyHeader like any other
+		if err := Blockchain.Append(b); err != nil {
+			if Blockchain.Tip().Hash == b.PrevHash {
+				return chain.Block{}, err
+			}
+			continue
+		}
+		return b, nil
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"blockchain-go/chain"
+	"blockchain-go/consensus"
+
+	"github.com/gorilla/mux"
+)
+
+// Message is what POST / takes
+type Message struct {
+	BPM int
+}
+
+// consensusResponse is what GET /consensus returns
+type consensusResponse struct {
+	Engine    string
+	Height    int
+	Tip       string
+	Finalized int
+	// Signers and Proposals are only there for engines that vote, like poa
+	Signers   []string        `json:",omitempty"`
+	Proposals map[string]bool `json:",omitempty"`
+}
+
+// Proposal is what POST /consensus/proposals takes
+type Proposal struct {
+	Address   string
+	Authorize bool
+}
+
+// serveHTTP serves the HTTP front end on addr
+func serveHTTP(addr string) error {
+	muxRouter := mux.NewRouter()
+	muxRouter.HandleFunc("/", handleGetBlockchain).Methods("GET")
+	muxRouter.HandleFunc("/", handleWriteBlock).Methods("POST")
+	muxRouter.HandleFunc("/consensus", handleGetConsensus).Methods("GET")
+	muxRouter.HandleFunc("/consensus/proposals", handlePropose).Methods("POST")
+	muxRouter.HandleFunc("/consensus/proposals/{address}", handleDiscard).Methods("DELETE")
+	s := &http.Server{
+		Addr:        addr,
+		Handler:     muxRouter,
+		ReadTimeout: 10 * time.Second,
+		// no WriteTimeout: POST / answers once the block is sealed, which
+		// takes as long as mining it or waiting for a slot
+		MaxHeaderBytes: 1 << 20,
+	}
+	log.Println("HTTP Server listening on", addr)
+	return s.ListenAndServe()
+}
+
+func handleGetBlockchain(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, r, http.StatusOK, Blockchain.Blocks())
+}
+
+// POST / forges a block for the BPM in the body with the engine and
+// returns it once it is on the chain
+func handleWriteBlock(w http.ResponseWriter, r *http.Request) {
+	var m Message
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+
+	//the request context cancels sealing if the client goes away
+	b, err := forge(r.Context(), m.BPM)
+	if errors.Is(err, consensus.ErrNotSigner) || errors.Is(err, consensus.ErrNoSlot) {
+		//not this node's turn, another node has to make the block
+		respondWithJSON(w, r, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithJSON(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	respondWithJSON(w, r, http.StatusCreated, b)
+}
+
+// GET /consensus shows the engine and how far the chain is
+func handleGetConsensus(w http.ResponseWriter, r *http.Request) {
+	blocks := Blockchain.Blocks()
+	tip := blocks[len(blocks)-1]
+	response := consensusResponse{
+		Engine:    engineName,
+		Height:    tip.Index,
+		Tip:       tip.Hash,
+		Finalized: Blockchain.Finalized().Index,
+	}
+	if voter, ok := engine.(consensus.Voter); ok {
+		signers, err := voter.Signers(blocks)
+		if err != nil {
+			respondWithJSON(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+		response.Signers = signers
+		response.Proposals = voter.Proposals()
+	}
+	respondWithJSON(w, r, http.StatusOK, response)
+}
+
+// POST /consensus/proposals {"Address":"...","Authorize":true} makes the
+// node vote on Address in the blocks it seals, until the vote passes
+func handlePropose(w http.ResponseWriter, r *http.Request) {
+	voter, ok := engine.(consensus.Voter)
+	if !ok {
+		respondWithJSON(w, r, http.StatusNotFound, engineName+" has no voting")
+		return
+	}
+	var p Proposal
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer r.Body.Close()
+	if _, err := chain.PublicKey(p.Address); err != nil {
+		respondWithJSON(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	voter.Propose(p.Address, p.Authorize)
+	respondWithJSON(w, r, http.StatusOK, voter.Proposals())
+}
+
+// DELETE /consensus/proposals/{address} stops voting on address
+func handleDiscard(w http.ResponseWriter, r *http.Request) {
+	voter, ok := engine.(consensus.Voter)
+	if !ok {
+		respondWithJSON(w, r, http.StatusNotFound, engineName+" has no voting")
+		return
+	}
+	voter.Discard(mux.Vars(r)["address"])
+	respondWithJSON(w, r, http.StatusOK, voter.Proposals())
+}
+
+func respondWithJSON(w http.ResponseWriter, r *http.Request, code int, payload interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	response, err := json.MarshalIndent(payload, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("HTTP 500: Internal Server Error"))
+		return
+	}
+	w.WriteHeader(code)
+	w.Write(response)
+}
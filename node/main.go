@@ -0,0 +1,138 @@
+package main
+
+/**
+node 是一个程序跑所有的共识: -consensus=none|pow|pos|poa|bft 选consensus.Engine
+├── 初始化阶段
+│   ├── go run ./node init / keygen 和其他程序一样写出genesis.json和验证者密钥
+│   ├── 加载环境变量，解析命令行参数
+│   ├── consensus.New 按名字创建Engine (pow要genesis里有Bits，pos要有validators和slot长度，poa要有authorities，bft要有replicas)
+│   ├── chain.OpenPath 用consensus.Verifier(engine)检查每个区块，Replace和Add用engine的ForkChoice选链
+│   │   └── 链保留所有分叉上合法的区块，换到另一个分叉时只回滚到共同祖先，reorg事件带回滚深度
+│   └── engine是consensus.Service的话 (bft) 在后台启动，-peer-listen 监听其他replica，-peers 连接它们
+│
+├── 出块 (forge)
+│   ├── chain.GenerateBlock 生成索引、时间、BPM、PrevHash
+│   ├── engine.Prepare 填上共识字段 (pow: Bits, poa: 签名者、difficulty和投票)
+│   ├── engine.Seal 让区块生效 (none: 算hash, pow: 挖矿, pos: 等到自己的slot再签名, poa: 等period再签名)
+│   ├── Append上链，如果tip在Seal的时候变了就在新的tip上重来
+│   └── bft不自己出块: engine是consensus.Submitter，把BPM签成请求交给replica，等所有replica投票同意的区块上链
+│
+└── 前端，和共识无关
+    ├── HTTP (-http): GET / 区块链，POST / {"BPM":60} 出块，GET /consensus 共识信息
+    │   └── poa: POST /consensus/proposals {"Address":"..","Authorize":true} 投票加减签名者，DELETE /consensus/proposals/{address} 取消
+    └── TCP (-tcp): nc连上输入BPM出块，有新区块就广播给所有连接
+*/
+
+import (
+	"encoding/hex"
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"blockchain-go/chain"
+	"blockchain-go/consensus"
+
+	"github.com/joho/godotenv"
+)
+
+// Blockchain is a series of validated Blocks
+var Blockchain *chain.Chain
+
+// engine prepares and seals the blocks of this node and checks everyone's
+var engine consensus.Engine
+
+// engineName is the -consensus flag, kept for reporting
+var engineName string
+
+// go run ./node -consensus=pow -http=8080 -tcp=9000
+func main() {
+	//go run ./node init 写出genesis.json
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		if err := chain.InitCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	//go run ./node keygen 生成验证者的ed25519密钥，打印地址(公钥)
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		if err := chain.KeygenCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	err := godotenv.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	opts := consensus.Options{}
+	flag.StringVar(&engineName, "consensus", "none", "consensus engine: none, pow, pos, poa or bft")
+	httpAddr := flag.String("http", os.Getenv("ADDR"), "HTTP port, empty to not serve HTTP")
+	tcpAddr := flag.String("tcp", "", "TCP port, empty to not serve TCP")
+	flag.StringVar(&opts.PeerListen, "peer-listen", "", "address a bft replica listens on for the other replicas, e.g. :7000")
+	peers := flag.String("peers", "", "comma separated addresses of the other bft replicas")
+	flag.Parse()
+	if *peers != "" {
+		opts.Peers = strings.Split(*peers, ",")
+	}
+
+	//所有节点从同一个GENESIS_FILE得到同一个创世区块
+	genesis, err := chain.LoadGenesis(os.Getenv("GENESIS_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//MINER_THREADS, KEYS_DIR, RANDAO_KEY和proof-work/proof-stake里的意思一样
+	opts.MinerThreads, _ = strconv.Atoi(os.Getenv("MINER_THREADS"))
+	keysDir := os.Getenv("KEYS_DIR")
+	if keysDir == "" {
+		keysDir = "keys"
+	}
+	if opts.Keys, err = chain.ReadKeys(keysDir); err != nil {
+		log.Fatal(err)
+	}
+	if opts.RandaoKey, err = hex.DecodeString(os.Getenv("RANDAO_KEY")); err != nil {
+		log.Fatal(err)
+	}
+	engine, err = consensus.New(engineName, genesis, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	//CHAIN_FILE里有区块的话就从文件恢复，否则从创世区块开始
+	Blockchain, err = chain.OpenPath(os.Getenv("CHAIN_FILE"), genesis, consensus.Verifier(engine))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("consensus %s, %d blocks, %d validator keys in %s", engineName, Blockchain.Len(), len(opts.Keys), keysDir)
+	go logReorgs()
+	if service, ok := engine.(consensus.Service); ok {
+		if err := service.Start(Blockchain); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *httpAddr == "" && *tcpAddr == "" {
+		log.Fatal("nothing to serve, set -http or -tcp")
+	}
+	errs := make(chan error)
+	if *tcpAddr != "" {
+		go func() { errs <- serveTCP(":" + *tcpAddr) }()
+	}
+	if *httpAddr != "" {
+		go func() { errs <- serveHTTP(":" + *httpAddr) }()
+	}
+	log.Fatal(<-errs)
+}
+
+// logReorgs reports every time the chain switches to another branch
+func logReorgs() {
+	reorgs, _ := Blockchain.SubscribeReorgs()
+	for reorg := range reorgs {
+		log.Printf("reorg of depth %d: rolled back to block %d %s, now at block %d",
+			reorg.Depth, reorg.Ancestor.Index, reorg.Ancestor.Hash, reorg.Added[len(reorg.Added)-1].Index)
+	}
+}
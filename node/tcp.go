@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+// serveTCP serves the TCP front end on addr: every connection can type in
+// BPMs, and hears about every new block
+func serveTCP(addr string) error {
+	server, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+	log.Println("TCP Server listening on", addr)
+
+	for {
+		conn, err := server.Accept()
+		if err != nil {
+			log.Println("Accept error:", err)
+			continue
+		}
+		go handleConn(conn)
+	}
+}
+
+func handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	//every new tip, whoever forged it, is sent to the connection
+	tips, stop := Blockchain.Subscribe()
+	defer stop()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case tip := <-tips:
+				output, err := json.Marshal(tip)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				io.WriteString(conn, "\nnew block: "+string(output)+"\n")
+			}
+		}
+	}()
+
+	io.WriteString(conn, "Enter a new BPM:")
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		bpm, err := strconv.Atoi(scanner.Text())
+		if err != nil {
+			io.WriteString(conn, fmt.Sprintf("\n%v not a number\n", scanner.Text()))
+		} else if _, err := forge(ctx, bpm); err != nil {
+			io.WriteString(conn, "\n"+err.Error()+"\n")
+		}
+		io.WriteString(conn, "\nEnter a new BPM:")
+	}
+}
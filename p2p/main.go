@@ -2,80 +2,136 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"flag"
 	"log"
+	"maps"
+	"math/big"
 	mrand "math/rand"
+	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"blockchain-go/chain"
+	"blockchain-go/chainsync"
+	"blockchain-go/consensus"
+	"blockchain-go/discovery"
+	"blockchain-go/gossip"
+	"blockchain-go/pos"
+
+	"github.com/davecgh/go-spew/spew"
+	"github.com/joho/godotenv"
 	"github.com/libp2p/go-libp2p"
-	net "github.com/libp2p/go-libp2p-net"
 	crypto "github.com/libp2p/go-libp2p/core/crypto"
 	host "github.com/libp2p/go-libp2p/core/host"
+	net "github.com/libp2p/go-libp2p/core/network"
+	libpeer "github.com/libp2p/go-libp2p/core/peer"
+	pstore "github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/p2p/net/connmgr"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
-// Block represents each 'item' in the blockchain
-type Block struct {
-	Index     int
-	Timestamp string
-	BPM       int
-	Hash      string
-	PrevHash  string
-}
-
 // Blockchain is a series of validated Blocks
-var Blockchain []Block
+var Blockchain *chain.Chain
 
 var mutex = &sync.Mutex{}
 
-// make sure block is valid by checking index, and comparing the hash of the previous block
-func isBlockValid(newBlock, oldBlock Block) bool {
-	if oldBlock.Index+1 != newBlock.Index {
-		return false
-	}
+// engine prepares and seals the blocks typed in here and checks everyone's,
+// chosen with -consensus like in node
+var engine consensus.Engine
 
-	if oldBlock.Hash != newBlock.PrevHash {
-		return false
-	}
+// orphans holds blocks from peers whose parent we don't have yet
+var orphans = chain.NewOrphanPool(orphanPoolBytes, orphanMaxAge)
 
-	if calculateHash(newBlock) != newBlock.Hash {
-		return false
-	}
+// gossiper spreads new blocks, transactions and votes over gossipsub
+var gossiper *gossip.Gossip
 
-	return true
-}
+// peers are the streams we have open, by peer ID, so blocks missing for a
+// gossiped orphan can be asked from whoever sent it
+var (
+	peers   = make(map[libpeer.ID]*peer)
+	peersMu sync.Mutex
+)
 
-// SHA256 hashing
-func calculateHash(block Block) string {
-	record := strconv.Itoa(block.Index) + block.Timestamp + strconv.Itoa(block.BPM) + block.PrevHash
-	h := sha256.New()
-	h.Write([]byte(record))
-	hashed := h.Sum(nil)
-	return hex.EncodeToString(hashed)
-}
+// protocolID names the stream protocol. Its version changes whenever the
+// messages do, so nodes that don't speak each other's messages never
+// open a stream to each other. Since 1.2.0 new blocks travel over
+// gossipsub; since 1.3.0 the stream starts with a chainsync.Status
+// instead of the genesis hash and never carries whole chains, a node
+// that is behind downloads what it misses over syncProtocolID.
+const protocolID = "/blockchain-go/p2p/1.3.0"
+
+// syncProtocolID names the chainsync protocol: each node opens one such
+// stream to each peer and sends its requests there
+const syncProtocolID = "/blockchain-go/sync/1.0.0"
+
+// syncInterval is how often the node checks whether a peer got ahead
+// without us noticing, e.g. while gossip missed blocks
+const syncInterval = 30 * time.Second
+
+// syncer downloads the blocks we miss from our peers, and syncNow asks it to
+var (
+	syncer  *chainsync.Syncer
+	syncNow = make(chan struct{}, 1)
+)
 
-// create a new block using previous block's hash
-func generateBlock(oldBlock Block, BPM int) Block {
+// node is our libp2p host
+var node host.Host
 
-	var newBlock Block
+const (
+	// orphanPoolBytes and orphanMaxAge bound the orphan pool
+	orphanPoolBytes = 8 << 20
+	orphanMaxAge    = 10 * time.Minute
+	// getBlocksCount is how many ancestors are asked for at once
+	getBlocksCount = 32
+)
 
-	t := time.Now()
+// peer is one stream to another node. Reading happens in readData and
+// writing from anywhere through send, which keeps lines whole.
+type peer struct {
+	id     string
+	stream net.Stream
+	rw     *bufio.ReadWriter
+	mu     sync.Mutex
+	// sync is our chainsync stream to the peer
+	sync *chainsync.StreamPeer
+	// done is closed once the peer is gone
+	done chan struct{}
+}
 
-	newBlock.Index = oldBlock.Index + 1
-	newBlock.Timestamp = t.String()
-	newBlock.BPM = BPM
-	//这是第一章的精髓
-	newBlock.PrevHash = oldBlock.Hash
-	newBlock.Hash = calculateHash(newBlock)
+// message is a line of the protocol after the handshake
+type message struct {
+	// Type is "block" for a single block, or "getblocks" to ask for the
+	// block with Hash and up to Count-1 of its ancestors, which come back
+	// oldest first as "block" messages
+	Type  string
+	Block *chain.Block `json:",omitempty"`
+	Hash  string       `json:",omitempty"`
+	Count int          `json:",omitempty"`
+}
 
-	return newBlock
+// send writes v to p as one JSON line
+func (p *peer) send(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rw.Write(append(data, '\n'))
+	return p.rw.Flush()
 }
 
 /** 
@@ -104,10 +160,11 @@ NAT 穿透是指通过技术手段（如协议或中继）让两个或多个 NAT
 
 
 // makeBasicHost creates a LibP2P host with a random peer ID listening on the
-// given multiaddress. It will use secio if secio is true.
+// given ip and port. It will use secio if secio is true. Once it has more
+// than twice target connections it closes some, down to target.
 // secio 是 go-libp2p 中用于安全通信的一种加密协议，全称是 Secure Communication
 
-func makeBasicHost(listenPort int, secio bool, randseed int64)(host.Host, error){
+func makeBasicHost(ip string, listenPort int, secio bool, randseed int64, target int)(host.Host, error){
 	
 	// If the seed is zero, use real cryptographic randomness. Otherwise, use a
 	// deterministic randomness source to make generated keys stay the same
@@ -141,9 +198,15 @@ func makeBasicHost(listenPort int, secio bool, randseed int64)(host.Host, error)
 	// 1. 监听本地127.0.0.1地址和指定端口
 	// 2. 使用前面生成的私钥作为节点身份标识
 	// 这些选项将传递给libp2p.New()函数来创建实际的P2P主机
+	//连接数超过2*target时，连接管理器把最不重要的连接关掉，直到剩target个
+	cm, err := connmgr.NewConnManager(target, 2*target)
+	if err != nil {
+		return nil, err
+	}
 	opts := []libp2p.Option{
-		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", listenPort)),
+		libp2p.ListenAddrStrings(fmt.Sprintf("/ip4/%s/tcp/%d", ip, listenPort)),
 		libp2p.Identity(priv),
+		libp2p.ConnectionManager(cm),
 	}
 
 	if !secio {
@@ -174,53 +237,466 @@ func makeBasicHost(listenPort int, secio bool, randseed int64)(host.Host, error)
 	return basicHost, nil
 }
 
-//处理输入数据流
+//处理输入数据流，别的节点连上我们的时候libp2p调用它
 func handleStream(s net.Stream){
 	log.Println("Got a new stream!")
+	runPeer(s)
+}
+
+// runPeer checks that the other end of s is on our network, opens our
+// chainsync stream to it and reads from s until it goes away. Both the
+// listening and the dialing side of a stream use it.
+func runPeer(s net.Stream) {
 	//creating a buffer stream for non blocking read and write
 	rw := bufio.NewReadWriter(bufio.NewReader(s), bufio.NewWriter(s))
-	go readData(rw)
-	go writeData(rw)
+	status, err := handshake(rw)
+	if err != nil {
+		log.Println("Dropping peer:", err)
+		s.Reset()
+		return
+	}
+	id := s.Conn().RemotePeer()
+	ss, err := node.NewStream(context.Background(), id, syncProtocolID)
+	if err != nil {
+		log.Println("Dropping peer:", err)
+		s.Reset()
+		return
+	}
+	p := &peer{id: id.String(), stream: s, rw: rw, sync: chainsync.NewStreamPeer(id.String(), ss), done: make(chan struct{})}
+	peersMu.Lock()
+	peers[id] = p
+	peersMu.Unlock()
+	syncer.AddPeer(p.sync)
+	go readData(p)
+	//对方的链比我们的重就马上同步，不用等下一轮
+	if work, ok := new(big.Int).SetString(status.Work, 16); ok && work.Cmp(Blockchain.Tip().Work()) > 0 {
+		requestSync()
+	}
 	// stream 's' will stay open until you close it (or the other side closes it).
 }
 
 
-func readData(rw  *bufio.ReadWriter){
+// handshake sends our status and reads the peer's. Peers built on a
+// different genesis are on another network, so we refuse to talk to them.
+func handshake(rw *bufio.ReadWriter) (chainsync.Status, error) {
+	var status chainsync.Status
+	data, err := json.Marshal(chainsync.NewStatus(Blockchain))
+	if err != nil {
+		return status, err
+	}
+	if _, err := rw.Write(append(data, '\n')); err != nil {
+		return status, err
+	}
+	if err := rw.Flush(); err != nil {
+		return status, err
+	}
+	str, err := rw.ReadString('\n')
+	if err != nil {
+		return status, err
+	}
+	if err := json.Unmarshal([]byte(str), &status); err != nil {
+		return status, err
+	}
+	if status.Genesis != Blockchain.Genesis().Hash {
+		return status, chain.ErrGenesisMismatch
+	}
+	return status, nil
+}
+
+// handleSync answers the chainsync requests of a peer
+func handleSync(s net.Stream) {
+	defer s.Reset()
+	chainsync.ServeStream(Blockchain, s, s)
+}
+
+// requestSync makes syncLoop sync now, unless it is about to anyway
+func requestSync() {
+	select {
+	case syncNow <- struct{}{}:
+	default:
+	}
+}
+
+// syncLoop downloads the blocks our peers have and we don't, whenever a
+// better peer shows up and every syncInterval
+func syncLoop() {
+	ticker := time.NewTicker(syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-syncNow:
+		case <-ticker.C:
+		}
+		added, err := syncer.Sync(context.Background())
+		if err != nil {
+			log.Println("sync:", err)
+		}
+		if added > 0 {
+			tip := Blockchain.Tip()
+			//这行Go代码 fmt.Printf("\x1b[32m%s\x1b[0m> ", ...) 的作用是在终端中显示绿色文本
+			fmt.Printf("\x1b[32msynced %d blocks, tip %d %s\x1b[0m\n> ", added, tip.Index, tip.Hash)
+		}
+	}
+}
+
+func readData(p *peer){
+	//对方断开或者被我们丢掉之后，同步用的stream也关掉
+	defer close(p.done)
+	defer p.stream.Reset()
+	defer func() {
+		peersMu.Lock()
+		if peers[p.stream.Conn().RemotePeer()] == p {
+			delete(peers, p.stream.Conn().RemotePeer())
+			syncer.RemovePeer(p.id)
+		}
+		peersMu.Unlock()
+		p.sync.Close()
+	}()
 	for{
-		str, err := rw.ReadString('\n')
+		str, err := p.rw.ReadString('\n')
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("Peer %s left: %v", p.id, err)
+			return
 		}
 		if str == ""{
 			return
 		}
-		if str != "\n" {
-			// 这里的0表示创建一个空的Block切片，用于后续存储解析后的区块链数据
-			// 相当于初始化一个空的区块链容器
-			chain := make([]Block, 0)
-			//然后往下进行
-			// &chain 表示将 chain 变量的内存地址传递给 json.Unmarshal 函数
-			// 在 JSON 解码时，解码结果会被直接存入 chain 变量中
-			if err := json.Unmarshal([]byte(str), &chain); err != nil {
-				log.Fatal(err)
+		//每行是一个单个区块或者getblocks请求，整条链不再发了，落后的节点用chainsync去要
+		var m message
+		if err := json.Unmarshal([]byte(str), &m); err != nil {
+			log.Println("Dropping peer:", err)
+			return
+		}
+		handleMessage(p, m)
+	}
+}
+// handleMessage handles a block or a getblocks request from p
+func handleMessage(p *peer, m message) {
+	switch m.Type {
+	case "block":
+		if m.Block == nil {
+			return
+		}
+		//父区块还没到的区块先放进orphans，向发来的节点要缺的祖先，祖先到了再接上
+		missing, err := orphans.Connect(Blockchain, *m.Block, p.id)
+		if err != nil && !errors.Is(err, chain.ErrKnownBlock) {
+			log.Printf("block %d from %s: %v", m.Block.Index, p.id, err)
+			return
+		}
+		if missing != "" && orphans.Request(missing) {
+			log.Printf("block %d from %s is an orphan (%d waiting), asking for %s", m.Block.Index, p.id, orphans.Len(), missing)
+			p.send(message{Type: "getblocks", Hash: missing, Count: getBlocksCount})
+		}
+	case "getblocks":
+		var blocks []chain.Block
+		for hash := m.Hash; len(blocks) < min(max(m.Count, 1), getBlocksCount); {
+			b, ok := Blockchain.Block(hash)
+			if !ok {
+				break
 			}
-			//这种算是读，也就是reading
-			mutex.Lock()
-			if len(chain) > len(Blockchain) {
-				Blockchain = chain
-				bytes,err := json.MarshalIndent(Blockchain,"","	")
-				if err != nil{
-					log.Fatal(err)
-				}
-				//这行Go代码 fmt.Printf("\x1b[32m%s\x1b[0m> ", string(bytes)) 的作用是在终端中显示绿色文本
-				fmt.Printf("\x1b[32m%s\x1b[0m> ", string(bytes))
+			blocks = append(blocks, b)
+			if b.Index == 0 {
+				break
 			}
-			mutex.Unlock()
+			hash = b.PrevHash
 		}
+		//最老的先发，这样每个区块到的时候父区块已经在了
+		for i := len(blocks) - 1; i >= 0; i-- {
+			if err := p.send(message{Type: "block", Block: &blocks[i]}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// askMissing asks the peer that gossiped an orphan for its missing
+// ancestors, over our stream to it
+func askMissing(hash string, from libpeer.ID) {
+	peersMu.Lock()
+	p := peers[from]
+	peersMu.Unlock()
+	if p == nil || !orphans.Request(hash) {
+		return
 	}
+	log.Printf("gossiped block from %s is an orphan (%d waiting), asking for %s", from, orphans.Len(), hash)
+	p.send(message{Type: "getblocks", Hash: hash, Count: getBlocksCount})
+	//差得多的话getblocks一次32个太慢，让chainsync一起补
+	requestSync()
+}
+
+// startGossip joins ha to the gossipsub topics of our chain
+func startGossip(ha host.Host) error {
+	var err error
+	gossiper, err = gossip.New(context.Background(), ha, Blockchain, orphans, gossip.Handlers{
+		CheckTx: func(tx chain.Tx) error {
+			return consensus.CheckTx(engine, tx, Blockchain.Blocks())
+		},
+		Block: func(b chain.Block, from libpeer.ID) {
+			log.Printf("block %d from %s: %s", b.Index, from, b.Hash)
+		},
+		Tx: func(tx chain.Tx, from libpeer.ID) {
+			log.Printf("%s tx from %s: %s", tx.Type, from, tx.Hash())
+		},
+		Vote: func(v chain.Vote, from libpeer.ID) {
+			log.Printf("%s vote of %s for %d from %s", v.Type, v.Validator, v.Height, from)
+		},
+		Missing: askMissing,
+	})
+	return err
 }
-func writeData(rw * bufio.ReadWriter){
-	//todo
+
+// readBPM reads a BPM per line from stdin, adds a block for it and
+// gossips it. With a key in KEYS_DIR, "tx <to> <amount>" gossips a signed
+// transfer and, with -consensus=pos, "vote" a signed prevote for our tip.
+func readBPM(key ed25519.PrivateKey) {
+	//the nonce after the last transaction we sent, which may not be in a
+	//block yet
+	var nonce uint64
+	stdReader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("> ")
+		sendData, err := stdReader.ReadString('\n')
+		if err != nil {
+			log.Fatal(err)
+		}
+		sendData = strings.TrimSpace(sendData)
+		if fields := strings.Fields(sendData); len(fields) > 0 && (fields[0] == "tx" || fields[0] == "vote") {
+			if key == nil {
+				log.Println("no key in KEYS_DIR to sign with")
+				continue
+			}
+			if err := publishSigned(fields, key, &nonce); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		bpm, err := strconv.Atoi(sendData)
+		if err != nil {
+			log.Printf("%q is not a number: %v", sendData, err)
+			continue
+		}
+		newBlock, err := forge(bpm)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		spew.Dump(Blockchain.Blocks())
+		if err := gossiper.PublishBlock(context.Background(), newBlock); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// forge makes a block for bpm on top of our tip: the engine prepares and
+// seals it, then it is appended, which checks it like any gossiped block.
+// If a block from a peer lands on the tip while sealing, Append fails and
+// the BPM has to be typed in again.
+func forge(bpm int) (chain.Block, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	blocks := Blockchain.Blocks()
+	b := chain.GenerateBlock(blocks[len(blocks)-1], bpm)
+	if err := engine.Prepare(&b, blocks); err != nil {
+		return chain.Block{}, err
+	}
+	if err := engine.Seal(context.Background(), &b, blocks); err != nil {
+		return chain.Block{}, err
+	}
+	return b, Blockchain.Append(b)
+}
+
+// publishSigned gossips the tx or vote the command fields ask for, signed
+// with key. The nonce of a tx follows the transactions of key on the chain
+// and the ones we sent since, so a restart doesn't reuse it.
+func publishSigned(fields []string, key ed25519.PrivateKey, nonce *uint64) error {
+	if fields[0] == "vote" {
+		//only the proof-stake finality gadget counts votes
+		if _, ok := engine.(*consensus.PoS); !ok {
+			return errors.New("votes are only counted with -consensus=pos")
+		}
+		tip := Blockchain.Tip()
+		v := chain.Vote{Type: pos.VotePrevote, Height: tip.Index, Hash: tip.Hash}
+		v.Sign(key)
+		return gossiper.PublishVote(context.Background(), v)
+	}
+	if len(fields) != 3 {
+		return errors.New("usage: tx <to> <amount>")
+	}
+	amount, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return err
+	}
+	from := chain.Address(key.Public().(ed25519.PublicKey))
+	tx := chain.Tx{Type: pos.TxTransfer, From: from, To: fields[1], Amount: amount, Nonce: max(*nonce, consensus.Nonce(Blockchain.Blocks(), from))}
+	tx.Sign(key)
+	if err := gossiper.PublishTx(context.Background(), tx); err != nil {
+		return err
+	}
+	*nonce = tx.Nonce + 1
+	return nil
+}
+
+// openStream opens our stream to a peer we connected to, however we
+// found it: -d, discovery or the DHT. Only the dialing side opens one,
+// and only one per peer.
+func openStream(ha host.Host, id libpeer.ID) {
+	peersMu.Lock()
+	_, ok := peers[id]
+	peersMu.Unlock()
+	if ok {
+		return
+	}
+	log.Println("opening stream to", id)
+	s, err := ha.NewStream(context.Background(), id, protocolID)
+	if err != nil {
+		log.Printf("peer %s: %v", id, err)
+		return
+	}
+	runPeer(s)
+}
+
+// dial connects to the peer at target, a full multiaddr such as
+// /ip4/127.0.0.1/tcp/10000/p2p/QmXXX as printed by makeBasicHost. The
+// stream is opened by openStream, like for every other connection.
+func dial(ha host.Host, target string) error {
+	addr, err := ma.NewMultiaddr(target)
+	if err != nil {
+		return err
+	}
+	info, err := libpeer.AddrInfoFromP2pAddr(addr)
+	if err != nil {
+		return err
+	}
+	ha.Peerstore().AddAddrs(info.ID, info.Addrs, pstore.PermanentAddrTTL)
+	return ha.Connect(context.Background(), *info)
+}
+
+// go run main.go -l 10000, then in another terminal the -d it prints, or
+// just -l 10001: nodes on the same LAN find each other with mDNS, others
+// through the DHT from a -bootstrap peer
+func main() {
+	//.env is optional here, the flags are enough to run a node
+	godotenv.Load()
+
+	listenF := flag.Int("l", 0, "wait for incoming connections on this port")
+	target := flag.String("d", "", "target peer to dial")
+	secio := flag.Bool("secio", false, "enable secure transports")
+	seed := flag.Int64("seed", 0, "set random seed for id generation")
+	ip := flag.String("ip", "127.0.0.1", "address to listen on, 0.0.0.0 for every interface")
+	useMDNS := flag.Bool("mdns", true, "find peers on the LAN with mDNS")
+	useDHT := flag.Bool("dht", true, "find peers through the Kademlia DHT")
+	bootstrap := flag.String("bootstrap", "", "comma separated full addresses of DHT bootstrap peers")
+	targetPeers := flag.Int("peers", 8, "number of connections to keep")
+	engineName := flag.String("consensus", "none", "consensus engine: none, pow, pos or poa")
+	flag.Parse()
+	if *listenF == 0 {
+		log.Fatal("Please provide a port to bind on with -l")
+	}
+
+	//所有节点从同一个GENESIS_FILE得到同一个创世区块，握手的时候对比它的hash
+	genesis, err := chain.LoadGenesis(os.Getenv("GENESIS_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	//KEYS_DIR is optional, the key with the first address in sorted order
+	//signs the txs and votes typed in, the same one every run, and the
+	//keys are the engine's validators or signers
+	var key ed25519.PrivateKey
+	keysDir := os.Getenv("KEYS_DIR")
+	if keysDir == "" {
+		keysDir = "keys"
+	}
+	keys, err := chain.ReadKeys(keysDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if addrs := slices.Sorted(maps.Keys(keys)); len(addrs) > 0 {
+		key = keys[addrs[0]]
+		log.Printf("signing txs and votes as %s", addrs[0])
+	}
+
+	//-consensus和node一样选共识，MINER_THREADS和RANDAO_KEY的意思也一样。
+	//bft的replica之间直接连接，不走gossip，要用node跑
+	opts := consensus.Options{Keys: keys}
+	opts.MinerThreads, _ = strconv.Atoi(os.Getenv("MINER_THREADS"))
+	if opts.RandaoKey, err = hex.DecodeString(os.Getenv("RANDAO_KEY")); err != nil {
+		log.Fatal(err)
+	}
+	engine, err = consensus.New(*engineName, genesis, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, ok := engine.(consensus.Service); ok {
+		log.Fatalf("consensus %s runs its own network, use: go run ./node -consensus=%s", *engineName, *engineName)
+	}
+
+	//同一台机器上跑几个节点的话，每个节点要用自己的CHAIN_FILE，比如 CHAIN_FILE=a.jsonl go run main.go -l 10000
+	Blockchain, err = chain.OpenPath(os.Getenv("CHAIN_FILE"), genesis, consensus.Verifier(engine))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Make a host that listens on the given multiaddress
+	ha, err := makeBasicHost(*ip, *listenF, *secio, *seed, *targetPeers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Set a stream handler on host A. protocolID is
+	// a user-defined protocol name.
+	node = ha
+	syncer = chainsync.NewSyncer(Blockchain)
+	go syncLoop()
+	ha.SetStreamHandler(protocolID, handleStream)
+	ha.SetStreamHandler(syncProtocolID, handleSync)
+	ha.Network().Notify(&net.NotifyBundle{
+		ConnectedF: func(_ net.Network, c net.Conn) {
+			if c.Stat().Direction == net.DirOutbound {
+				go openStream(ha, c.RemotePeer())
+			}
+		},
+	})
+	if err := startGossip(ha); err != nil {
+		log.Fatal(err)
+	}
+
+	//PEERS_FILE记住见过的节点，重启后就算bootstrap节点都不在了也能连回网络。
+	//同一台机器跑几个节点时和CHAIN_FILE一样每个用自己的
+	peersFile := os.Getenv("PEERS_FILE")
+	if peersFile == "" {
+		peersFile = "peers.json"
+	}
+	var bootstrapPeers []string
+	if *bootstrap != "" {
+		bootstrapPeers = strings.Split(*bootstrap, ",")
+	}
+	disc, err := discovery.Start(context.Background(), ha, discovery.Config{
+		Namespace: "blockchain-go-" + Blockchain.Genesis().Hash[:16],
+		MDNS:      *useMDNS,
+		DHT:       *useDHT,
+		Bootstrap: bootstrapPeers,
+		Target:    *targetPeers,
+		PeersFile: peersFile,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	//Ctrl-C的时候把见过的节点写进PEERS_FILE再退出
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		if err := disc.Close(); err != nil {
+			log.Println(err)
+		}
+		os.Exit(0)
+	}()
+
+	if *target == "" {
+		log.Println("listening for connections")
+	} else if err := dial(ha, *target); err != nil {
+		log.Fatal(err)
+	}
+	readBPM(key)
 }
 
 
@@ -0,0 +1,72 @@
+// Package poa holds the proof-of-authority rules, after Ethereum's Clique:
+// a known set of signers take turns sealing blocks. The signer whose turn
+// it is seals with difficulty 2, any other signer may step in with
+// difficulty 1, and the chain with the most difficulty wins, so in-turn
+// blocks are preferred. No signer may seal more than one of any
+// len(signers)/2+1 consecutive blocks, so a minority of signers can't
+// take over the chain. Signers add and remove each other by majority vote
+// in the blocks they seal.
+package poa
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"blockchain-go/chain"
+)
+
+// Block difficulties
+const (
+	// DiffInTurn is the difficulty of a block sealed by the signer whose turn it was
+	DiffInTurn = 2
+	// DiffNoTurn is the difficulty of a block sealed by any other signer
+	DiffNoTurn = 1
+)
+
+// Vote transaction types. A signer votes by putting one of them in a block
+// it seals, with From its own address and To the address voted on. The
+// block signature covers them, so they need no signature of their own.
+const (
+	// TxAuthorize votes to make To a signer
+	TxAuthorize = "authorize"
+	// TxDeauthorize votes to drop To from the signers
+	TxDeauthorize = "deauthorize"
+)
+
+var (
+	// ErrUnauthorized is returned for blocks sealed by someone who isn't a signer
+	ErrUnauthorized = errors.New("poa: not an authorized signer")
+	// ErrRecentlySigned is returned for blocks by a signer that sealed one too recently
+	ErrRecentlySigned = errors.New("poa: signer sealed a recent block")
+	// ErrWrongDifficulty is returned for blocks whose difficulty doesn't match the signer's turn
+	ErrWrongDifficulty = errors.New("poa: wrong difficulty")
+	// ErrTooEarly is returned for blocks sealed less than a period after their parent
+	ErrTooEarly = errors.New("poa: block sealed too early")
+	// ErrBadVote is returned for blocks with votes that don't count
+	ErrBadVote = errors.New("poa: invalid vote")
+)
+
+// Verifier makes a chain.Chain check that every block was sealed by an
+// authorized signer that didn't seal too recently, with the difficulty of
+// its turn, no sooner than a period after its parent, and with at most one
+// valid vote. chain already checks the signature.
+type Verifier struct {
+	Snapshots *Snapshots
+}
+
+func (v Verifier) VerifyBlock(b chain.Block, prev []chain.Block) error {
+	parent := prev[len(prev)-1]
+	period := time.Duration(v.Snapshots.Config().Period)
+	if b.Timestamp < parent.Timestamp+int64(period) {
+		return fmt.Errorf("%w: index %d: less than %s after its parent", ErrTooEarly, b.Index, period)
+	}
+	if b.Bits != 0 {
+		return fmt.Errorf("%w: index %d: proof-work bits in a proof-authority block", chain.ErrInvalidBlock, b.Index)
+	}
+	snap, err := v.Snapshots.At(prev)
+	if err != nil {
+		return err
+	}
+	return snap.Clone().Apply(b)
+}
@@ -0,0 +1,270 @@
+package poa
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+
+	"blockchain-go/chain"
+)
+
+// Vote is a signer's standing vote on Address
+type Vote struct {
+	Signer    string
+	Block     int
+	Address   string
+	Authorize bool
+}
+
+// Tally is the standing votes on one address
+type Tally struct {
+	Authorize bool
+	Votes     int
+}
+
+// Snapshot is the proof-authority state after some block: who the signers
+// are, who sealed the recent blocks, and the votes not yet decided. It
+// changes only through blocks, so every node with the same chain has the
+// same snapshot.
+type Snapshot struct {
+	Signers map[string]bool
+	// Recents holds the signer of each of the recent blocks, by index
+	Recents map[int]string
+	Votes   []Vote
+	Tally   map[string]Tally
+
+	config chain.AuthorityConfig
+}
+
+// NewSnapshot returns the snapshot as of the genesis block of g
+func NewSnapshot(g *chain.Genesis) *Snapshot {
+	s := &Snapshot{
+		Signers: make(map[string]bool),
+		Recents: make(map[int]string),
+		Tally:   make(map[string]Tally),
+		config:  g.Authority,
+	}
+	for _, address := range g.Authorities {
+		s.Signers[address] = true
+	}
+	return s
+}
+
+// Clone returns a copy of s that can be changed without touching s
+func (s *Snapshot) Clone() *Snapshot {
+	return &Snapshot{
+		Signers: maps.Clone(s.Signers),
+		Recents: maps.Clone(s.Recents),
+		Votes:   slices.Clone(s.Votes),
+		Tally:   maps.Clone(s.Tally),
+		config:  s.config,
+	}
+}
+
+// SignerList returns the signers in the order they take turns
+func (s *Snapshot) SignerList() []string {
+	signers := make([]string, 0, len(s.Signers))
+	for address := range s.Signers {
+		signers = append(signers, address)
+	}
+	sort.Strings(signers)
+	return signers
+}
+
+// InTurn reports whether it is signer's turn to seal the block at index
+func (s *Snapshot) InTurn(index int, signer string) bool {
+	signers := s.SignerList()
+	return len(signers) > 0 && signers[index%len(signers)] == signer
+}
+
+// Difficulty returns the difficulty of the block at index sealed by signer
+func (s *Snapshot) Difficulty(index int, signer string) uint64 {
+	if s.InTurn(index, signer) {
+		return DiffInTurn
+	}
+	return DiffNoTurn
+}
+
+// limit is how many consecutive blocks a signer may seal only one of
+func (s *Snapshot) limit() int {
+	return len(s.Signers)/2 + 1
+}
+
+// CanSeal reports whether signer may seal the block at index
+func (s *Snapshot) CanSeal(index int, signer string) bool {
+	if !s.Signers[signer] {
+		return false
+	}
+	for seen, recent := range s.Recents {
+		if recent == signer && seen > index-s.limit() {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidVote reports whether a vote on address would change anything
+func (s *Snapshot) ValidVote(address string, authorize bool) bool {
+	return s.Signers[address] != authorize
+}
+
+// Apply moves the snapshot to after b, checking its signer, difficulty
+// and vote. If an error is returned s is left half way, so apply to a
+// Clone.
+func (s *Snapshot) Apply(b chain.Block) error {
+	signer := b.Validator
+	if !s.Signers[signer] {
+		return fmt.Errorf("%w: index %d: %s", ErrUnauthorized, b.Index, signer)
+	}
+	if !s.CanSeal(b.Index, signer) {
+		return fmt.Errorf("%w: index %d: %s", ErrRecentlySigned, b.Index, signer)
+	}
+	if want := s.Difficulty(b.Index, signer); b.Difficulty != want {
+		return fmt.Errorf("%w: index %d: %d, want %d", ErrWrongDifficulty, b.Index, b.Difficulty, want)
+	}
+
+	//only the last limit blocks count as recent
+	delete(s.Recents, b.Index-s.limit())
+	s.Recents[b.Index] = signer
+
+	checkpoint := s.config.Epoch > 0 && b.Index%s.config.Epoch == 0
+	if checkpoint {
+		s.Votes = nil
+		s.Tally = make(map[string]Tally)
+	}
+	if len(b.Txs) == 0 {
+		return nil
+	}
+	if len(b.Txs) > 1 || checkpoint {
+		return fmt.Errorf("%w: index %d: %d votes", ErrBadVote, b.Index, len(b.Txs))
+	}
+	tx := b.Txs[0]
+	if tx.Type != TxAuthorize && tx.Type != TxDeauthorize || tx.From != signer || tx.To == "" {
+		return fmt.Errorf("%w: index %d: %s from %s on %q", ErrBadVote, b.Index, tx.Type, tx.From, tx.To)
+	}
+	authorize := tx.Type == TxAuthorize
+	if !s.ValidVote(tx.To, authorize) {
+		return fmt.Errorf("%w: index %d: %s %s changes nothing", ErrBadVote, b.Index, tx.Type, tx.To)
+	}
+	s.vote(Vote{Signer: signer, Block: b.Index, Address: tx.To, Authorize: authorize})
+	return nil
+}
+
+// vote records v, replacing the signer's earlier vote on the same address,
+// and carries out the vote once more than half of the signers agree
+func (s *Snapshot) vote(v Vote) {
+	s.uncast(v.Signer, v.Address)
+	s.Votes = append(s.Votes, v)
+	tally := s.Tally[v.Address]
+	tally.Authorize = v.Authorize
+	tally.Votes++
+	s.Tally[v.Address] = tally
+	if tally.Votes <= len(s.Signers)/2 {
+		return
+	}
+
+	if v.Authorize {
+		s.Signers[v.Address] = true
+	} else {
+		delete(s.Signers, v.Address)
+		//one signer fewer may let the oldest recent signer seal again
+		delete(s.Recents, v.Block-s.limit())
+		//the votes of a dropped signer no longer count
+		for _, cast := range slices.Clone(s.Votes) {
+			if cast.Signer == v.Address {
+				s.uncast(cast.Signer, cast.Address)
+			}
+		}
+	}
+	//the vote is decided, start over on this address
+	s.Votes = slices.DeleteFunc(s.Votes, func(cast Vote) bool { return cast.Address == v.Address })
+	delete(s.Tally, v.Address)
+}
+
+// uncast drops signer's vote on address, if there is one
+func (s *Snapshot) uncast(signer, address string) {
+	i := slices.IndexFunc(s.Votes, func(v Vote) bool { return v.Signer == signer && v.Address == address })
+	if i < 0 {
+		return
+	}
+	s.Votes = slices.Delete(s.Votes, i, i+1)
+	if tally := s.Tally[address]; tally.Votes > 1 {
+		tally.Votes--
+		s.Tally[address] = tally
+	} else {
+		delete(s.Tally, address)
+	}
+}
+
+// snapshotCacheSize is how many recent snapshots Snapshots keeps
+const snapshotCacheSize = 128
+
+// Snapshots computes the snapshot as of any block. Snapshots of recent
+// blocks are kept by block hash, so the snapshot of a new block is its
+// parent's plus one block.
+type Snapshots struct {
+	genesis *chain.Genesis
+	config  chain.AuthorityConfig
+
+	mu     sync.Mutex
+	byHash map[string]*Snapshot
+	// order is the hashes in byHash, oldest first
+	order []string
+}
+
+// NewSnapshots creates Snapshots for the chain that starts with g
+func NewSnapshots(g *chain.Genesis) *Snapshots {
+	return &Snapshots{genesis: g, config: g.Authority, byHash: make(map[string]*Snapshot)}
+}
+
+// Config returns the proof-authority parameters of the chain
+func (ss *Snapshots) Config() chain.AuthorityConfig {
+	return ss.config
+}
+
+// At returns the snapshot after the last of blocks, which must start with
+// genesis. The snapshot is shared: Clone it before changing it.
+func (ss *Snapshots) At(blocks []chain.Block) (*Snapshot, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	var s *Snapshot
+	i := len(blocks) - 1
+	for ; i >= 0; i-- {
+		if cached, ok := ss.byHash[blocks[i].Hash]; ok {
+			s = cached
+			break
+		}
+	}
+	if i == len(blocks)-1 {
+		return s, nil
+	}
+	if s == nil {
+		//nothing cached on this branch, start over from genesis
+		s, i = NewSnapshot(ss.genesis), 0
+	} else {
+		s = s.Clone()
+	}
+	for _, b := range blocks[i+1:] {
+		if err := s.Apply(b); err != nil {
+			return nil, err
+		}
+	}
+	ss.put(blocks[len(blocks)-1].Hash, s)
+	return s, nil
+}
+
+// put caches s under hash, forgetting the oldest snapshot when full
+func (ss *Snapshots) put(hash string, s *Snapshot) {
+	if _, ok := ss.byHash[hash]; ok {
+		return
+	}
+	if len(ss.order) == snapshotCacheSize {
+		delete(ss.byHash, ss.order[0])
+		ss.order = ss.order[1:]
+	}
+	ss.byHash[hash] = s
+	ss.order = append(ss.order, hash)
+}
@@ -0,0 +1,53 @@
+package pos
+
+import (
+	"time"
+
+	"blockchain-go/chain"
+)
+
+// Clock divides time since genesis into slots of SlotDuration, and slots
+// into epochs of SlotsPerEpoch. Every node reads the same genesis.json, so
+// they all agree on which slot and epoch a timestamp falls in.
+type Clock struct {
+	Genesis       time.Time
+	SlotDuration  time.Duration
+	SlotsPerEpoch int
+}
+
+// NewClock returns the clock of the chain that starts with g
+func NewClock(g *chain.Genesis) Clock {
+	return Clock{
+		Genesis:       g.Timestamp,
+		SlotDuration:  time.Duration(g.Staking.SlotDuration),
+		SlotsPerEpoch: max(g.Staking.EpochLength, 1),
+	}
+}
+
+// Slot returns the slot t falls in. Genesis is in slot 0.
+func (c Clock) Slot(t time.Time) int {
+	if c.SlotDuration <= 0 {
+		return 0
+	}
+	return int(t.Sub(c.Genesis) / c.SlotDuration)
+}
+
+// SlotStart returns when slot begins
+func (c Clock) SlotStart(slot int) time.Time {
+	return c.Genesis.Add(time.Duration(slot) * c.SlotDuration)
+}
+
+// Epoch returns the epoch slot is in
+func (c Clock) Epoch(slot int) int {
+	return slot / c.SlotsPerEpoch
+}
+
+// FirstSlot returns the first slot of epoch
+func (c Clock) FirstSlot(epoch int) int {
+	return epoch * c.SlotsPerEpoch
+}
+
+// BlockSlot returns the slot b was forged in, by its timestamp
+func (c Clock) BlockSlot(b chain.Block) int {
+	return c.Slot(b.Time())
+}
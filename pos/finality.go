@@ -0,0 +1,191 @@
+package pos
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"blockchain-go/chain"
+)
+
+// Vote types of the finality gadget
+const (
+	// VotePrevote says a validator saw a block and found it valid
+	VotePrevote = "prevote"
+	// VotePrecommit says a validator saw more than 2/3 of the stake
+	// prevote a block, and will never vote for another block at its height
+	VotePrecommit = "precommit"
+)
+
+var (
+	// ErrBadVote is returned for votes the gadget can't count
+	ErrBadVote = errors.New("pos: invalid vote")
+	// ErrDoubleVote is returned when a validator votes for two blocks at one height
+	ErrDoubleVote = errors.New("pos: validator voted twice")
+	// ErrNoQuorum is returned for a Certificate without enough precommits
+	ErrNoQuorum = errors.New("pos: not enough stake voted")
+)
+
+// Certificate proves that a block is final: precommits for it from more
+// than 2/3 of the stake of its epoch
+type Certificate struct {
+	Height     int
+	Hash       string
+	Precommits []chain.Vote
+}
+
+// round is the votes of one type at one height
+type round struct {
+	Type   string
+	Height int
+}
+
+// Finality is a Tendermint style voting layer on top of the proof-stake
+// chain. Every validator prevotes for each block it accepts; once more
+// than 2/3 of the stake prevoted for a block, validators precommit to it,
+// and once more than 2/3 precommitted it is final, along with all its
+// ancestors. Two different blocks at one height can't both be final unless
+// more than 1/3 of the stake voted twice.
+//
+// Votes are weighed by the validator set of the epoch the block is in, see
+// Schedule.
+type Finality struct {
+	ledgers *Ledgers
+
+	mu sync.Mutex
+	// votes by round, then by validator
+	votes     map[round]map[string]chain.Vote
+	finalized Certificate
+}
+
+// NewFinality creates a finality gadget for the chain ls computes ledgers of
+func NewFinality(ls *Ledgers) *Finality {
+	return &Finality{ledgers: ls, votes: make(map[round]map[string]chain.Vote)}
+}
+
+// Finalized returns the certificate of the last final block. Height is 0
+// while only genesis is final.
+func (f *Finality) Finalized() Certificate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.finalized
+}
+
+// Voted reports whether validator already cast a vote of type typ at height
+func (f *Finality) Voted(typ string, height int, validator string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.votes[round{typ, height}][validator]
+	return ok
+}
+
+// Add counts v, a vote for a block of blocks, and reports whether its
+// block now has more than 2/3 of the stake behind it for v's type. When
+// that happens for a precommit the block is final and Finalized returns
+// its certificate.
+func (f *Finality) Add(v chain.Vote, blocks []chain.Block) (bool, error) {
+	stakes, err := f.voters(v, blocks)
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if v.Height <= f.finalized.Height {
+		return false, fmt.Errorf("%w: %s for %d, already final up to %d", ErrBadVote, v.Type, v.Height, f.finalized.Height)
+	}
+	r := round{v.Type, v.Height}
+	if f.votes[r] == nil {
+		f.votes[r] = make(map[string]chain.Vote)
+	}
+	if old, ok := f.votes[r][v.Validator]; ok {
+		if old.Hash != v.Hash {
+			return false, fmt.Errorf("%w: %s %s for %d", ErrDoubleVote, v.Validator, v.Type, v.Height)
+		}
+		return false, nil
+	}
+	f.votes[r][v.Validator] = v
+
+	var voters []chain.Vote
+	for _, vote := range f.votes[r] {
+		if vote.Hash == v.Hash {
+			voters = append(voters, vote)
+		}
+	}
+	if !quorum(voters, stakes) {
+		return false, nil
+	}
+	if v.Type == VotePrecommit {
+		f.finalized = Certificate{Height: v.Height, Hash: v.Hash, Precommits: voters}
+		for r := range f.votes {
+			if r.Height <= v.Height {
+				delete(f.votes, r)
+			}
+		}
+	}
+	return true, nil
+}
+
+// Load checks c against blocks and makes it the last final block, e.g.
+// for a certificate saved before a restart
+func (f *Finality) Load(c Certificate, blocks []chain.Block) error {
+	if c.Height == 0 {
+		return nil
+	}
+	loaded := NewFinality(f.ledgers)
+	var final bool
+	for _, v := range c.Precommits {
+		if v.Type != VotePrecommit || v.Height != c.Height || v.Hash != c.Hash {
+			return fmt.Errorf("%w: %s for %d in certificate of %d", ErrBadVote, v.Type, v.Height, c.Height)
+		}
+		ok, err := loaded.Add(v, blocks)
+		if err != nil {
+			return err
+		}
+		final = final || ok
+	}
+	if !final {
+		return fmt.Errorf("%w: certificate of %d", ErrNoQuorum, c.Height)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c.Height > f.finalized.Height {
+		f.finalized = loaded.finalized
+	}
+	return nil
+}
+
+// voters checks v against blocks and returns the validator set its block
+// is voted on by
+func (f *Finality) voters(v chain.Vote, blocks []chain.Block) (*Sampler, error) {
+	if v.Type != VotePrevote && v.Type != VotePrecommit {
+		return nil, fmt.Errorf("%w: unknown type %q", ErrBadVote, v.Type)
+	}
+	if v.Height <= 0 || v.Height >= len(blocks) || blocks[v.Height].Hash != v.Hash {
+		return nil, fmt.Errorf("%w: %s for unknown block %d %s", ErrBadVote, v.Type, v.Height, v.Hash)
+	}
+	if err := chain.VerifyVote(v); err != nil {
+		return nil, err
+	}
+	slot := f.ledgers.Clock().BlockSlot(blocks[v.Height])
+	schedule, err := f.ledgers.Schedule(blocks[:v.Height], slot)
+	if err != nil {
+		return nil, err
+	}
+	if schedule.Stakes.Stake(v.Validator) == 0 {
+		return nil, fmt.Errorf("%w: %s is not a validator in epoch %d", ErrBadVote, v.Validator, schedule.Epoch)
+	}
+	return schedule.Stakes, nil
+}
+
+// quorum reports whether votes come from more than 2/3 of the stake of stakes
+func quorum(votes []chain.Vote, stakes *Sampler) bool {
+	voted := new(big.Int)
+	for _, v := range votes {
+		voted.Add(voted, new(big.Int).SetUint64(stakes.Stake(v.Validator)))
+	}
+	voted.Mul(voted, big.NewInt(3))
+	return voted.Cmp(new(big.Int).Mul(stakes.Total(), big.NewInt(2))) > 0
+}
@@ -0,0 +1,312 @@
+package pos
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+
+	"blockchain-go/chain"
+)
+
+// Transaction types understood by the Ledger
+const (
+	// TxBond stakes Amount of From's balance
+	TxBond = "bond"
+	// TxUnbond unstakes Amount of From's stake. It is only spendable again
+	// after the unbonding period, so a validator can't misbehave and run.
+	TxUnbond = "unbond"
+	// TxTransfer moves Amount of From's balance to To
+	TxTransfer = "transfer"
+	// TxEvidence reports that From signed the two blocks in Evidence at the
+	// same height; From is slashed and jailed for it
+	TxEvidence = "evidence"
+)
+
+var (
+	// ErrBadTx is returned for transactions the ledger can't make sense of
+	ErrBadTx = errors.New("pos: invalid transaction")
+	// ErrBadNonce is returned for transactions out of order or replayed
+	ErrBadNonce = errors.New("pos: wrong transaction nonce")
+	// ErrInsufficientFunds is returned when a transaction moves more than From has
+	ErrInsufficientFunds = errors.New("pos: insufficient funds")
+)
+
+// Unbonding is stake on its way out: it no longer counts for elections but
+// can't be spent before height Release
+type Unbonding struct {
+	Address string
+	Amount  uint64
+	Release int
+}
+
+// Ledger is the proof-stake state after some block: the balance and stake
+// of every address. It starts from genesis.json and changes only through
+// transactions in blocks, so every node with the same chain has the same
+// ledger.
+type Ledger struct {
+	Balances  map[string]uint64
+	Bonded    map[string]uint64
+	Unbonding []Unbonding
+	// Nonces is the number of transactions sent by each address
+	Nonces map[string]uint64
+	// Jailed holds the epoch from which each jailed validator may forge again
+	Jailed map[string]int
+	// Slashed records every address@height already slashed for
+	Slashed map[string]bool
+
+	config chain.StakingConfig
+	clock  Clock
+}
+
+// NewLedger returns the ledger as of the genesis block of g
+func NewLedger(g *chain.Genesis) *Ledger {
+	l := &Ledger{
+		Balances: make(map[string]uint64),
+		Bonded:   make(map[string]uint64),
+		Nonces:   make(map[string]uint64),
+		Jailed:   make(map[string]int),
+		Slashed:  make(map[string]bool),
+		config:   g.Staking,
+		clock:    NewClock(g),
+	}
+	for address, amount := range g.Balances {
+		if amount > 0 {
+			l.Balances[address] = amount
+		}
+	}
+	for address, amount := range g.Validators {
+		if amount > 0 {
+			l.Bonded[address] = amount
+		}
+	}
+	return l
+}
+
+// Clone returns a copy of l that can be changed without touching l
+func (l *Ledger) Clone() *Ledger {
+	return &Ledger{
+		Balances:  maps.Clone(l.Balances),
+		Bonded:    maps.Clone(l.Bonded),
+		Unbonding: append([]Unbonding(nil), l.Unbonding...),
+		Nonces:    maps.Clone(l.Nonces),
+		Jailed:    maps.Clone(l.Jailed),
+		Slashed:   maps.Clone(l.Slashed),
+		config:    l.config,
+		clock:     l.clock,
+	}
+}
+
+// Eligible returns the bonded stake of the validators that may forge in
+// epoch, i.e. that aren't jailed by then
+func (l *Ledger) Eligible(epoch int) map[string]uint64 {
+	eligible := maps.Clone(l.Bonded)
+	for address, until := range l.Jailed {
+		if epoch < until {
+			delete(eligible, address)
+		}
+	}
+	return eligible
+}
+
+// Known reports whether address holds, stakes or is unbonding anything
+func (l *Ledger) Known(address string) bool {
+	if l.Balances[address] > 0 || l.Bonded[address] > 0 {
+		return true
+	}
+	for _, u := range l.Unbonding {
+		if u.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply moves the ledger to after b: stake whose unbonding period ends at
+// b is released and validators whose jail time is over are let out, then
+// the transactions of b are applied in order. If an
+// error is returned l is left half way, so apply to a Clone.
+func (l *Ledger) Apply(b chain.Block) error {
+	epoch := l.clock.Epoch(l.clock.BlockSlot(b))
+	l.release(b.Index)
+	l.unjail(epoch)
+	for _, tx := range b.Txs {
+		if err := l.ApplyTx(tx, b.Index, epoch); err != nil {
+			return fmt.Errorf("index %d: %w", b.Index, err)
+		}
+	}
+	return nil
+}
+
+// release returns unbonded stake that can be spent at height to its owner
+func (l *Ledger) release(height int) {
+	kept := l.Unbonding[:0]
+	for _, u := range l.Unbonding {
+		if u.Release <= height {
+			l.Balances[u.Address] += u.Amount
+		} else {
+			kept = append(kept, u)
+		}
+	}
+	l.Unbonding = kept
+}
+
+// ApplyTx applies a single transaction included at height, in epoch
+func (l *Ledger) ApplyTx(tx chain.Tx, height, epoch int) error {
+	if tx.Type == TxEvidence {
+		return l.slash(tx, epoch)
+	}
+	if tx.From == "" || tx.Amount == 0 {
+		return fmt.Errorf("%w: %s %s", ErrBadTx, tx.Type, tx.Hash())
+	}
+	//only the holder of From's key can move its funds
+	if err := chain.VerifyTx(tx); err != nil {
+		return err
+	}
+	if tx.Nonce != l.Nonces[tx.From] {
+		return fmt.Errorf("%w: %s sent nonce %d, want %d", ErrBadNonce, tx.From, tx.Nonce, l.Nonces[tx.From])
+	}
+
+	switch tx.Type {
+	case TxBond:
+		if err := debit(l.Balances, tx.From, tx.Amount); err != nil {
+			return err
+		}
+		l.Bonded[tx.From] += tx.Amount
+	case TxUnbond:
+		if err := debit(l.Bonded, tx.From, tx.Amount); err != nil {
+			return err
+		}
+		l.Unbonding = append(l.Unbonding, Unbonding{
+			Address: tx.From,
+			Amount:  tx.Amount,
+			Release: height + l.config.UnbondingBlocks,
+		})
+	case TxTransfer:
+		if tx.To == "" || tx.To == tx.From {
+			return fmt.Errorf("%w: transfer from %s to %q", ErrBadTx, tx.From, tx.To)
+		}
+		if err := debit(l.Balances, tx.From, tx.Amount); err != nil {
+			return err
+		}
+		l.Balances[tx.To] += tx.Amount
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrBadTx, tx.Type)
+	}
+	l.Nonces[tx.From]++
+	return nil
+}
+
+// Next returns a copy of l ready for the transactions of the block at
+// height, in epoch: stake whose unbonding period ends there is already
+// released, and validators whose jail time is over are out
+func (l *Ledger) Next(height, epoch int) *Ledger {
+	next := l.Clone()
+	next.release(height)
+	next.unjail(epoch)
+	return next
+}
+
+// Includable returns the transactions of txs that apply, in order, to a
+// block at height, in epoch, on top of l. l is not changed.
+func (l *Ledger) Includable(txs []chain.Tx, height, epoch int) []chain.Tx {
+	next := l.Next(height, epoch)
+	var ok []chain.Tx
+	for _, tx := range txs {
+		if next.ApplyTx(tx, height, epoch) == nil {
+			ok = append(ok, tx)
+		}
+	}
+	return ok
+}
+
+// debit takes amount from m[address], which is left out once it is empty
+func debit(m map[string]uint64, address string, amount uint64) error {
+	if m[address] < amount {
+		return fmt.Errorf("%w: %s has %d, needs %d", ErrInsufficientFunds, address, m[address], amount)
+	}
+	if m[address] -= amount; m[address] == 0 {
+		delete(m, address)
+	}
+	return nil
+}
+
+// ledgerCacheSize is how many recent ledgers Ledgers keeps
+const ledgerCacheSize = 128
+
+// Ledgers computes the ledger as of any block, and the leader schedule of
+// any epoch. Ledgers of recent blocks are kept by block hash, so the
+// ledger of a new block is its parent's plus one block, and after a reorg
+// only the blocks since the fork point are replayed.
+type Ledgers struct {
+	genesis *chain.Genesis
+	clock   Clock
+
+	mu     sync.Mutex
+	byHash map[string]*Ledger
+	// order is the hashes in byHash, oldest first
+	order []string
+	// schedules are kept by boundary block hash and epoch
+	schedules     map[string]*Schedule
+	scheduleOrder []string
+}
+
+// NewLedgers creates Ledgers for the chain that starts with g
+func NewLedgers(g *chain.Genesis) *Ledgers {
+	return &Ledgers{
+		genesis:   g,
+		clock:     NewClock(g),
+		byHash:    make(map[string]*Ledger),
+		schedules: make(map[string]*Schedule),
+	}
+}
+
+// Clock returns the slot clock of the chain
+func (ls *Ledgers) Clock() Clock {
+	return ls.clock
+}
+
+// At returns the ledger after the last of blocks, which must start with
+// genesis. The ledger is shared: Clone it before changing it.
+func (ls *Ledgers) At(blocks []chain.Block) (*Ledger, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	var l *Ledger
+	i := len(blocks) - 1
+	for ; i >= 0; i-- {
+		if cached, ok := ls.byHash[blocks[i].Hash]; ok {
+			l = cached
+			break
+		}
+	}
+	if i == len(blocks)-1 {
+		return l, nil
+	}
+	if l == nil {
+		//nothing cached on this branch, start over from genesis
+		l, i = NewLedger(ls.genesis), 0
+	} else {
+		l = l.Clone()
+	}
+	for _, b := range blocks[i+1:] {
+		if err := l.Apply(b); err != nil {
+			return nil, err
+		}
+	}
+	ls.put(blocks[len(blocks)-1].Hash, l)
+	return l, nil
+}
+
+// put caches l under hash, forgetting the oldest ledger when full
+func (ls *Ledgers) put(hash string, l *Ledger) {
+	if _, ok := ls.byHash[hash]; ok {
+		return
+	}
+	if len(ls.order) == ledgerCacheSize {
+		delete(ls.byHash, ls.order[0])
+		ls.order = ls.order[1:]
+	}
+	ls.byHash[hash] = l
+	ls.order = append(ls.order, hash)
+}
@@ -0,0 +1,144 @@
+// Package pos holds the proof-of-stake rules used by proof-stake: which
+// validator may forge in each slot, and how any node can check that a
+// block came from that validator. The schedule only reads public chain
+// data, so every node that has the same chain agrees on it.
+package pos
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"blockchain-go/chain"
+)
+
+var (
+	// ErrNoStake is returned when nobody has any stake to be elected with
+	ErrNoStake = errors.New("pos: no validator has stake")
+	// ErrWrongLeader is returned for blocks forged by someone other than the slot's proposer
+	ErrWrongLeader = errors.New("pos: block not forged by the slot's proposer")
+	// ErrWrongSlot is returned for blocks not in a later slot than their parent
+	ErrWrongSlot = errors.New("pos: block in wrong slot")
+	// ErrBadReveal is returned for blocks whose reveal doesn't open the validator's last commitment
+	ErrBadReveal = errors.New("pos: reveal does not match commitment")
+	// ErrBadMix is returned for blocks whose mix isn't the parent's mix with the reveal folded in
+	ErrBadMix = errors.New("pos: wrong randao mix")
+)
+
+// Verifier makes a chain.Chain check that every block is in a later slot
+// than its parent, was forged by the proposer its epoch's schedule has for
+// that slot, carries a valid RANDAO reveal, and only has transactions the
+// ledger accepts. Between forks it picks the one with the most stake
+// behind it, see ForkChoice.
+//
+// Whether a block arrived during its slot can only be told as it arrives,
+// not when a chain is synced later, so that is left to the node.
+type Verifier struct {
+	Ledgers *Ledgers
+}
+
+func (v Verifier) VerifyBlock(b chain.Block, prev []chain.Block) error {
+	clock := v.Ledgers.Clock()
+	parent := prev[len(prev)-1]
+	slot := clock.BlockSlot(b)
+	if slot <= clock.BlockSlot(parent) {
+		return fmt.Errorf("%w: index %d: slot %d, parent in slot %d", ErrWrongSlot, b.Index, slot, clock.BlockSlot(parent))
+	}
+	schedule, err := v.Ledgers.Schedule(prev, slot)
+	if err != nil {
+		return err
+	}
+	if proposer := schedule.Proposer(slot); b.Validator != proposer {
+		return fmt.Errorf("%w: index %d: forged by %s, slot %d is for %s", ErrWrongLeader, b.Index, b.Validator, slot, proposer)
+	}
+	if err := CheckReveal(b, prev); err != nil {
+		return err
+	}
+	ledger, err := v.Ledgers.At(prev)
+	if err != nil {
+		return err
+	}
+	return ledger.Clone().Apply(b)
+}
+
+// ForkChoice picks the branch with the most stake behind it. After the
+// last block the two chains share, every block weighs as much as its
+// proposer had at stake in the block's epoch, so a branch forged by a few
+// small validators loses to one forged by the bulk of the stake, even if
+// it has more blocks. Ties keep the current chain.
+func (v Verifier) ForkChoice(current, candidate []chain.Block) bool {
+	fork := chain.ForkPoint(current, candidate)
+	return v.weight(candidate, fork).Cmp(v.weight(current, fork)) > 0
+}
+
+// weight sums the stake of the proposers of blocks after index fork
+func (v Verifier) weight(blocks []chain.Block, fork int) *big.Int {
+	clock := v.Ledgers.Clock()
+	weight := new(big.Int)
+	for i := fork + 1; i < len(blocks); i++ {
+		schedule, err := v.Ledgers.Schedule(blocks[:i], clock.BlockSlot(blocks[i]))
+		if err != nil {
+			continue
+		}
+		weight.Add(weight, new(big.Int).SetUint64(schedule.Stakes.Stake(blocks[i].Validator)))
+	}
+	return weight
+}
+
+// Mix returns the RANDAO mix as of b. Genesis has none, so the mix starts
+// from the genesis hash.
+func Mix(b chain.Block) string {
+	if b.Mix == "" {
+		return b.Hash
+	}
+	return b.Mix
+}
+
+// NextMix folds reveal into the mix of parent
+func NextMix(parent chain.Block, reveal string) string {
+	if reveal == "" {
+		return Mix(parent)
+	}
+	hashed := sha256.Sum256([]byte(Mix(parent) + reveal))
+	return hex.EncodeToString(hashed[:])
+}
+
+// Commit returns the commitment to secret, which is published a block
+// before secret itself
+func Commit(secret string) string {
+	hashed := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hashed[:])
+}
+
+// LastForged returns the last block in blocks forged by validator, whose
+// commitment the next one has to reveal
+func LastForged(blocks []chain.Block, validator string) (chain.Block, bool) {
+	for i := len(blocks) - 1; i > 0; i-- {
+		if blocks[i].Validator == validator {
+			return blocks[i], true
+		}
+	}
+	return chain.Block{}, false
+}
+
+// CheckReveal checks the RANDAO fields of b, whose ancestors are prev. A
+// validator that forged before must reveal the secret it committed to
+// then, and every block must commit to a new secret.
+func CheckReveal(b chain.Block, prev []chain.Block) error {
+	if len(b.Commit) != sha256.Size*2 {
+		return fmt.Errorf("%w: index %d: no commitment", ErrBadReveal, b.Index)
+	}
+	if last, ok := LastForged(prev, b.Validator); ok {
+		if Commit(b.Reveal) != last.Commit {
+			return fmt.Errorf("%w: index %d", ErrBadReveal, b.Index)
+		}
+	} else if b.Reveal != "" {
+		return fmt.Errorf("%w: index %d: nothing to reveal", ErrBadReveal, b.Index)
+	}
+	if b.Mix != NextMix(prev[len(prev)-1], b.Reveal) {
+		return fmt.Errorf("%w: index %d", ErrBadMix, b.Index)
+	}
+	return nil
+}
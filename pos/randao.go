@@ -0,0 +1,62 @@
+package pos
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+
+	"blockchain-go/chain"
+)
+
+// ErrNoRandaoKey is returned by CheckRandaoKey for a node with validator
+// keys but no RANDAO key
+var ErrNoRandaoKey = errors.New("pos: no RANDAO key for the validator keys, set RANDAO_KEY to 32 random bytes in hex")
+
+// Secrets derives the RANDAO secrets of the validators a node forges for
+// from one private key, so that after a restart the node can still reveal
+// what it committed to without having stored anything.
+type Secrets struct {
+	key []byte
+}
+
+// CheckRandaoKey checks that a node forging for validators validators has
+// a RANDAO key. Without the key a validator can't reveal what it committed
+// to before a restart and misses its slots, so the node must not start
+// forging without one. A node with no validator keys never forges and
+// doesn't need it.
+func CheckRandaoKey(validators int, key []byte) error {
+	if validators > 0 && len(key) == 0 {
+		return ErrNoRandaoKey
+	}
+	return nil
+}
+
+// NewSecrets creates Secrets from a private key
+func NewSecrets(key []byte) *Secrets {
+	return &Secrets{key: key}
+}
+
+// Secret returns the secret committed to in the block at index forged by
+// validator
+func (s *Secrets) Secret(validator string, index int) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(validator))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(index)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Forge fills in the RANDAO fields of b, forged on top of prev by the
+// validator holding key, and signs it
+func (s *Secrets) Forge(b *chain.Block, prev []chain.Block, key ed25519.PrivateKey) {
+	validator := chain.Address(key.Public().(ed25519.PublicKey))
+	b.Commit = Commit(s.Secret(validator, b.Index))
+	b.Reveal = ""
+	if last, ok := LastForged(prev, validator); ok {
+		b.Reveal = s.Secret(validator, last.Index)
+	}
+	b.Mix = NextMix(prev[len(prev)-1], b.Reveal)
+	b.Sign(key)
+}
@@ -0,0 +1,97 @@
+package pos
+
+import (
+	"math/big"
+	"math/bits"
+	"sort"
+)
+
+// Sampler picks validators with probability proportional to their stake.
+//
+// It keeps one running total per validator, so memory grows with the
+// number of validators and not with how much they stake, and a pick is a
+// binary search over the totals. Stakes are uint64 and the totals 128 bits
+// wide, so not even 2^64 validators each staking the maximum can overflow.
+//
+// An alias table would pick in O(1), but it is built with floating point
+// probabilities, and every node has to pick exactly the same validator.
+type Sampler struct {
+	addresses []string
+	// cumulative[i] is the stake of addresses[0..i], as hi, lo words
+	cumulative [][2]uint64
+	total      *big.Int
+}
+
+// NewSampler builds a Sampler over stakes. Validators with no stake are
+// left out.
+func NewSampler(stakes map[string]uint64) *Sampler {
+	s := &Sampler{addresses: make([]string, 0, len(stakes))}
+	for address, stake := range stakes {
+		if stake > 0 {
+			s.addresses = append(s.addresses, address)
+		}
+	}
+	//map order is random, so sum the validators in a fixed order
+	sort.Strings(s.addresses)
+
+	s.cumulative = make([][2]uint64, len(s.addresses))
+	var hi, lo, carry uint64
+	for i, address := range s.addresses {
+		lo, carry = bits.Add64(lo, stakes[address], 0)
+		hi += carry
+		s.cumulative[i] = [2]uint64{hi, lo}
+	}
+	s.total = uint128(hi, lo)
+	return s
+}
+
+// Len returns the number of validators with stake
+func (s *Sampler) Len() int {
+	return len(s.addresses)
+}
+
+// Total returns the sum of all stakes
+func (s *Sampler) Total() *big.Int {
+	return new(big.Int).Set(s.total)
+}
+
+// Stake returns the stake of address, 0 if it has none
+func (s *Sampler) Stake(address string) uint64 {
+	i := sort.SearchStrings(s.addresses, address)
+	if i == len(s.addresses) || s.addresses[i] != address {
+		return 0
+	}
+	stake := s.cumulative[i][1]
+	if i > 0 {
+		//the stake is the step between running totals, which never exceeds 2^64
+		stake -= s.cumulative[i-1][1]
+	}
+	return stake
+}
+
+// Pick returns the validator that seed falls on. Each validator owns a
+// range of the stake total as wide as its stake, and seed, read as a
+// number modulo the total, lands in exactly one of them.
+func (s *Sampler) Pick(seed []byte) (string, error) {
+	if s.total.Sign() == 0 {
+		return "", ErrNoStake
+	}
+	ticket := new(big.Int).SetBytes(seed)
+	ticket.Mod(ticket, s.total)
+	hi := new(big.Int).Rsh(ticket, 64).Uint64()
+	lo := ticket.And(ticket, maxUint64).Uint64()
+
+	i := sort.Search(len(s.cumulative), func(i int) bool {
+		c := s.cumulative[i]
+		return c[0] > hi || c[0] == hi && c[1] > lo
+	})
+	return s.addresses[i], nil
+}
+
+var maxUint64 = new(big.Int).SetUint64(^uint64(0))
+
+func uint128(hi, lo uint64) *big.Int {
+	n := new(big.Int).SetUint64(hi)
+	n.Lsh(n, 64)
+	return n.Or(n, new(big.Int).SetUint64(lo))
+}
@@ -0,0 +1,62 @@
+package pos
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"runtime"
+	"testing"
+)
+
+// stakes returns n validators, each staking close to the maximum uint64
+func stakes(n int) map[string]uint64 {
+	m := make(map[string]uint64, n)
+	for i := 0; i < n; i++ {
+		hashed := sha256.Sum256(binary.BigEndian.AppendUint64(nil, uint64(i)))
+		m[fmt.Sprintf("%x", hashed)] = math.MaxUint64 - uint64(i)
+	}
+	return m
+}
+
+func heap() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// BenchmarkSampler builds samplers over up to a million validators and
+// picks from them, and reports how much memory a sampler holds. Run it with
+//
+//	go test ./pos -run '^$' -bench Sampler
+func BenchmarkSampler(b *testing.B) {
+	for _, n := range []int{1_000, 100_000, 1_000_000} {
+		validators := stakes(n)
+
+		b.Run(fmt.Sprintf("NewSampler/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			before := heap()
+			s := NewSampler(validators)
+			held := heap() - before
+			runtime.KeepAlive(s)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				NewSampler(validators)
+			}
+			b.ReportMetric(float64(held)/(1<<20), "MiB-held")
+		})
+
+		s := NewSampler(validators)
+		b.Run(fmt.Sprintf("Pick/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			seed := make([]byte, 32)
+			for i := 0; i < b.N; i++ {
+				binary.BigEndian.PutUint64(seed, uint64(i))
+				if _, err := s.Pick(seed); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package pos
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"blockchain-go/chain"
+)
+
+// Schedule is the validator set of an epoch and the proposer of each of
+// its slots. It is worked out once, at the epoch boundary, from the ledger
+// and RANDAO mix of the last block before the epoch, so stake that moves
+// during an epoch only counts from the next one.
+type Schedule struct {
+	Epoch     int
+	FirstSlot int
+	// Stakes is the validator set of the epoch
+	Stakes *Sampler
+	// Proposers has the proposer of every slot of the epoch, in order
+	Proposers []string
+}
+
+// Proposer returns the validator that may forge in slot
+func (s *Schedule) Proposer(slot int) string {
+	if slot < s.FirstSlot || slot >= s.FirstSlot+len(s.Proposers) {
+		return ""
+	}
+	return s.Proposers[slot-s.FirstSlot]
+}
+
+// EpochSeed returns the seed the schedule of epoch is drawn with: the hash
+// of the RANDAO mix as of boundary, the last block before the epoch, and
+// the epoch number.
+//
+// The boundary block's hash itself is left out on purpose: its forger
+// could try many timestamps until the hash elects them again. The mix only
+// moves by reveals, which were fixed when they were committed to.
+func EpochSeed(boundary chain.Block, epoch int) []byte {
+	h := sha256.New()
+	h.Write([]byte(Mix(boundary)))
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(epoch)))
+	return h.Sum(nil)
+}
+
+// NewSchedule draws the schedule of epoch from ledger and boundary, the
+// last block before the epoch. Every slot's proposer is picked with
+// probability proportional to its stake.
+func NewSchedule(clock Clock, ledger *Ledger, boundary chain.Block, epoch int) (*Schedule, error) {
+	s := &Schedule{
+		Epoch:     epoch,
+		FirstSlot: clock.FirstSlot(epoch),
+		Stakes:    NewSampler(ledger.Eligible(epoch)),
+		Proposers: make([]string, clock.SlotsPerEpoch),
+	}
+	seed := EpochSeed(boundary, epoch)
+	for i := range s.Proposers {
+		h := sha256.New()
+		h.Write(seed)
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(s.FirstSlot+i)))
+		proposer, err := s.Stakes.Pick(h.Sum(nil))
+		if err != nil {
+			return nil, fmt.Errorf("epoch %d: %w", epoch, err)
+		}
+		s.Proposers[i] = proposer
+	}
+	return s, nil
+}
+
+// scheduleCacheSize is how many schedules Ledgers keeps
+const scheduleCacheSize = 16
+
+// Schedule returns the schedule of the epoch slot is in, for a block
+// whose ancestors are prev (its parent last)
+func (ls *Ledgers) Schedule(prev []chain.Block, slot int) (*Schedule, error) {
+	epoch := ls.clock.Epoch(slot)
+	first := ls.clock.FirstSlot(epoch)
+	i := len(prev) - 1
+	for i > 0 && ls.clock.BlockSlot(prev[i]) >= first {
+		i--
+	}
+	boundary := prev[:i+1]
+
+	key := fmt.Sprintf("%s/%d", boundary[i].Hash, epoch)
+	ls.mu.Lock()
+	s, ok := ls.schedules[key]
+	ls.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	ledger, err := ls.At(boundary)
+	if err != nil {
+		return nil, err
+	}
+	if s, err = NewSchedule(ls.clock, ledger, boundary[i], epoch); err != nil {
+		return nil, err
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if len(ls.scheduleOrder) == scheduleCacheSize {
+		delete(ls.schedules, ls.scheduleOrder[0])
+		ls.scheduleOrder = ls.scheduleOrder[1:]
+	}
+	if _, ok := ls.schedules[key]; !ok {
+		ls.schedules[key] = s
+		ls.scheduleOrder = append(ls.scheduleOrder, key)
+	}
+	return s, nil
+}
@@ -0,0 +1,102 @@
+package pos
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+
+	"blockchain-go/chain"
+)
+
+// ErrBadEvidence is returned for evidence transactions that don't prove
+// a validator signed two blocks at the same height
+var ErrBadEvidence = errors.New("pos: invalid equivocation evidence")
+
+// NewEvidence builds the transaction reporting that the validator of a and
+// b signed both. Evidence proves itself, so anyone may send it and it is
+// neither signed nor numbered.
+func NewEvidence(a, b chain.Block) chain.Tx {
+	tx := chain.Tx{Type: TxEvidence, From: a.Validator}
+	for _, header := range []chain.Block{a, b} {
+		//only the signed header is evidence
+		header.Txs, header.ChainWork = nil, ""
+		tx.Evidence = append(tx.Evidence, header)
+	}
+	return tx
+}
+
+// CheckEvidence checks that tx holds two different headers for the same
+// height, both signed by tx.From
+func CheckEvidence(tx chain.Tx) error {
+	if len(tx.Evidence) != 2 {
+		return fmt.Errorf("%w: want 2 headers, got %d", ErrBadEvidence, len(tx.Evidence))
+	}
+	a, b := tx.Evidence[0], tx.Evidence[1]
+	if a.Index != b.Index {
+		return fmt.Errorf("%w: heights %d and %d", ErrBadEvidence, a.Index, b.Index)
+	}
+	if a.Validator != tx.From || b.Validator != tx.From {
+		return fmt.Errorf("%w: headers not forged by %s", ErrBadEvidence, tx.From)
+	}
+	if chain.CalculateHash(a) == chain.CalculateHash(b) {
+		return fmt.Errorf("%w: same header twice", ErrBadEvidence)
+	}
+	for _, header := range tx.Evidence {
+		if err := chain.VerifySignature(header); err != nil {
+			return fmt.Errorf("%w: %v", ErrBadEvidence, err)
+		}
+	}
+	return nil
+}
+
+// slash burns SlashPercent of the bonded and unbonding stake of the
+// validator tx proves signed twice, and jails it until JailEpochs whole
+// epochs after epoch, the one tx is included in, have passed
+func (l *Ledger) slash(tx chain.Tx, epoch int) error {
+	if err := CheckEvidence(tx); err != nil {
+		return err
+	}
+	offender := tx.From
+	offense := fmt.Sprintf("%s@%d", offender, tx.Evidence[0].Index)
+	if l.Slashed[offense] {
+		return fmt.Errorf("%w: %s already slashed", ErrBadEvidence, offense)
+	}
+
+	var burned uint64
+	if stake := l.Bonded[offender]; stake > 0 {
+		cut := percent(stake, l.config.SlashPercent)
+		debit(l.Bonded, offender, cut)
+		burned += cut
+	}
+	//unbonding stake is still at stake, that is what the unbonding period is for
+	for i, u := range l.Unbonding {
+		if u.Address == offender {
+			cut := percent(u.Amount, l.config.SlashPercent)
+			l.Unbonding[i].Amount -= cut
+			burned += cut
+		}
+	}
+	if burned == 0 && l.Bonded[offender] == 0 {
+		return fmt.Errorf("%w: %s has no stake left to slash", ErrBadEvidence, offender)
+	}
+
+	l.Slashed[offense] = true
+	l.Jailed[offender] = epoch + l.config.JailEpochs + 1
+	return nil
+}
+
+// unjail forgets the validators whose jail time is over by epoch
+func (l *Ledger) unjail(epoch int) {
+	for address, until := range l.Jailed {
+		if epoch >= until {
+			delete(l.Jailed, address)
+		}
+	}
+}
+
+// percent returns p percent of amount, rounded down, without overflowing
+func percent(amount uint64, p int) uint64 {
+	hi, lo := bits.Mul64(amount, uint64(p))
+	q, _ := bits.Div64(hi, lo, 100)
+	return q
+}
@@ -0,0 +1,123 @@
+package pow
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"blockchain-go/chain"
+)
+
+// checkEvery is how many nonces a worker tries between looks at its context
+const checkEvery = 1 << 12
+
+// Miner searches the nonce space of a block with several worker goroutines.
+// Worker i of n tries nonces i, i+n, i+2n, ... so no two workers ever hash
+// the same header.
+type Miner struct {
+	workers int
+	hashes  atomic.Uint64
+	// rate holds the float64 bits of the last measured hashrate
+	rate atomic.Uint64
+}
+
+// NewMiner creates a Miner with the given number of workers, or one per CPU
+// if workers is 0
+func NewMiner(workers int) *Miner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &Miner{workers: workers}
+}
+
+// Workers returns the number of worker goroutines
+func (m *Miner) Workers() int {
+	return m.workers
+}
+
+// Hashes returns the number of hashes tried so far
+func (m *Miner) Hashes() uint64 {
+	return m.hashes.Load()
+}
+
+// Hashrate returns hashes per second, measured over the last second of mining
+func (m *Miner) Hashrate() float64 {
+	return math.Float64frombits(m.rate.Load())
+}
+
+// Mine looks for a nonce that puts the hash of template below its target.
+// Bits must already be filled in. It returns the sealed block, or ctx.Err()
+// if ctx is cancelled first, e.g. because a competing block arrived.
+func (m *Miner) Mine(ctx context.Context, template chain.Block) (chain.Block, error) {
+	target := chain.CompactToBig(template.Bits)
+	if target.Sign() <= 0 || target.Cmp(PowLimit) > 0 {
+		return chain.Block{}, ErrBadTarget
+	}
+
+	targetHex := fmt.Sprintf("%064x", target)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(chan chain.Block, m.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < m.workers; i++ {
+		wg.Add(1)
+		go func(start uint64) {
+			defer wg.Done()
+			b := template
+			var tried uint64
+			for nonce := start; ; nonce += uint64(m.workers) {
+				b.Nonce = nonce
+				b.Hash = chain.CalculateHash(b)
+				tried++
+				// both are 64 lowercase hex digits, so comparing the strings
+				// compares the numbers without a big.Int per hash
+				if b.Hash < targetHex {
+					m.hashes.Add(tried % checkEvery)
+					found <- b
+					cancel()
+					return
+				}
+				if tried%checkEvery == 0 {
+					m.hashes.Add(checkEvery)
+					if ctx.Err() != nil {
+						return
+					}
+				}
+			}
+		}(uint64(i))
+	}
+
+	go m.measure(ctx)
+	wg.Wait()
+
+	select {
+	case b := <-found:
+		return b, nil
+	default:
+		return chain.Block{}, ctx.Err()
+	}
+}
+
+// measure updates the hashrate once a second until ctx is done
+func (m *Miner) measure(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last, lastTime := m.hashes.Load(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			hashes := m.hashes.Load()
+			rate := float64(hashes-last) / now.Sub(lastTime).Seconds()
+			m.rate.Store(math.Float64bits(rate))
+			last, lastTime = hashes, now
+		}
+	}
+}
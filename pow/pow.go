@@ -0,0 +1,56 @@
+// Package pow holds the proof-of-work rules used by proof-work: a block is
+// valid when its hash, read as a 256-bit number, is below the target
+// encoded in its Bits.
+package pow
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"blockchain-go/chain"
+)
+
+// PowLimitBits is the easiest target a block may ask for
+const PowLimitBits = 0x207fffff
+
+var (
+	// PowLimit is PowLimitBits as a number
+	PowLimit = chain.CompactToBig(PowLimitBits)
+
+	// ErrBadTarget is returned for blocks whose Bits don't encode a usable target
+	ErrBadTarget = errors.New("pow: target out of range")
+	// ErrHighHash is returned for blocks whose hash is not below their target
+	ErrHighHash = errors.New("pow: hash is not below target")
+)
+
+// HashToBig reads a hex block hash as a big-endian 256-bit number
+func HashToBig(hash string) (*big.Int, bool) {
+	return new(big.Int).SetString(hash, 16)
+}
+
+// CheckProofOfWork checks that the hash of b is numerically below its target
+func CheckProofOfWork(b chain.Block) error {
+	target := chain.CompactToBig(b.Bits)
+	if target.Sign() <= 0 || target.Cmp(PowLimit) > 0 {
+		return fmt.Errorf("%w: index %d: bits %08x", ErrBadTarget, b.Index, b.Bits)
+	}
+	hash, ok := HashToBig(b.Hash)
+	if !ok || hash.Cmp(target) >= 0 {
+		return fmt.Errorf("%w: index %d", ErrHighHash, b.Index)
+	}
+	return nil
+}
+
+// Verifier makes a chain.Chain check proof of work on every block. Bits
+// are recomputed with Retarget and must match what the block carries.
+type Verifier struct {
+	Retarget Retargeter
+}
+
+func (v Verifier) VerifyBlock(b chain.Block, prev []chain.Block) error {
+	if want := v.Retarget.NextBits(prev); b.Bits != want {
+		return fmt.Errorf("%w: index %d: bits %08x, want %08x", ErrBadTarget, b.Index, b.Bits, want)
+	}
+	return CheckProofOfWork(b)
+}
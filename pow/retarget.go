@@ -0,0 +1,178 @@
+package pow
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"blockchain-go/chain"
+)
+
+// A Retargeter decides the target of the next block from the chain so far,
+// so that blocks keep coming at TargetSpacing whatever the hashrate. Miners
+// use it to fill in Bits and validators to check them.
+type Retargeter interface {
+	// NextBits returns the Bits of the block after prev (its parent last)
+	NextBits(prev []chain.Block) uint32
+}
+
+// NewRetargeter builds the Retargeter described by cfg
+func NewRetargeter(cfg chain.RetargetConfig) (Retargeter, error) {
+	spacing := time.Duration(cfg.TargetSpacing)
+	if cfg.Algorithm != "" && spacing <= 0 {
+		return nil, fmt.Errorf("pow: retarget %q needs a target spacing", cfg.Algorithm)
+	}
+	switch cfg.Algorithm {
+	case "":
+		return Fixed{}, nil
+	case "bitcoin":
+		if cfg.Window < 1 {
+			return nil, fmt.Errorf("pow: retarget %q needs a window", cfg.Algorithm)
+		}
+		return Bitcoin{Spacing: spacing, Interval: cfg.Window}, nil
+	case "lwma":
+		if cfg.Window < 1 {
+			return nil, fmt.Errorf("pow: retarget %q needs a window", cfg.Algorithm)
+		}
+		return LWMA{Spacing: spacing, Window: cfg.Window}, nil
+	case "asert":
+		if time.Duration(cfg.HalfLife) < time.Second || spacing < time.Second {
+			return nil, fmt.Errorf("pow: retarget %q needs a half life and spacing of at least 1s", cfg.Algorithm)
+		}
+		return ASERT{Spacing: spacing, HalfLife: time.Duration(cfg.HalfLife)}, nil
+	}
+	return nil, fmt.Errorf("pow: unknown retarget algorithm %q", cfg.Algorithm)
+}
+
+// Fixed keeps the target of genesis forever
+type Fixed struct{}
+
+func (Fixed) NextBits(prev []chain.Block) uint32 {
+	return prev[len(prev)-1].Bits
+}
+
+// Bitcoin retargets every Interval blocks, scaling the target by how long
+// the last Interval blocks actually took against how long they should have
+// taken. A single step never moves the target more than 4x either way.
+type Bitcoin struct {
+	Spacing  time.Duration
+	Interval int
+}
+
+func (r Bitcoin) NextBits(prev []chain.Block) uint32 {
+	parent := prev[len(prev)-1]
+	if (parent.Index+1)%r.Interval != 0 {
+		return parent.Bits
+	}
+
+	first := max(len(prev)-1-r.Interval, 0)
+	expected := int64(r.Spacing) * int64(len(prev)-1-first)
+	if expected == 0 {
+		return parent.Bits
+	}
+	actual := parent.Timestamp - prev[first].Timestamp
+	actual = min(max(actual, expected/4), expected*4)
+
+	target := chain.CompactToBig(parent.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	return clampTarget(target)
+}
+
+// LWMA is a linearly weighted moving average over the last Window blocks
+// (zawy12's LWMA-1): recent solve times weigh more, so it reacts within a
+// few blocks instead of waiting for the next retarget boundary.
+type LWMA struct {
+	Spacing time.Duration
+	Window  int
+}
+
+func (r LWMA) NextBits(prev []chain.Block) uint32 {
+	n := min(r.Window, len(prev)-1)
+	if n < 1 {
+		return prev[len(prev)-1].Bits
+	}
+
+	T := int64(r.Spacing)
+	var weighted int64
+	sumTarget := new(big.Int)
+	start := len(prev) - n
+	for i := start; i < len(prev); i++ {
+		// solve times are clamped so one lying timestamp can't swing the target
+		solveTime := min(max(prev[i].Timestamp-prev[i-1].Timestamp, 1), 6*T)
+		weighted += solveTime * int64(i-start+1)
+		sumTarget.Add(sumTarget, chain.CompactToBig(prev[i].Bits))
+	}
+
+	// next = avgTarget * weighted / (T * n(n+1)/2)
+	target := sumTarget.Mul(sumTarget, big.NewInt(weighted))
+	target.Div(target, big.NewInt(int64(n)))
+	target.Div(target, new(big.Int).Mul(big.NewInt(T), big.NewInt(int64(n)*int64(n+1)/2)))
+	return clampTarget(target)
+}
+
+// ASERT (absolutely scheduled exponentially rising targets, aserti3-2d from
+// Bitcoin Cash) keeps the chain on a schedule of one block every Spacing:
+// for every HalfLife the chain is behind schedule the target doubles, and
+// for every HalfLife ahead it halves. Only the anchor and the parent are
+// read.
+//
+// The anchor is block 1, the first mined block, which gets the genesis
+// target. The schedule starts from its timestamp rather than from genesis,
+// which is often written long before anyone mines: anchored at genesis,
+// the chain would start hopelessly behind and the target stay at PowLimit
+// until it caught up.
+type ASERT struct {
+	Spacing  time.Duration
+	HalfLife time.Duration
+}
+
+var asertRadix = big.NewInt(1 << 16)
+
+func (r ASERT) NextBits(prev []chain.Block) uint32 {
+	if len(prev) < 2 {
+		return prev[0].Bits
+	}
+	anchor, parent := prev[1], prev[len(prev)-1]
+
+	// 16.16 fixed point, in seconds so the products can't overflow
+	timeDelta := (parent.Timestamp - anchor.Timestamp) / int64(time.Second)
+	heightDelta := int64(parent.Index - anchor.Index)
+	spacing := int64(r.Spacing / time.Second)
+	exponent := (timeDelta - spacing*heightDelta) * 65536 / int64(r.HalfLife/time.Second)
+
+	shifts := exponent >> 16
+	frac := big.NewInt(exponent - shifts*65536)
+	// 2^frac ~= 1 + 0.695502049*frac + 0.2262698*frac^2 + 0.0782318*frac^3
+	factor := new(big.Int).Mul(big.NewInt(195766423245049), frac)
+	frac2 := new(big.Int).Mul(frac, frac)
+	factor.Add(factor, new(big.Int).Mul(big.NewInt(971821376), frac2))
+	factor.Add(factor, new(big.Int).Mul(big.NewInt(5127), frac2.Mul(frac2, frac)))
+	factor.Add(factor, new(big.Int).Lsh(big.NewInt(1), 47))
+	factor.Rsh(factor, 48)
+	factor.Add(factor, asertRadix)
+
+	if shifts > 256 {
+		// hopelessly behind schedule, anything goes
+		return PowLimitBits
+	}
+	target := chain.CompactToBig(anchor.Bits)
+	target.Mul(target, factor)
+	if shifts -= 16; shifts < 0 {
+		target.Rsh(target, uint(-shifts))
+	} else {
+		target.Lsh(target, uint(shifts))
+	}
+	return clampTarget(target)
+}
+
+// clampTarget keeps a computed target between 1 and PowLimit
+func clampTarget(target *big.Int) uint32 {
+	if target.Sign() <= 0 {
+		target = big.NewInt(1)
+	}
+	if target.Cmp(PowLimit) > 0 {
+		target = PowLimit
+	}
+	return chain.BigToCompact(target)
+}
@@ -0,0 +1,40 @@
+package pow
+
+import (
+	"time"
+
+	"blockchain-go/chain"
+)
+
+// Intervals summarises the time between consecutive blocks
+type Intervals struct {
+	Count int
+	Mean  time.Duration
+	Min   time.Duration
+	Max   time.Duration
+	Last  time.Duration
+}
+
+// IntervalStats summarises the intervals between the last n+1 blocks
+func IntervalStats(blocks []chain.Block, n int) Intervals {
+	n = min(n, len(blocks)-1)
+	var s Intervals
+	if n < 1 {
+		return s
+	}
+	var total time.Duration
+	for i := len(blocks) - n; i < len(blocks); i++ {
+		d := time.Duration(blocks[i].Timestamp - blocks[i-1].Timestamp)
+		if s.Count == 0 || d < s.Min {
+			s.Min = d
+		}
+		if d > s.Max {
+			s.Max = d
+		}
+		total += d
+		s.Count++
+		s.Last = d
+	}
+	s.Mean = total / time.Duration(s.Count)
+	return s
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"blockchain-go/chain"
+	"blockchain-go/pos"
+)
+
+// finality collects the prevotes and precommits of the validators, a block
+// more than 2/3 of the stake precommitted to can never be reverted
+var finality *pos.Finality
+
+// finalityFile keeps the certificate of the last final block next to
+// CHAIN_FILE, so finality survives a restart. Empty if the chain is in memory.
+var finalityFile string
+
+// vote casts the votes of the validators with a key on this node for the
+// block at height: first a prevote, then, once more than 2/3 of the stake
+// prevoted for the block, a precommit
+func vote(height int) {
+	blocks := Blockchain.Blocks()
+	if height >= len(blocks) {
+		return
+	}
+	schedule, err := ledgers.Schedule(blocks[:height], ledgers.Clock().BlockSlot(blocks[height]))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, typ := range []string{pos.VotePrevote, pos.VotePrecommit} {
+		quorum := false
+		for address, key := range keys {
+			//only the validator set of the block's epoch votes on it
+			if schedule.Stakes.Stake(address) == 0 || finality.Voted(typ, height, address) {
+				continue
+			}
+			v := chain.Vote{Type: typ, Height: height, Hash: blocks[height].Hash}
+			v.Sign(key)
+			ok, err := finality.Add(v, blocks)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			quorum = quorum || ok
+		}
+		//不到2/3的stake prevote，就不能precommit
+		if !quorum {
+			return
+		}
+	}
+	finalize()
+}
+
+// finalize makes the block finality just finalized final in Blockchain,
+// saves its certificate and tells the clients
+func finalize() {
+	cert := finality.Finalized()
+	if err := Blockchain.Finalize(cert.Height, cert.Hash); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := saveCertificate(cert); err != nil {
+		log.Println(err)
+	}
+	log.Printf("block %d %s is final, %d precommits", cert.Height, cert.Hash, len(cert.Precommits))
+	mutex.Lock()
+	n := clients
+	mutex.Unlock()
+	for i := 0; i < n; i++ {
+		announcements <- fmt.Sprintf("\nfinalized block %d\n", cert.Height)
+	}
+}
+
+// describeFinalized shows the last final block
+func describeFinalized() string {
+	cert := finality.Finalized()
+	final := Blockchain.Finalized()
+	return fmt.Sprintf("\nfinalized block %d %s, %d precommits, tip %d\n",
+		final.Index, final.Hash, len(cert.Precommits), Blockchain.Tip().Index)
+}
+
+// saveCertificate writes cert to finalityFile, replacing the old one in
+// one rename
+func saveCertificate(cert pos.Certificate) error {
+	if finalityFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(cert)
+	if err != nil {
+		return err
+	}
+	tmp := finalityFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, finalityFile)
+}
+
+// loadCertificate checks the certificate in finalityFile, if there is one,
+// and finalizes its block again
+func loadCertificate() error {
+	if finalityFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(finalityFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var cert pos.Certificate
+	if err := json.Unmarshal(data, &cert); err != nil {
+		return fmt.Errorf("%s: %w", finalityFile, err)
+	}
+	if err := finality.Load(cert, Blockchain.Blocks()); err != nil {
+		return fmt.Errorf("%s: %w", finalityFile, err)
+	}
+	return Blockchain.Finalize(cert.Height, cert.Hash)
+}
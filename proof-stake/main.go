@@ -7,18 +7,22 @@ Proof of Stake 执行流程
 │   ├── 创建创世区块
 │   ├── 启动TCP服务器 (端口9000)
 │   ├── 启动后台服务
-│   │   ├── 候选区块处理器 (从candidateBlocks通道读取)
-│   │   └── 获胜者选择器 (每30秒执行一次)
+│   │   ├── 候选区块处理器 (从candidateBlocks通道读取，同一高度签了两个区块就提交evidence)
+│   │   └── 获胜者选择器 (每个slot结束时执行一次)
+│   ├── 从CHAIN_FILE.final恢复最终确定的区块
 │   └── 等待客户端连接
 │
 ├── 客户端连接处理 (handleConn)
 │   ├── 启动公告广播器
 │   ├── 验证者注册
-│   │   ├── 要求输入代币余额
-│   │   └── 生成验证者地址并存储到validators映射
+│   │   ├── 要求输入验证者地址
+│   │   ├── 地址是ed25519公钥 (go run main.go keygen 生成)，节点的KEYS_DIR里要有私钥
+│   │   └── 地址在链上账本里要有余额或stake (最初来自genesis.json)
 │   ├── BPM数据处理
 │   │   ├── 要求输入BPM
-│   │   ├── 生成新区块
+│   │   ├── bond/unbond/transfer 命令变成交易，放进下一个区块
+│   │   ├── 不是这个slot的proposer就不出块
+│   │   ├── 生成新区块 (带上RANDAO的commit和reveal)
 │   │   ├── 验证区块有效性
 │   │   ├── 发送到候选区块通道
 │   │   └── 继续等待下一个BPM输入
@@ -27,15 +31,17 @@ Proof of Stake 执行流程
 │
 ├── 权益证明核心逻辑 (pickWinner)
 │   ├── 获取临时区块池
-│   ├── 构建彩票池
-│   │   ├── 遍历临时区块
-│   │   ├── 检查验证者是否已在池中
-│   │   └── 根据代币余额加权添加到彩票池
-│   ├── 随机选择获胜者
-│   │   ├── 使用时间戳作为随机种子
-│   │   └── 从彩票池中随机选择
-│   ├── 添加获胜区块到主链
-│   └── 广播获胜信息
+│   ├── 等这个slot结束
+│   ├── 查这个slot的proposer (pos.Schedule)
+│   │   ├── 每个epoch开始时，用上一个epoch最后一个区块的账本定下验证者集合
+│   │   ├── 种子 = hash(那个区块的RANDAO mix + epoch)，每个节点算出来都一样
+│   │   └── 每个slot按stake加权，从验证者集合里选一个proposer
+│   ├── 把proposer在这个slot出的区块加到主链 (pos.Verifier会再检查一遍)
+│   ├── 广播获胜信息
+│   └── 投票 (vote, pos.Finality)
+│       ├── 本节点的验证者给新区块prevote
+│       ├── 超过2/3的stake prevote了，再precommit
+│       └── 超过2/3的stake precommit了，区块和它之前的区块都最终确定，Replace不能再回滚它们
 │
 └── 核心算法
     ├── 区块哈希计算 (calculateBlockHash)
@@ -43,26 +49,27 @@ Proof of Stake 执行流程
     └── 区块验证 (isBlockValid)
         ├── 索引连续性检查
         ├── 前哈希匹配检查
-        └── 当前哈希正确性检查
-
-// 构建彩票池的核心逻辑
-for _, block := range temp {
-    // 避免重复添加同一验证者
-    for _, node := range lotteryPool {
-        if block.Validator == node {
-            continue OUTER
-        }
-    }
-
-    // 根据代币余额加权
-    k, ok := setValidators[block.Validator]
-    if ok {
-        // 代币越多，被添加到彩票池的次数越多，中奖概率越高
-        for i := 0; i < k; i++ {
-            lotteryPool = append(lotteryPool, block.Validator)
-        }
+        ├── 当前哈希正确性检查
+        └── 签名是不是Validator的私钥签的
+
+// 选proposer的核心逻辑，见pos.NewSchedule
+// 原来用time.Now()做随机种子，别的节点没法验证，也能被预测
+// 现在种子只来自链上的数据，任何节点都能算出同一个leader，并检查区块是不是他出的
+ticket := hash(hash(mix, epoch), slot) mod totalStake
+sum := 0
+for _, address := range sorted(validators) {
+    sum += validators[address]
+    // stake越多，占的区间越大，被选中的概率越高
+    if ticket < sum {
+        return address
     }
 }
+
+// 原来的lotteryPool每个token存一次地址，stake 10^9 就要几个G的内存
+// pos.Sampler只给每个验证者存一个累加和，选的时候二分查找ticket落在谁的区间里
+
+// RANDAO: 每个区块里validator公布一个新secret的commit，并reveal上一次commit的secret
+// mix = hash(父区块mix + reveal)，secret在commit的时候就定了，出块的人没法挑种子
 客户端输入BPM → 生成区块 → 候选区块通道 → 临时区块池 → 权益证明选择 → 主区块链 → 状态广播
 数据输入阶段：handleConn处理客户端输入，输入广播
 验证阶段：isBlockValid验证区块有效性
@@ -78,99 +85,76 @@ for _, block := range temp {
 
 import (
 	"bufio"
-	"crypto/sha256"
+	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"net"
 	"os"
 	"strconv"
 	"sync"
 	"time"
 
+	"blockchain-go/chain"
+	"blockchain-go/pos"
+
 	"github.com/davecgh/go-spew/spew"
 	"github.com/joho/godotenv"
 )
 
 
-type Block struct {
-	Index     int
-	Timestamp string
-	BPM       int
-	Hash      string
-	PrevHash  string
-	Validator string
-}
-
 //candidateBlocks  handles incoming blocks for validation
-var candidateBlocks = make(chan Block)
+var candidateBlocks = make(chan chain.Block)
 
 //tempBlocks is simply a holding tank of blocks before one of them 
 //is picked as the winner to be added to Blockchain
-var tempBlocks []Block
+var tempBlocks []chain.Block
 
 
 // Blockchain is a series of validated Blocks
-var Blockchain []Block
+var Blockchain *chain.Chain
 
 //announcements broadcasts winning validator to all nodes 
 var announcements = make(chan string)
 
 var mutex = &sync.Mutex{}
 
-//validators keeps track of open validators and balances 
-var validators = make(map[string]int)
+//ledgers holds the stake of every validator as of any block. Stake starts
+//in genesis.json and only moves through bond/unbond/transfer transactions
+//in blocks, so every node with the same chain agrees on it
+var ledgers *pos.Ledgers
 
+//keys are the ed25519 keys of the validators that forge through this node,
+//by address, loaded from KEYS_DIR
+var keys map[string]ed25519.PrivateKey
 
-// SHA256 hasing
-// calculateHash is a simple SHA256 hashing function
-func calculateHash(s string) string {
-	h := sha256.New()
-	h.Write([]byte(s))
-	hashed := h.Sum(nil)
-	return hex.EncodeToString(hashed)
-}
-
-//calculateBlockHash returns the hash of all block information
-func calculateBlockHash(block Block) string {
-	record := strconv.Itoa(block.Index) + block.Timestamp + strconv.Itoa(block.BPM) + block.PrevHash
-	return calculateHash(record)
-}
+//secrets derives the RANDAO secrets of the validators forging through this node
+var secrets *pos.Secrets
 
-// generateBlock creates a new block using previous block's hash
-func generateBlock(oldBlock Block, BPM int, address string) (Block, error) {
+//clients is the number of registered connections, each waiting for announcements
+var clients int
 
-	var newBlock Block
 
-	t := time.Now()
-
-	newBlock.Index = oldBlock.Index + 1
-	newBlock.Timestamp = t.String()
-	newBlock.BPM = BPM
-	newBlock.PrevHash = oldBlock.Hash
-	newBlock.Hash = calculateBlockHash(newBlock)
-	newBlock.Validator = address //caveat 
-
-	return newBlock, nil
+// currentEpoch returns the epoch the slot clock is in now
+func currentEpoch() int {
+	clock := ledgers.Clock()
+	return clock.Epoch(clock.Slot(time.Now()))
 }
 
-func isBlockValid(newBlock, oldBlock Block) bool {
-	if oldBlock.Index+1 != newBlock.Index {
-		return false
-	}
-
-	if oldBlock.Hash != newBlock.PrevHash {
-		return false
-	}
-
-	if calculateBlockHash(newBlock) != newBlock.Hash {
-		return false
-	}
-
-	return true
+// generateBlock creates a new block on top of blocks, forged and signed by
+// address in the current slot. ledger is the state as of the last of blocks.
+func generateBlock(blocks []chain.Block, BPM int, address string, ledger *pos.Ledger) chain.Block {
+	newBlock := chain.GenerateBlock(blocks[len(blocks)-1], BPM)
+	//waiting stake transactions that still apply go into the block
+	clock := ledgers.Clock()
+	epoch := clock.Epoch(clock.BlockSlot(newBlock))
+	newBlock.Txs = ledger.Includable(mempool.pending(), newBlock.Index, epoch)
+	newBlock.TxRoot = chain.TxRoot(newBlock.Txs)
+	//fills in the RANDAO commit/reveal/mix, then Validator, the hash and the signature
+	secrets.Forge(&newBlock, blocks, keys[address])
+	return newBlock
 }
 
 /* 
@@ -197,24 +181,38 @@ func handleConn(conn net.Conn){
 
 
 	//register
+	//stake is in the ledger on chain, so a validator only says who it is
 	var address string
-	io.WriteString(conn,"Enter token balance:");
-	scanBalance := bufio.NewScanner(conn)
+	io.WriteString(conn,"Enter validator address:");
+	scanAddress := bufio.NewScanner(conn)
 	
-	for scanBalance.Scan(){
-		balance, err := strconv.Atoi(scanBalance.Text())
+	for scanAddress.Scan(){
+		address = scanAddress.Text()
+		ledger, err := ledgers.At(Blockchain.Blocks())
 		if err != nil {
-			log.Printf("%v not a number: %v", scanBalance.Text(), err)
+			log.Println(err)
+			return
+		}
+		if !ledger.Known(address) {
+			io.WriteString(conn, "\nno balance or stake for "+address+"\n")
+			return
+		}
+		//the address is a public key, only its private key can sign for it
+		if _, ok := keys[address]; !ok {
+			io.WriteString(conn, "\nno key for "+address+" in KEYS_DIR\n")
 			return
 		}
 		
-		fmt.Println(balance)
-		t := time.Now()
-		address = calculateHash(t.String())
-		validators[address] = balance
-		fmt.Println(validators)
+		fmt.Println(address, ledger.Bonded[address])
+		io.WriteString(conn, describeBalance(address, ledger)+txHelp)
+		mutex.Lock()
+		clients++
+		mutex.Unlock()
 		break
 	}
+	if address == "" {
+		return
+	}
 
 
 	//bpm
@@ -223,37 +221,100 @@ func handleConn(conn net.Conn){
 
 
 	//add candidate
+	//forged is the last slot this connection forged in, a second block in
+	//the same slot would be equivocation
+	forged := -1
 	go func(){	
 		for {
 			for scanBPM.Scan(){
+				// Blocks在chain内部加锁，返回的是副本
+				blocks := Blockchain.Blocks()
+				oldLastIndex := blocks[len(blocks)-1]
+				//the state as of the tip, which the next block builds on
+				ledger, err := ledgers.At(blocks)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+
+				//stake commands become transactions for the next blocks
+				if scanBPM.Text() == "balance" {
+					io.WriteString(conn, describeBalance(address, ledger))
+					io.WriteString(conn, "\nEnter a new BPM:")
+					continue
+				}
+				if scanBPM.Text() == "finalized" {
+					io.WriteString(conn, describeFinalized())
+					io.WriteString(conn, "\nEnter a new BPM:")
+					continue
+				}
+				if tx, ok, err := parseTx(address, scanBPM.Text()); ok {
+					if err == nil {
+						tx.Nonce = mempool.nextNonce(address, ledger)
+						tx.Sign(keys[address])
+						err = mempool.submit(tx, ledger, oldLastIndex.Index+1, currentEpoch())
+					}
+					if err != nil {
+						io.WriteString(conn, "\n"+err.Error()+"\n")
+					} else {
+						io.WriteString(conn, "\nqueued "+tx.Type+" "+tx.Hash()+"\n")
+					}
+					io.WriteString(conn, "\nEnter a new BPM:")
+					continue
+				}
+
 				bpm, err := strconv.Atoi(scanBPM.Text())
 				if err != nil {
 					log.Printf("%v not a number: %v", scanBPM.Text(), err)
-					// 是的，delete(validators, address)会从validators映射中删除该address对应的验证者
-					// 这里可以添加一些日志输出以便调试
-					log.Printf("删除无效验证者: %s", address)
-					delete(validators, address)
+					// stake是链上共识的一部分，不能因为输错就删掉，只断开这个连接
+					log.Printf("断开验证者: %s", address)
+					mutex.Lock()
+					clients--
+					mutex.Unlock()
 					conn.Close()
+					return
 				}
 
 				// 在处理区块链数据时需要遵循以下加锁原则：
 				// 1. 读取共享数据时：如果只是简单读取且后续没有修改操作，可以不加锁
 				// 2. 修改共享数据时：必须加锁保护，防止并发修改
 
-				mutex.Lock()
-				oldLastIndex := Blockchain[len(Blockchain)-1]
-				mutex.Unlock()
+				// 时间按genesis的时间分成slot，每个slot只有一个proposer能出块
+				// proposer在epoch开始时按那时候的stake排好，epoch中间stake变了要到下个epoch才算
+				clock := ledgers.Clock()
+				slot := clock.Slot(time.Now())
+				if slot == forged {
+					io.WriteString(conn, fmt.Sprintf("\nalready forged in slot %d, wait for the next slot\n", slot))
+					io.WriteString(conn, "\nEnter a new BPM:")
+					continue
+				}
+				if clock.BlockSlot(oldLastIndex) >= slot {
+					io.WriteString(conn, fmt.Sprintf("\nslot %d already has block %d, wait for the next slot\n", slot, oldLastIndex.Index))
+					io.WriteString(conn, "\nEnter a new BPM:")
+					continue
+				}
+				schedule, err := ledgers.Schedule(blocks, slot)
+				if err != nil || schedule.Proposer(slot) != address {
+					proposer := ""
+					if schedule != nil {
+						proposer = schedule.Proposer(slot)
+					}
+					io.WriteString(conn, fmt.Sprintf("\nslot %d is for validator %s to forge\n", slot, proposer))
+					io.WriteString(conn, "\nEnter a new BPM:")
+					continue
+				}
 
 				// 在generateBlock时不加锁是因为:
 				// 1. generateBlock只是基于旧区块创建新区块，不直接修改区块链状态
-				newBlock, err := generateBlock(oldLastIndex, bpm, address)
-
-				if err != nil{
-					log.Println(err)
+				newBlock := generateBlock(blocks, bpm, address, ledger)
+				if clock.BlockSlot(newBlock) != slot {
+					io.WriteString(conn, fmt.Sprintf("\nslot %d is over\n", slot))
+					io.WriteString(conn, "\nEnter a new BPM:")
 					continue
 				}
 
-				if isBlockValid(newBlock, oldLastIndex) {
+				if chain.IsBlockValid(newBlock, oldLastIndex) {
+					forged = slot
 					candidateBlocks <- newBlock
 				}
 
@@ -265,9 +326,7 @@ func handleConn(conn net.Conn){
 	// simulate receiving broadcast ,watch data
 	for {
 		time.Sleep(30 * time.Second) // 添加适当的延迟，避免无限快速广播
-		mutex.Lock()
-		output, err := json.Marshal(Blockchain) //读取和修改
-		mutex.Unlock()
+		output, err := json.Marshal(Blockchain.Blocks()) //读取
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -276,79 +335,81 @@ func handleConn(conn net.Conn){
 }
 
 
-// pickWinner creates a lottery pool of validators and chooses the validator who gets to forge a block to the blockchain
-// by random selecting from the pool, weighted by amount of tokens staked
+// pickWinner waits for the current slot to end, then adds the block its
+// proposer forged in it to the blockchain. Proposers are drawn for a whole
+// epoch at its start, by pos.Schedule, from the stake as of the last block
+// before the epoch and a seed taken from the chain itself, so every node
+// draws the same ones and can check that a block came from its slot's
+// proposer. Blocks forged in any other slot, by anyone else or arriving
+// after their slot is over are dropped.
 // pick winner 实际上是从TempBlocks往BlockChain里加东西
 func pickWinner(){
-	time.Sleep(30 * time.Second)
+	clock := ledgers.Clock()
+	slot := clock.Slot(time.Now())
+	time.Sleep(time.Until(clock.SlotStart(slot + 1)))
 
 	mutex.Lock()
 	temp := tempBlocks //because of reading
+	// 清理临时区块池
+	tempBlocks = []chain.Block{}
 	mutex.Unlock()
 
-	lotteryPool := []string{}
-
-
-	if len(temp) > 0 {
-
+	if len(temp) == 0 {
+		return
+	}
 
-	//continue and break jump label
-	OUTER:
-		// slightly modified traditional proof of stake algorithm
-		// from all validators who submitted a block, weight them by the number of staked tokens
-		// in traditional proof of stake, validators can participate without sub
-		for _, block := range temp {
-			// if already in lottery pool, skip
-			for _, node := range lotteryPool {
-				if block.Validator == node {
-					continue OUTER
-				}
-			}
+	blocks := Blockchain.Blocks()
+	parent := blocks[len(blocks)-1]
+	schedule, err := ledgers.Schedule(blocks, slot)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	proposer := schedule.Proposer(slot)
 
-			// lock list of validators to prevent data race
-			mutex.Lock()
-			setValidators := validators
-			mutex.Unlock()
-			//"comma ok"模式。所以即使map中存储的是int值，你仍然可以获取到两个返回值：值本身和一个表示键是否存在的布尔值。
-			k, ok := setValidators[block.Validator]
-			if ok {
-				//如果该验证者存在于映射中（ok为true），则根据权重值将该验证者多次添加到lotteryPool中
-				//根据权重往池子里加是个好思路
-				for i := 0; i < k; i++ {
-					lotteryPool = append(lotteryPool, block.Validator)
-				}
-			}
+	// add block of winner to blockchain and let all the other nodes know
+	for _, block := range temp {
+		//candidates forged on an older tip or in another slot are stale
+		if block.Validator != proposer || block.PrevHash != parent.Hash || clock.BlockSlot(block) != slot {
+			continue
 		}
-
-		// randomly pick winner from lottery pool
-		//使用当前时间的Unix时间戳作为种子创建一个新的随机数源，可以想一下为什么用时间戳做种子
-		s := rand.NewSource(time.Now().Unix())
-		//基于上边的seed，创建随机数生成实例
-		r := rand.New(s)
-		//r.Intn(len(lotteryPool)) 生成一个0到lotteryPool长度减1之间的随机整数
-		lotteryWinner := lotteryPool[r.Intn(len(lotteryPool))]
-		// add block of winner to blockchain and let all the other nodes know
-
-		for _, block := range temp {
-			if block.Validator == lotteryWinner {
-				mutex.Lock()
-				Blockchain = append(Blockchain, block)
-				mutex.Unlock()
-				for range validators {
-					announcements <- "\nwinning validator: " + lotteryWinner + "\n"
-				}
-				break
-			}
+		if err := Blockchain.Append(block); err != nil {
+			log.Println(err)
+			continue
+		}
+		//drop the transactions the block included
+		if next, err := ledgers.At(append(blocks, block)); err == nil {
+			mempool.prune(next, block.Index+1, clock.Epoch(slot+1))
+		}
+		mutex.Lock()
+		n := clients
+		mutex.Unlock()
+		for i := 0; i < n; i++ {
+			announcements <- fmt.Sprintf("\nwinning validator: %s (slot %d, epoch %d)\n", proposer, slot, schedule.Epoch)
 		}
+		//validators on this node vote for the new block
+		vote(block.Index)
+		return
 	}
-
-	// 清理临时区块池
-	mutex.Lock()
-	tempBlocks = []Block{}
-	mutex.Unlock()
+	log.Printf("validator %s had slot %d but did not forge in it", proposer, slot)
 }
 
 func main(){
+	//go run main.go init 写出genesis.json
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		if err := chain.InitCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	//go run main.go keygen 生成验证者的ed25519密钥，打印地址(公钥)
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		if err := chain.KeygenCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	
 	err := godotenv.Load() 
 	if err != nil {
@@ -356,11 +417,60 @@ func main(){
 	}
 	
 	// create genesis block 
-	t := time.Now()
-	genesisBlock := Block{}
-	genesisBlock = Block{0, t.String(), 0, calculateBlockHash(genesisBlock), "", ""}
-	spew.Dump(genesisBlock)
-	Blockchain = append(Blockchain,genesisBlock)
+	//所有节点从同一个GENESIS_FILE得到同一个创世区块
+	genesis, err := chain.LoadGenesis(os.Getenv("GENESIS_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	//stakes start from genesis.json, every node elects leaders from the same stakes
+	if len(genesis.Validators) == 0 {
+		log.Fatal("genesis has no validators, set them with: go run main.go init -validator addr=stake")
+	}
+	//slot和epoch从genesis的时间算，所有节点要用同一个slot长度
+	if genesis.Staking.SlotDuration <= 0 {
+		log.Fatal("genesis has no slot duration, set it with: go run main.go init -slot-duration 30s")
+	}
+	ledgers = pos.NewLedgers(genesis)
+
+	//KEYS_DIR里是在这个节点出块的验证者的私钥，不设置时是keys
+	keysDir := os.Getenv("KEYS_DIR")
+	if keysDir == "" {
+		keysDir = "keys"
+	}
+	keys, err = chain.ReadKeys(keysDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d validator keys in %s", len(keys), keysDir)
+
+	//RANDAO_KEY (hex) lets the node reveal its secrets again after a
+	//restart, so the validators above can't forge without it
+	key, err := hex.DecodeString(os.Getenv("RANDAO_KEY"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := pos.CheckRandaoKey(len(keys), key); err != nil {
+		log.Fatal(err)
+	}
+	secrets = pos.NewSecrets(key)
+
+	//CHAIN_FILE里有区块的话就从文件恢复，否则从创世区块开始
+	//pos.Verifier检查每个区块都是选出来的leader出的，reveal和commit对得上，交易在账本上能执行
+	Blockchain, err = chain.OpenPath(os.Getenv("CHAIN_FILE"), genesis, pos.Verifier{Ledgers: ledgers})
+	if err != nil {
+		log.Fatal(err)
+	}
+	spew.Dump(Blockchain.Blocks())
+
+	//最终确定(finalized)的区块不会被回滚，证明(precommit签名)存在CHAIN_FILE.final里
+	finality = pos.NewFinality(ledgers)
+	if path := os.Getenv("CHAIN_FILE"); path != "" {
+		finalityFile = path + ".final"
+	}
+	if err := loadCertificate(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("finalized block %d", Blockchain.Finalized().Index)
 
 	//start TCP and serve TCP server
 	//启动时tcp:port.如果godotenv已经load，using it just need to os.getEnv
@@ -375,6 +485,13 @@ func main(){
 	go func(){
 		for candidate := range candidateBlocks {
 			mutex.Lock()
+			//两个不同的区块，同一个高度，同一个验证者签名 = equivocation，要被slash
+			for _, other := range tempBlocks {
+				if other.Validator == candidate.Validator && other.Index == candidate.Index && other.Hash != candidate.Hash {
+					reportEquivocation(other, candidate)
+					break
+				}
+			}
 			tempBlocks = append(tempBlocks, candidate)
 			mutex.Unlock() 
 		}
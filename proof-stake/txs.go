@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+
+	"blockchain-go/chain"
+	"blockchain-go/pos"
+)
+
+// txHelp lists the stake commands a validator can type instead of a BPM
+const txHelp = "\nstake commands: bond <amount>, unbond <amount>, transfer <to> <amount>, balance, finalized\n"
+
+// txPool holds the stake transactions typed in by validators until the
+// leader puts them in a block
+type txPool struct {
+	mu  sync.Mutex
+	txs []chain.Tx
+}
+
+var mempool txPool
+
+// pending returns the waiting transactions, oldest first
+func (p *txPool) pending() []chain.Tx {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]chain.Tx(nil), p.txs...)
+}
+
+// submit checks tx on top of ledger, the state at the tip, and the
+// transactions already waiting, and queues it if it applies to a block at
+// height in epoch
+func (p *txPool) submit(tx chain.Tx, ledger *pos.Ledger, height, epoch int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	next := ledger.Next(height, epoch)
+	for _, pending := range p.txs {
+		next.ApplyTx(pending, height, epoch)
+	}
+	if err := next.ApplyTx(tx, height, epoch); err != nil {
+		return err
+	}
+	p.txs = append(p.txs, tx)
+	return nil
+}
+
+// nextNonce returns the nonce of the next transaction from address.
+// Evidence against address names it in From but isn't sent by it, so like
+// in the ledger it doesn't use up a nonce.
+func (p *txPool) nextNonce(address string, ledger *pos.Ledger) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	nonce := ledger.Nonces[address]
+	for _, tx := range p.txs {
+		if tx.From == address && tx.Type != pos.TxEvidence && tx.Nonce >= nonce {
+			nonce = tx.Nonce + 1
+		}
+	}
+	return nonce
+}
+
+// prune drops the transactions that no longer apply after a new block,
+// most of all the ones it included
+func (p *txPool) prune(ledger *pos.Ledger, height, epoch int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.txs = ledger.Includable(p.txs, height, epoch)
+}
+
+// parseTx reads a stake command typed by address. ok is false if line is
+// not a stake command at all, e.g. a BPM.
+func parseTx(address, line string) (tx chain.Tx, ok bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return tx, false, nil
+	}
+	tx = chain.Tx{Type: fields[0], From: address}
+	var amount string
+	switch {
+	case (tx.Type == pos.TxBond || tx.Type == pos.TxUnbond) && len(fields) == 2:
+		amount = fields[1]
+	case tx.Type == pos.TxTransfer && len(fields) == 3:
+		tx.To, amount = fields[1], fields[2]
+	case tx.Type == pos.TxBond || tx.Type == pos.TxUnbond || tx.Type == pos.TxTransfer:
+		return tx, true, fmt.Errorf("usage: %s", strings.TrimSpace(txHelp))
+	default:
+		return tx, false, nil
+	}
+	tx.Amount, err = strconv.ParseUint(amount, 10, 64)
+	return tx, true, err
+}
+
+// describeBalance shows what address holds in ledger
+func describeBalance(address string, ledger *pos.Ledger) string {
+	var unbonding uint64
+	for _, u := range ledger.Unbonding {
+		if u.Address == address {
+			unbonding += u.Amount
+		}
+	}
+	jailed := ""
+	if until, ok := ledger.Jailed[address]; ok {
+		jailed = fmt.Sprintf(", jailed until epoch %d", until)
+	}
+	return fmt.Sprintf("\n%s: balance %d, bonded %d, unbonding %d%s\n",
+		address, ledger.Balances[address], ledger.Bonded[address], unbonding, jailed)
+}
+
+// reportEquivocation queues the evidence that the validator of a and b
+// signed both, so the next block slashes it
+func reportEquivocation(a, b chain.Block) {
+	blocks := Blockchain.Blocks()
+	ledger, err := ledgers.At(blocks)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	tx := pos.NewEvidence(a, b)
+	if err := mempool.submit(tx, ledger, blocks[len(blocks)-1].Index+1, currentEpoch()); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("validator %s signed two blocks at height %d, queued evidence %s", a.Validator, a.Index, tx.Hash())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"blockchain-go/chain"
+	"blockchain-go/pow"
+)
+
+// retarget decides the Bits of every new block, see genesis.json "retarget"
+var retarget pow.Retargeter
+
+// retargetConfig is kept for reporting only
+var retargetConfig chain.RetargetConfig
+
+// difficultyResponse is what GET /difficulty returns
+type difficultyResponse struct {
+	Algorithm     string
+	TargetSpacing string
+	// Bits/Target of the tip, NextBits/NextTarget for the block being mined
+	Bits       string
+	Target     string
+	NextBits   string
+	NextTarget string
+	Intervals  intervalsResponse
+}
+
+type intervalsResponse struct {
+	Count int
+	Mean  string
+	Min   string
+	Max   string
+	Last  string
+}
+
+// GET /difficulty?n=20 shows the current target and stats of the last n block intervals
+func handleGetDifficulty(w http.ResponseWriter, r *http.Request) {
+	n := 20
+	if s := r.URL.Query().Get("n"); s != "" {
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 1 {
+			respondWithJSON(w, r, http.StatusBadRequest, "n must be a positive number")
+			return
+		}
+		n = v
+	}
+
+	blocks := Blockchain.Blocks()
+	tip := blocks[len(blocks)-1]
+	next := retarget.NextBits(blocks)
+	stats := pow.IntervalStats(blocks, n)
+
+	algorithm := retargetConfig.Algorithm
+	if algorithm == "" {
+		algorithm = "none"
+	}
+	respondWithJSON(w, r, http.StatusOK, difficultyResponse{
+		Algorithm:     algorithm,
+		TargetSpacing: time.Duration(retargetConfig.TargetSpacing).String(),
+		Bits:          fmt.Sprintf("%08x", tip.Bits),
+		Target:        fmt.Sprintf("%064x", chain.CompactToBig(tip.Bits)),
+		NextBits:      fmt.Sprintf("%08x", next),
+		NextTarget:    fmt.Sprintf("%064x", chain.CompactToBig(next)),
+		Intervals: intervalsResponse{
+			Count: stats.Count,
+			Mean:  stats.Mean.String(),
+			Min:   stats.Min.String(),
+			Max:   stats.Max.String(),
+			Last:  stats.Last.String(),
+		},
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"blockchain-go/chain"
+
+	"github.com/gorilla/mux"
+)
+
+// JobStatus is where a mining job is in its life
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobMining    JobStatus = "mining"
+	JobDone      JobStatus = "done"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// jobRetention is how long finished jobs can still be looked up
+const jobRetention = time.Hour
+
+// Job is a BPM submitted with POST /, mined in the background in the order
+// it was submitted
+type Job struct {
+	ID     string
+	BPM    int
+	Status JobStatus
+	// Position is the number of jobs ahead of a queued job
+	Position  int `json:",omitempty"`
+	Submitted time.Time
+	Started   time.Time `json:",omitzero"`
+	Finished  time.Time `json:",omitzero"`
+	// Hashes is how many nonces were tried for this job so far
+	Hashes   uint64       `json:",omitempty"`
+	Hashrate float64      `json:",omitempty"`
+	Block    *chain.Block `json:",omitempty"`
+	Error    string       `json:",omitempty"`
+
+	cancel      context.CancelFunc
+	startHashes uint64
+}
+
+// jobQueue keeps every job by ID and the queued ones in FIFO order
+type jobQueue struct {
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	pending []*Job
+	// wake is signalled whenever a job is queued
+	wake chan struct{}
+}
+
+var jobs = &jobQueue{
+	jobs: make(map[string]*Job),
+	wake: make(chan struct{}, 1),
+}
+
+var errJobFinished = errors.New("job already finished")
+
+// submit queues a job for bpm and returns a snapshot of it
+func (q *jobQueue) submit(bpm int) Job {
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := &Job{
+		ID:        hex.EncodeToString(id),
+		BPM:       bpm,
+		Status:    JobQueued,
+		Submitted: time.Now(),
+	}
+
+	q.mu.Lock()
+	q.prune()
+	q.jobs[job.ID] = job
+	q.pending = append(q.pending, job)
+	snapshot := q.snapshot(job)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return snapshot
+}
+
+// next waits for the oldest queued job and marks it as mining. The returned
+// context is cancelled when the job is. next returns nil once ctx is done.
+func (q *jobQueue) next(ctx context.Context) (*Job, context.Context) {
+	for {
+		q.mu.Lock()
+		if len(q.pending) > 0 {
+			job := q.pending[0]
+			q.pending = q.pending[1:]
+			jobCtx, cancel := context.WithCancel(ctx)
+			job.Status = JobMining
+			job.Started = time.Now()
+			job.cancel = cancel
+			job.startHashes = miner.Hashes()
+			q.mu.Unlock()
+			return job, jobCtx
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-q.wake:
+		}
+	}
+}
+
+// finish records the outcome of mining job. A block that was mined counts
+// even if the job was cancelled meanwhile: it is on the chain already.
+func (q *jobQueue) finish(job *Job, b chain.Block, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.cancel()
+	job.Finished = time.Now()
+	job.Hashes = miner.Hashes() - job.startHashes
+	if secs := job.Finished.Sub(job.Started).Seconds(); secs > 0 {
+		job.Hashrate = float64(job.Hashes) / secs
+	}
+	switch {
+	case err == nil:
+		job.Status = JobDone
+		job.Block = &b
+	case job.Status == JobCancelled && errors.Is(err, context.Canceled):
+	default:
+		job.Status = JobFailed
+		job.Error = err.Error()
+	}
+}
+
+// cancel stops a queued or running job
+func (q *jobQueue) cancel(id string) (Job, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false, nil
+	}
+	switch job.Status {
+	case JobQueued:
+		for i, p := range q.pending {
+			if p == job {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				break
+			}
+		}
+		job.Finished = time.Now()
+	case JobMining:
+		//finish fills in Finished once the miner has stopped
+		job.cancel()
+	default:
+		return q.snapshot(job), true, errJobFinished
+	}
+	job.Status = JobCancelled
+	return q.snapshot(job), true, nil
+}
+
+// get returns a snapshot of the job with the given id
+func (q *jobQueue) get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return q.snapshot(job), true
+}
+
+// list returns snapshots of the running job followed by the queued ones
+func (q *jobQueue) list() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := []Job{}
+	for _, job := range q.jobs {
+		if job.Status == JobMining {
+			list = append(list, q.snapshot(job))
+		}
+	}
+	for _, job := range q.pending {
+		list = append(list, q.snapshot(job))
+	}
+	return list
+}
+
+// snapshot copies job, filling in its live progress. q.mu must be held.
+func (q *jobQueue) snapshot(job *Job) Job {
+	s := *job
+	switch job.Status {
+	case JobQueued:
+		for i, p := range q.pending {
+			if p == job {
+				s.Position = i
+				break
+			}
+		}
+	case JobMining:
+		s.Hashes = miner.Hashes() - job.startHashes
+		s.Hashrate = miner.Hashrate()
+	}
+	return s
+}
+
+// prune forgets jobs that finished more than jobRetention ago. q.mu must be held.
+func (q *jobQueue) prune() {
+	for id, job := range q.jobs {
+		if !job.Finished.IsZero() && time.Since(job.Finished) > jobRetention {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// GET /jobs lists the running and queued jobs
+func handleGetJobs(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, r, http.StatusOK, jobs.list())
+}
+
+// GET /jobs/{id} shows the status, progress and, once mined, the block of a job
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := jobs.get(mux.Vars(r)["id"])
+	if !ok {
+		respondWithJSON(w, r, http.StatusNotFound, "no such job")
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, job)
+}
+
+// DELETE /jobs/{id} cancels a job that hasn't finished yet
+func handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	job, ok, err := jobs.cancel(mux.Vars(r)["id"])
+	if !ok {
+		respondWithJSON(w, r, http.StatusNotFound, "no such job")
+		return
+	}
+	if err != nil {
+		respondWithJSON(w, r, http.StatusConflict, job)
+		return
+	}
+	respondWithJSON(w, r, http.StatusOK, job)
+}
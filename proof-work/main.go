@@ -1,44 +1,29 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
+	"context"
 	"encoding/json"
-	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 
+	"blockchain-go/chain"
+	"blockchain-go/pow"
+
 	"github.com/davecgh/go-spew/spew"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 )
-const difficulty = 1
-
-type Block struct {
-        Index      int
-        Timestamp  string
-        BPM        int
-        Hash       string
-        PrevHash   string
-        Difficulty int
-        Nonce      string
-}
 
-var Blockchain []Block
+var Blockchain *chain.Chain
 
 type Message struct {
         BPM int
 }
 
-//get the mutex instance
-var mutex = &sync.Mutex{}
-
 func run() error{
 	//start with a server
 	mux := makeMuxRouter()
@@ -68,13 +53,18 @@ func makeMuxRouter() http.Handler{
 	muxRouter :=  mux.NewRouter()
 	muxRouter.HandleFunc("/",handleGetBlockchain).Methods("GET")
 	muxRouter.HandleFunc("/",handleWriteBlock).Methods("POST")
+	muxRouter.HandleFunc("/difficulty",handleGetDifficulty).Methods("GET")
+	muxRouter.HandleFunc("/miner",handleGetMiner).Methods("GET")
+	muxRouter.HandleFunc("/jobs",handleGetJobs).Methods("GET")
+	muxRouter.HandleFunc("/jobs/{id}",handleGetJob).Methods("GET")
+	muxRouter.HandleFunc("/jobs/{id}",handleCancelJob).Methods("DELETE")
 	return muxRouter;
 
 }
 
 
 func handleGetBlockchain(w http.ResponseWriter, r *http.Request){
-	bytes, err := json.MarshalIndent(Blockchain, "", "  ")
+	bytes, err := json.MarshalIndent(Blockchain.Blocks(), "", "  ")
 	//todo
 	if err != nil {
 		http.Error(w,err.Error(),http.StatusInternalServerError)
@@ -113,100 +103,63 @@ func handleWriteBlock(w http.ResponseWriter, r * http.Request){
 	}
 	defer r.Body.Close()
 
-	//ensure atomicity when creating new block 
-	mutex.Lock()
-
-	newBlock := generateBlock(Blockchain[len(Blockchain)-1], m.BPM)
-	mutex.Unlock()
-
-	if isBlockValid(newBlock, Blockchain[len(Blockchain)-1]) {
-		Blockchain = append(Blockchain, newBlock)
-		spew.Dump(Blockchain)
-	}   
-	respondWithJSON(w, r, http.StatusCreated, newBlock)
+	//挖矿在后台的mineLoop里按提交顺序进行，这里只排队，马上返回job的ID
+	//用GET /jobs/{id}查看进度和挖出来的区块
+	job := jobs.submit(m.BPM)
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	respondWithJSON(w, r, http.StatusAccepted, job)
 
 }	
 
-func isBlockValid(newBlock, oldBlock Block) bool {
-	if oldBlock.Index+1 != newBlock.Index {
-			return false
-	}
-
-	if oldBlock.Hash != newBlock.PrevHash {
-			return false
-	}
-
-	if calculateHash(newBlock) != newBlock.Hash {
-			return false
-	}
-
-	return true
-}
-
-func calculateHash(block Block) string {
-	record := strconv.Itoa(block.Index) + block.Timestamp + strconv.Itoa(block.BPM) + block.PrevHash + block.Nonce
-	h := sha256.New()
-	h.Write([]byte(record))
-	hashed := h.Sum(nil)
-	return hex.EncodeToString(hashed)
-}
-
-
-//distinguish hash valid with block valid
-func isHashValid(hash string, difficulty int) bool{
-	//difficulty is repeating count
-	prefix := strings.Repeat("0",difficulty)
-	return strings.HasPrefix(hash, prefix)
+// generateBlock creates the block to mine on top of blocks; the Miner then
+// searches for its Nonce
+func generateBlock(blocks []chain.Block, BPM int) chain.Block{
+	newBlock := chain.GenerateBlock(blocks[len(blocks)-1], BPM)
+	//the target is retargeted from the chain so far
+	newBlock.Bits = retarget.NextBits(blocks)
+	return newBlock
 }
 
-
-//perhaps need to change , generate block 
-func generateBlock(oldBlock Block, BPM int) Block{
-	var newBlock Block
-	t := time.Now()
-
-	newBlock.Index = oldBlock.Index +1
-	newBlock.Timestamp = t.String()
-	newBlock.BPM = BPM
-	newBlock.PrevHash = oldBlock.Hash
-	newBlock.Difficulty = difficulty
-
-	//需要一直算下去
-	for i := 0 ; ; i++{
-		//将i转化字符串
-		hex := fmt.Sprintf("%x", i)
-		//通过改变Nonce，再对block算哈希，看是否满足情况
-        newBlock.Nonce = hex
-		if !isHashValid(calculateHash(newBlock),newBlock.Difficulty){
-			fmt.Println(calculateHash(newBlock), " do more work!")
-			time.Sleep(time.Second)
-			continue
-		}else {
-			fmt.Println(calculateHash(newBlock), " work done!")
-            newBlock.Hash = calculateHash(newBlock)
-            break
+func main(){
+	//go run main.go init 写出genesis.json
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		if err := chain.InitCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
 		}
+		return
 	}
-	return newBlock
-}
 
-func main(){
 	//这里Load，在要使用的时候Getenv
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal(err)
 	}   
 	
-	go func(){
-		t := time.Now()
-		genesisBlock := Block{}
-		genesisBlock = Block{0, t.String(), 0, calculateHash(genesisBlock), "", difficulty, ""} 
-		spew.Dump(genesisBlock)
+	//所有节点从同一个GENESIS_FILE得到同一个创世区块
+	genesis, err := chain.LoadGenesis(os.Getenv("GENESIS_FILE"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if genesis.Bits == 0 {
+		log.Fatal("genesis has no proof-work target, set one with: go run main.go init -bits 0x200fffff")
+	}
+	retargetConfig = genesis.Retarget
+	retarget, err = pow.NewRetargeter(genesis.Retarget)
+	if err != nil {
+		log.Fatal(err)
+	}
+	//CHAIN_FILE里有区块的话就从文件恢复，否则从创世区块开始
+	//pow.Verifier让chain检查每个区块的Bits是否符合调整后的难度，hash是否小于target
+	Blockchain, err = chain.OpenPath(os.Getenv("CHAIN_FILE"), genesis, pow.Verifier{Retarget: retarget})
+	if err != nil {
+		log.Fatal(err)
+	}
+	spew.Dump(Blockchain.Blocks())
 
-		mutex.Lock()
-		Blockchain = append(Blockchain, genesisBlock)
-		mutex.Unlock()
-	}()
+	//MINER_THREADS不设置就每个CPU一个worker
+	threads, _ := strconv.Atoi(os.Getenv("MINER_THREADS"))
+	miner = pow.NewMiner(threads)
+	go mineLoop(context.Background())
 
 	log.Fatal(run())
 }
@@ -220,6 +173,9 @@ func main(){
 前导0个数只是目标值的一种可视化表现方式
 比特币的难度调整算法更精确(BTC每2016个区块调整一次)
 实际实现通过比较哈希数值是否小于目标数值，而非仅看前导0
+
+这里也是这样做的：区块头里存compact格式的Bits，见pow.CheckProofOfWork，
+分叉时chain按ChainWork选最重的链，而不是最长的链
 */
 
 
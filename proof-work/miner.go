@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"blockchain-go/chain"
+	"blockchain-go/pow"
+)
+
+// miner seals blocks in the background, independent of request handling
+var miner *pow.Miner
+
+// mineLoop mines the queued jobs one after another until ctx is done
+func mineLoop(ctx context.Context) {
+	for {
+		job, jobCtx := jobs.next(ctx)
+		if job == nil {
+			return
+		}
+		b, err := mineBlock(jobCtx, job.BPM)
+		jobs.finish(job, b, err)
+	}
+}
+
+// mineBlock mines a block for bpm on top of the current tip and appends it.
+// If a competing block lands on the chain first, the search is cancelled
+// and started again on the new tip.
+func mineBlock(ctx context.Context, bpm int) (chain.Block, error) {
+	tips, stop := Blockchain.Subscribe()
+	defer stop()
+
+	for {
+		template := generateBlock(Blockchain.Blocks(), bpm)
+
+		mineCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-tips:
+					if Blockchain.Tip().Hash != template.PrevHash {
+						cancel()
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+
+		start := time.Now()
+		b, err := miner.Mine(mineCtx, template)
+		close(done)
+		cancel()
+
+		if ctx.Err() != nil {
+			return chain.Block{}, ctx.Err()
+		}
+		if errors.Is(err, context.Canceled) {
+			log.Printf("block %d was mined by someone else, starting over on the new tip", template.Index)
+			continue
+		}
+		if err != nil {
+			return chain.Block{}, err
+		}
+		//the chain keeps its own lock, so Append is atomic
+		if err := Blockchain.Append(b); err != nil {
+			if Blockchain.Tip().Hash == template.PrevHash {
+				return chain.Block{}, err
+			}
+			//lost the race to a block that arrived just now
+			continue
+		}
+		log.Printf("mined block %d in %s at %.0f H/s", b.Index, time.Since(start).Round(time.Millisecond), miner.Hashrate())
+		return b, nil
+	}
+}
+
+// minerResponse is what GET /miner returns
+type minerResponse struct {
+	Workers  int
+	Hashes   uint64
+	Hashrate float64
+}
+
+// GET /miner shows the hashrate of the background miner
+func handleGetMiner(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, r, http.StatusOK, minerResponse{
+		Workers:  miner.Workers(),
+		Hashes:   miner.Hashes(),
+		Hashrate: miner.Hashrate(),
+	})
+}